@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"github.com/segfaultx/simple_rest/pkg/transfer"
+	"os"
+)
+
+// runImport implements "main import [flags] <file>" and returns the exit code.
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "", "input format, csv or ndjson (default: derived from the file extension)")
+	tenantId := flags.String("tenant", repo.DefaultTenant, "tenant to import into")
+	dryRun := flags.Bool("dry-run", false, "validate and report without writing")
+	restore := flags.Bool("restore", false, "undelete trashed products that rows match by id or sku")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: main import [-format csv|ndjson] [-tenant id] [-dry-run] [-restore] <file>")
+		return 2
+	}
+	filename := flags.Arg(0)
+	if *format == "" {
+		*format = transfer.FormatFromFilename(filename)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+	repository := setupRepo()
+	defer repository.Close()
+	report, err := transfer.Import(file, *format, repository.ForTenant(*tenantId), repo.ImportOptions{DryRun: *dryRun, Restore: *restore})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, lineError := range report.Errors {
+		fmt.Fprintf(os.Stderr, "%s:%d: %s\n", filename, lineError.Line, lineError.Error)
+	}
+	verb := "imported"
+	if report.DryRun {
+		verb = "would import"
+	}
+	fmt.Printf("%s %d of %d rows, %d failed\n", verb, report.Imported, report.Processed, len(report.Errors))
+	if len(report.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -5,14 +5,24 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/segfaultx/simple_rest/pkg/auth"
 	"github.com/segfaultx/simple_rest/pkg/handlers"
+	"github.com/segfaultx/simple_rest/pkg/mail"
 	"github.com/segfaultx/simple_rest/pkg/repo"
+	"github.com/segfaultx/simple_rest/pkg/suggest"
+	"github.com/segfaultx/simple_rest/pkg/tenant"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 )
 
+const (
+	defaultTrashRetention = 30 * 24 * time.Hour
+	defaultIdempotencyTTL = 24 * time.Hour
+	purgeInterval         = time.Hour
+)
+
 func setupRepo() *repo.DefaultRepository {
 	repository := repo.New()
 	user := os.Getenv("POSTGRES_USER")
@@ -25,6 +35,114 @@ func setupRepo() *repo.DefaultRepository {
 	return repository
 }
 
+func setupKeyStore() *auth.KeyStore {
+	keyDir := os.Getenv("JWT_KEY_DIR")
+	if keyDir == "" {
+		return nil
+	}
+	var rotation time.Duration
+	if interval := os.Getenv("JWT_KEY_ROTATION"); interval != "" {
+		var err error
+		rotation, err = time.ParseDuration(interval)
+		if err != nil {
+			panic(err)
+		}
+	}
+	keyStore, err := auth.NewKeyStore(keyDir, os.Getenv("JWT_ALGORITHM"), rotation)
+	if err != nil {
+		panic(err)
+	}
+	return keyStore
+}
+
+func setupOIDCProvider() *auth.OIDCProvider {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+	config := auth.OIDCConfig{
+		IssuerURL:    issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		RoleClaim:    os.Getenv("OIDC_ROLE_CLAIM"),
+	}
+	if scopes := os.Getenv("OIDC_SCOPES"); scopes != "" {
+		config.Scopes = strings.Fields(scopes)
+	}
+	if adminValues := os.Getenv("OIDC_ADMIN_VALUES"); adminValues != "" {
+		config.AdminValues = strings.Split(adminValues, ",")
+	}
+	provider, err := auth.NewOIDCProvider(config)
+	if err != nil {
+		panic(err)
+	}
+	return provider
+}
+
+func setupAuthService(repository *repo.DefaultRepository, keyStore *auth.KeyStore, oidcProvider *auth.OIDCProvider) *auth.BasicJwtAuthService {
+	var leeway time.Duration
+	if value := os.Getenv("JWT_LEEWAY"); value != "" {
+		var err error
+		leeway, err = time.ParseDuration(value)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return &auth.BasicJwtAuthService{
+		Repo:                 repository,
+		Verifications:        repository,
+		Mailer:               mail.NewFromEnv(),
+		VerificationURL:      os.Getenv("VERIFICATION_URL"),
+		RequireVerifiedEmail: os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true",
+		TwoFactors:           repository,
+		TOTPIssuer:           os.Getenv("TOTP_ISSUER"),
+		APIKeys:              repository,
+		Keys:                 keyStore,
+		Issuer:               os.Getenv("JWT_ISSUER"),
+		Audience:             os.Getenv("JWT_AUDIENCE"),
+		Leeway:               leeway,
+		OIDC:                 oidcProvider,
+		Identities:           repository,
+		Revocations:          repository,
+		Sessions:             repository,
+		Admin:                repository,
+		Permissions:          repository,
+		PasswordResetURL:     os.Getenv("PASSWORD_RESET_URL"),
+		Tenant:               repository.Tenant,
+	}
+}
+
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		panic(err)
+	}
+	return duration
+}
+
+func purgePeriodically(what string, purge func(before time.Time) (int64, error), retention time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for {
+		purged, err := purge(time.Now().Add(-retention))
+		if err != nil {
+			log.Print(err)
+		} else if purged > 0 {
+			log.Printf("purged %d %s", purged, what)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
 func errorFunc() {
 	r := recover()
 	if r != nil {
@@ -32,11 +150,79 @@ func errorFunc() {
 	}
 }
 
-func setupRoutes(router *mux.Router, repository repo.ProductRepository, service auth.AuthenticationService) {
-	router.HandleFunc("/catalog/products/{id}", handlers.MakeProductsHandler(repository)).Methods("GET", "DELETE", "PUT")
-	router.HandleFunc("/catalog/products", handlers.MakeAllProductsHandler(repository, service)).Methods("GET", "POST")
-	router.HandleFunc("/register", handlers.MakeRegisterHandler(service)).Methods("POST")
-	router.HandleFunc("/login", handlers.MakeLoginHandler(service)).Methods("POST")
+func setupRoutes(router *mux.Router, repository repo.ProductRepository, service auth.AuthenticationService, admin auth.UserAdminService, permissions auth.PermissionService, oauthServer auth.AuthorizationServer, audit repo.AuditRepository, trash repo.TrashRepository, idempotency repo.IdempotencyRepository, batch repo.ProductBatchRepository, transfers repo.ProductTransferRepository, categories repo.CategoryRepository, attributes repo.AttributeRepository, suggestions *suggest.Index) {
+	router.Use(handlers.RequestIdMiddleware)
+	authorized := handlers.MakeProductAuthorizationMiddleware(service)
+	productAudit := handlers.MakeAuditMiddleware(audit, handlers.ProductSnapshot(repository))
+	audited := handlers.MakeAuditMiddleware(audit, nil)
+	authEvents := handlers.MakeAuthEventAuditMiddleware(audit)
+	idempotent := handlers.MakeIdempotencyMiddleware(idempotency, durationFromEnv("IDEMPOTENCY_KEY_TTL", defaultIdempotencyTTL))
+	productHandler := http.Handler(handlers.MakeProductsHandler(repository))
+	if os.Getenv("REQUIRE_IF_MATCH") == "true" {
+		productHandler = handlers.RequireIfMatch(productHandler)
+	}
+	router.Handle("/catalog/search", authorized(handlers.MakeSearchHandler(repository))).Methods("GET")
+	similar, _ := repository.(repo.SuggestRepository)
+	router.Handle("/catalog/suggest", authorized(handlers.MakeSuggestHandler(suggestions, similar))).Methods("GET")
+	router.Handle("/catalog/products/export", authorized(handlers.MakeProductExportHandler(transfers))).Methods("GET")
+	router.Handle("/catalog/products/{id}", authorized(productAudit(productHandler))).Methods("GET", "DELETE", "PUT", "PATCH")
+	router.Handle("/catalog/products", authorized(idempotent(productAudit(handlers.MakeAllProductsHandler(repository, service))))).Methods("GET", "POST")
+	router.Handle("/catalog/products:batch", authorized(idempotent(audited(handlers.MakeProductBatchHandler(batch, service))))).Methods("POST")
+	restorable := handlers.RequirePermission(service, auth.PermissionProductsDelete)
+	router.Handle("/catalog/products/{id}/restore", authorized(restorable(idempotent(productAudit(handlers.MakeRestoreProductHandler(trash)))))).Methods("POST")
+	router.Handle("/catalog/products/{id}/categories", authorized(audited(handlers.MakeProductCategoriesHandler(categories)))).Methods("GET", "PUT")
+	router.Handle("/catalog/categories", authorized(idempotent(audited(handlers.MakeCategoriesHandler(categories))))).Methods("GET", "POST")
+	router.Handle("/catalog/categories/{id}", authorized(audited(handlers.MakeCategoryHandler(categories)))).Methods("GET", "PUT", "DELETE")
+	router.Handle("/catalog/categories/{id}/products", authorized(handlers.MakeCategoryProductsHandler(categories))).Methods("GET")
+	router.Handle("/catalog/categories/{id}/move", authorized(audited(handlers.MakeMoveCategoryHandler(categories)))).Methods("POST")
+	router.Handle("/catalog/attributes", authorized(handlers.MakeAttributeDefinitionsHandler(attributes))).Methods("GET")
+	router.Handle("/register", audited(handlers.MakeRegisterHandler(service))).Methods("POST")
+	router.Handle("/login", audited(handlers.MakeLoginHandler(service))).Methods("POST")
+	router.Handle("/verify", authEvents(handlers.MakeVerifyEmailHandler(service))).Methods("GET")
+	router.HandleFunc("/.well-known/jwks.json", handlers.MakeJWKSHandler(service)).Methods("GET")
+	router.HandleFunc("/login/oidc", handlers.MakeOIDCLoginHandler(service)).Methods("GET")
+	router.Handle("/login/oidc/callback", authEvents(handlers.MakeOIDCCallbackHandler(service))).Methods("GET")
+	router.Handle("/login/2fa", audited(handlers.MakeTwoFactorLoginHandler(service))).Methods("POST")
+	router.Handle("/password/reset", audited(handlers.MakePasswordResetHandler(admin))).Methods("POST")
+	router.Handle("/oauth/token", audited(handlers.MakeTokenHandler(oauthServer))).Methods("POST")
+	router.HandleFunc("/oauth/introspect", handlers.MakeIntrospectionHandler(oauthServer)).Methods("POST")
+	router.Handle("/oauth/revoke", audited(handlers.MakeRevocationHandler(oauthServer))).Methods("POST")
+
+	oauth := router.PathPrefix("/oauth").Subrouter()
+	oauth.Use(handlers.MakeAuthenticationMiddleware(service), handlers.RequireInteractiveSession, audited)
+	oauth.HandleFunc("/authorize", handlers.MakeAuthorizeHandler(oauthServer)).Methods("GET", "POST")
+	oauth.Handle("/clients", handlers.RequirePermission(service, auth.PermissionClientsAdmin)(handlers.MakeClientRegistrationHandler(oauthServer))).Methods("GET", "POST")
+
+	me := router.PathPrefix("/me").Subrouter()
+	me.Use(handlers.MakeAuthenticationMiddleware(service), handlers.RequireInteractiveSession,
+		handlers.MakeAuditMiddleware(audit, handlers.ProfileSnapshot(service)))
+	me.HandleFunc("", handlers.MakeProfileHandler(service)).Methods("GET", "PATCH", "DELETE")
+	me.HandleFunc("/sessions", handlers.MakeSessionsHandler(service)).Methods("GET")
+	me.HandleFunc("/sessions/{id}", handlers.MakeSessionHandler(service)).Methods("DELETE")
+	me.HandleFunc("/2fa/enroll", handlers.MakeTOTPEnrollHandler(service)).Methods("POST")
+	me.HandleFunc("/2fa/confirm", handlers.MakeTOTPConfirmHandler(service)).Methods("POST")
+	me.HandleFunc("/api-keys", handlers.MakeAPIKeysHandler(service)).Methods("GET", "POST")
+	me.HandleFunc("/api-keys/{id}", handlers.MakeAPIKeyHandler(service)).Methods("DELETE")
+	me.HandleFunc("/identities", handlers.MakeIdentitiesHandler(service)).Methods("GET")
+	me.HandleFunc("/identities/link", handlers.MakeOIDCLinkHandler(service)).Methods("GET")
+
+	adminRouter := router.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(handlers.MakeAuthenticationMiddleware(service), handlers.RequireInteractiveSession,
+		handlers.RequirePermission(service, auth.PermissionUsersAdmin), handlers.MakeAuditMiddleware(audit, handlers.UserSnapshot(admin)))
+	adminRouter.HandleFunc("/users", handlers.MakeAdminUsersHandler(admin)).Methods("GET")
+	adminRouter.HandleFunc("/users/{username}", handlers.MakeAdminUserHandler(admin)).Methods("GET", "DELETE")
+	adminRouter.HandleFunc("/users/{username}/role", handlers.MakeAdminRoleHandler(admin)).Methods("PUT")
+	adminRouter.HandleFunc("/users/{username}/disable", handlers.MakeAdminDisableHandler(admin, true)).Methods("POST")
+	adminRouter.HandleFunc("/users/{username}/enable", handlers.MakeAdminDisableHandler(admin, false)).Methods("POST")
+	adminRouter.HandleFunc("/users/{username}/password-reset", handlers.MakeAdminPasswordResetHandler(admin)).Methods("POST")
+	adminRouter.HandleFunc("/users/{username}/roles", handlers.MakeUserRolesHandler(permissions)).Methods("GET", "PUT")
+	adminRouter.HandleFunc("/roles", handlers.MakeRolesHandler(permissions)).Methods("GET")
+	adminRouter.HandleFunc("/roles/{name}", handlers.MakeRoleHandler(permissions)).Methods("PUT", "DELETE")
+	adminRouter.HandleFunc("/audit", handlers.MakeAuditLogHandler(audit)).Methods("GET")
+	adminRouter.HandleFunc("/attributes", handlers.MakeAttributeDefinitionsHandler(attributes)).Methods("GET")
+	adminRouter.HandleFunc("/attributes/{name}", handlers.MakeAttributeDefinitionHandler(attributes)).Methods("PUT", "DELETE")
+	adminRouter.HandleFunc("/trash/products", handlers.MakeTrashHandler(trash)).Methods("GET")
+	adminRouter.HandleFunc("/products/import", handlers.MakeProductImportHandler(transfers)).Methods("POST")
 }
 
 func listenAndServe(server *http.Server) {
@@ -60,18 +246,50 @@ func shutdownOnInterrupt(server *http.Server) {
 }
 
 func main() {
-	router := mux.NewRouter()
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runImport(os.Args[2:]))
+	}
+	keyStore := setupKeyStore()
+	if keyStore == nil {
+		if err := auth.LoadSecrets(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	handlers.SecureCookies = os.Getenv("INSECURE_COOKIES") != "true"
 	repository := setupRepo()
-	authService := auth.New(repository)
+	oidcProvider := setupOIDCProvider()
 	defer log.Println("done")
 	defer errorFunc()
 	defer repository.Close()
 
-	setupRoutes(router, repository, authService)
+	dispatcher := &tenant.Dispatcher{
+		Resolver: tenant.Resolver{BaseDomain: os.Getenv("TENANT_BASE_DOMAIN")},
+		Tenants:  repository,
+		Build: func(tenantId string) http.Handler {
+			tenantRepository := repository.ForTenant(tenantId)
+			suggestions := suggest.NewIndex()
+			tenantRepository.ProductsLoaded = suggestions.Rebuild
+			tenantRepository.AllProducts()
+			authService := setupAuthService(tenantRepository, keyStore, oidcProvider)
+			oauthServer := &auth.OAuthServer{Service: authService, Clients: tenantRepository}
+			router := mux.NewRouter()
+			setupRoutes(router, tenantRepository, authService, authService, authService, oauthServer, tenantRepository, tenantRepository, tenantRepository, tenantRepository, tenantRepository, tenantRepository, tenantRepository, suggestions)
+			return router
+		},
+	}
 
-	server := &http.Server{Addr: ":8080", Handler: router}
+	server := &http.Server{Addr: ":8080", Handler: dispatcher}
 
 	go listenAndServe(server)
+	if keyStore != nil {
+		stopRotation := make(chan struct{})
+		defer close(stopRotation)
+		go keyStore.StartRotation(stopRotation)
+	}
+	stopPurge := make(chan struct{})
+	defer close(stopPurge)
+	go purgePeriodically("trashed products", repository.PurgeProducts, durationFromEnv("PRODUCT_TRASH_RETENTION", defaultTrashRetention), stopPurge)
+	go purgePeriodically("idempotency keys", repository.PurgeIdempotencyKeys, durationFromEnv("IDEMPOTENCY_KEY_TTL", defaultIdempotencyTTL), stopPurge)
 
 	shutdownOnInterrupt(server)
 }
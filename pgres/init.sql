@@ -1,15 +1,278 @@
+CREATE TABLE tenants
+(
+	ID TEXT PRIMARY KEY,
+	NAME TEXT NOT NULL,
+	SEARCH_CONFIG REGCONFIG NOT NULL DEFAULT 'english',
+	CREATED TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+INSERT INTO tenants (ID, NAME) VALUES('default', 'Default');
+
 CREATE TABLE products
 (
-	ID SERIAL,
-	NAME TEXT CONSTRAINT prodchk CHECK(char_length(NAME) >= 3)
+	TENANT_ID TEXT NOT NULL DEFAULT 'default' REFERENCES tenants (ID),
+	ID SERIAL UNIQUE,
+	NAME TEXT CONSTRAINT prodchk CHECK(char_length(NAME) >= 3),
+	SKU TEXT,
+	DESCRIPTION TEXT,
+	PRICE NUMERIC(12, 2) NOT NULL DEFAULT 0 CHECK (PRICE >= 0),
+	BRAND TEXT,
+	STOCK INTEGER NOT NULL DEFAULT 0 CHECK (STOCK >= 0),
+	TAGS TEXT[] NOT NULL DEFAULT '{}',
+	ATTRIBUTES JSONB NOT NULL DEFAULT '{}' CHECK (jsonb_typeof(ATTRIBUTES) = 'object'),
+	SEARCH TSVECTOR,
+	VERSION INTEGER NOT NULL DEFAULT 1,
+	DELETED_AT TIMESTAMPTZ
 );
 
+CREATE UNIQUE INDEX products_sku ON products (TENANT_ID, SKU) WHERE DELETED_AT IS NULL;
+
+CREATE INDEX products_search ON products USING GIN (SEARCH);
+
+CREATE INDEX products_brand ON products (TENANT_ID, BRAND);
+
+CREATE INDEX products_price ON products (TENANT_ID, PRICE);
+
+CREATE INDEX products_tags ON products USING GIN (TAGS);
+
+CREATE INDEX products_attributes ON products USING GIN (ATTRIBUTES);
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX products_name_trigram ON products USING GIN (NAME gin_trgm_ops);
+
+CREATE FUNCTION products_search_vector() RETURNS trigger AS $$
+DECLARE
+	config REGCONFIG;
+BEGIN
+	SELECT SEARCH_CONFIG INTO config FROM tenants WHERE ID = NEW.TENANT_ID;
+	NEW.SEARCH := setweight(to_tsvector(COALESCE(config, 'simple'), COALESCE(NEW.NAME, '')), 'A') ||
+		setweight(to_tsvector(COALESCE(config, 'simple'), COALESCE(NEW.DESCRIPTION, '')), 'B');
+	RETURN NEW;
+END $$ LANGUAGE plpgsql;
+
+CREATE TRIGGER products_search_update BEFORE INSERT OR UPDATE OF NAME, DESCRIPTION ON products
+	FOR EACH ROW EXECUTE PROCEDURE products_search_vector();
+
 CREATE TABLE users
 (
+	TENANT_ID TEXT NOT NULL DEFAULT 'default' REFERENCES tenants (ID),
 	ID SERIAL,
 	USERNAME TEXT NOT NULL CONSTRAINT lengthchk CHECK(char_length(USERNAME) >= 4),
 	PASSWORD TEXT NOT NULL,
-	ROLE TEXT NOT NULL
+	ROLE TEXT NOT NULL,
+	EMAIL TEXT,
+	VERIFIED BOOLEAN NOT NULL DEFAULT FALSE,
+	TOTP_SECRET TEXT,
+	TOTP_ENABLED BOOLEAN NOT NULL DEFAULT FALSE,
+	TOTP_LAST_STEP BIGINT NOT NULL DEFAULT 0,
+	DISABLED BOOLEAN NOT NULL DEFAULT FALSE,
+	UNIQUE (TENANT_ID, USERNAME)
+);
+
+CREATE TABLE verification_tokens
+(
+	TENANT_ID TEXT NOT NULL DEFAULT 'default' REFERENCES tenants (ID),
+	TOKEN_HASH TEXT PRIMARY KEY,
+	USERNAME TEXT NOT NULL,
+	PURPOSE TEXT NOT NULL DEFAULT 'verify',
+	EXPIRES TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE recovery_codes
+(
+	TENANT_ID TEXT NOT NULL DEFAULT 'default' REFERENCES tenants (ID),
+	ID SERIAL PRIMARY KEY,
+	USERNAME TEXT NOT NULL,
+	CODE_HASH TEXT NOT NULL
+);
+
+CREATE TABLE two_factor_attempts
+(
+	TENANT_ID TEXT NOT NULL DEFAULT 'default' REFERENCES tenants (ID),
+	CHALLENGE_ID TEXT NOT NULL,
+	ATTEMPTS INTEGER NOT NULL DEFAULT 1,
+	CREATED TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (TENANT_ID, CHALLENGE_ID)
+);
+
+CREATE TABLE api_keys
+(
+	TENANT_ID TEXT NOT NULL DEFAULT 'default' REFERENCES tenants (ID),
+	ID SERIAL PRIMARY KEY,
+	NAME TEXT NOT NULL,
+	PREFIX TEXT NOT NULL UNIQUE,
+	KEY_HASH TEXT NOT NULL,
+	OWNER TEXT NOT NULL,
+	OWNER_TYPE TEXT NOT NULL,
+	ROLE TEXT,
+	SCOPES TEXT[] NOT NULL DEFAULT '{}',
+	CREATED_BY TEXT NOT NULL,
+	CREATED TIMESTAMPTZ NOT NULL DEFAULT now(),
+	EXPIRES TIMESTAMPTZ,
+	LAST_USED TIMESTAMPTZ
+);
+
+CREATE TABLE external_identities
+(
+	TENANT_ID TEXT NOT NULL DEFAULT 'default' REFERENCES tenants (ID),
+	ISSUER TEXT NOT NULL,
+	SUBJECT TEXT NOT NULL,
+	USERNAME TEXT NOT NULL,
+	EMAIL TEXT,
+	CREATED TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (TENANT_ID, ISSUER, SUBJECT)
+);
+
+CREATE TABLE oauth_clients
+(
+	TENANT_ID TEXT NOT NULL DEFAULT 'default' REFERENCES tenants (ID),
+	ID SERIAL PRIMARY KEY,
+	CLIENT_ID TEXT NOT NULL,
+	SECRET_HASH TEXT,
+	NAME TEXT NOT NULL,
+	REDIRECT_URIS TEXT[] NOT NULL DEFAULT '{}',
+	SCOPES TEXT[] NOT NULL DEFAULT '{}',
+	GRANT_TYPES TEXT[] NOT NULL DEFAULT '{}',
+	OWNER TEXT NOT NULL,
+	CREATED TIMESTAMPTZ NOT NULL DEFAULT now(),
+	UNIQUE (TENANT_ID, CLIENT_ID)
+);
+
+CREATE TABLE authorization_codes
+(
+	TENANT_ID TEXT NOT NULL DEFAULT 'default' REFERENCES tenants (ID),
+	CODE_HASH TEXT PRIMARY KEY,
+	CLIENT_ID TEXT NOT NULL,
+	USERNAME TEXT NOT NULL,
+	REDIRECT_URI TEXT NOT NULL,
+	SCOPES TEXT[] NOT NULL DEFAULT '{}',
+	CODE_CHALLENGE TEXT NOT NULL,
+	EXPIRES TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE revoked_tokens
+(
+	JTI TEXT PRIMARY KEY,
+	EXPIRES TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE sessions
+(
+	TENANT_ID TEXT NOT NULL DEFAULT 'default' REFERENCES tenants (ID),
+	ID TEXT PRIMARY KEY,
+	USERNAME TEXT NOT NULL,
+	CREATED TIMESTAMPTZ NOT NULL,
+	LAST_SEEN TIMESTAMPTZ NOT NULL,
+	REVOKED BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE roles
+(
+	TENANT_ID TEXT NOT NULL DEFAULT 'default' REFERENCES tenants (ID),
+	NAME TEXT NOT NULL,
+	PERMISSIONS TEXT[] NOT NULL DEFAULT '{}',
+	PRIMARY KEY (TENANT_ID, NAME)
+);
+
+CREATE TABLE user_roles
+(
+	TENANT_ID TEXT NOT NULL DEFAULT 'default' REFERENCES tenants (ID),
+	USERNAME TEXT NOT NULL,
+	ROLE TEXT NOT NULL,
+	PRIMARY KEY (TENANT_ID, USERNAME, ROLE)
+);
+
+-- Every tenant gets its own copy of the seed roles so that role edits never
+-- leak into other tenants.
+CREATE FUNCTION seed_tenant_roles(tenant TEXT) RETURNS void AS $$
+	INSERT INTO roles (TENANT_ID, NAME, PERMISSIONS) VALUES
+		(tenant, 'ADMIN', '{products:read,products:write,products:delete,users:admin,clients:admin}'),
+		(tenant, 'USER', '{products:read,products:write}')
+	ON CONFLICT DO NOTHING;
+$$ LANGUAGE sql;
+
+CREATE FUNCTION tenants_seed_roles() RETURNS trigger AS $$
+BEGIN
+	PERFORM seed_tenant_roles(NEW.ID);
+	RETURN NEW;
+END $$ LANGUAGE plpgsql;
+
+CREATE TRIGGER tenants_seed_roles AFTER INSERT ON tenants
+	FOR EACH ROW EXECUTE PROCEDURE tenants_seed_roles();
+
+SELECT seed_tenant_roles(ID) FROM tenants;
+
+CREATE TABLE audit_log
+(
+	TENANT_ID TEXT NOT NULL DEFAULT 'default' REFERENCES tenants (ID),
+	ID BIGSERIAL PRIMARY KEY,
+	ACTOR TEXT NOT NULL,
+	ACTION TEXT NOT NULL,
+	TARGET TEXT NOT NULL,
+	STATUS INTEGER NOT NULL,
+	BEFORE JSONB,
+	AFTER JSONB,
+	REQUEST_ID TEXT NOT NULL,
+	CREATED TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX audit_log_created ON audit_log (TENANT_ID, CREATED);
+
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_log is append-only';
+END $$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_immutable BEFORE UPDATE OR DELETE ON audit_log
+	FOR EACH ROW EXECUTE PROCEDURE audit_log_append_only();
+
+CREATE TABLE idempotency_keys
+(
+	TENANT_ID TEXT NOT NULL DEFAULT 'default' REFERENCES tenants (ID),
+	USERNAME TEXT NOT NULL,
+	KEY TEXT NOT NULL,
+	REQUEST_HASH TEXT NOT NULL,
+	COMPLETED BOOLEAN NOT NULL DEFAULT FALSE,
+	STATUS INTEGER,
+	HEADER JSONB,
+	BODY BYTEA,
+	CREATED TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (TENANT_ID, USERNAME, KEY)
+);
+
+CREATE INDEX idempotency_keys_created ON idempotency_keys (CREATED);
+
+CREATE TABLE categories
+(
+	TENANT_ID TEXT NOT NULL DEFAULT 'default' REFERENCES tenants (ID),
+	ID SERIAL PRIMARY KEY,
+	PARENT_ID INTEGER REFERENCES categories (ID),
+	SLUG TEXT NOT NULL CHECK (SLUG ~ '^[a-z0-9]+(-[a-z0-9]+)*$'),
+	NAME TEXT NOT NULL,
+	POSITION INTEGER NOT NULL DEFAULT 0,
+	UNIQUE (TENANT_ID, SLUG)
+);
+
+CREATE INDEX categories_parent ON categories (PARENT_ID);
+
+CREATE TABLE product_categories
+(
+	TENANT_ID TEXT NOT NULL DEFAULT 'default' REFERENCES tenants (ID),
+	PRODUCT_ID INTEGER NOT NULL REFERENCES products (ID) ON DELETE CASCADE,
+	CATEGORY_ID INTEGER NOT NULL REFERENCES categories (ID) ON DELETE CASCADE,
+	PRIMARY KEY (PRODUCT_ID, CATEGORY_ID)
+);
+
+CREATE INDEX product_categories_category ON product_categories (CATEGORY_ID);
+
+CREATE TABLE attribute_definitions
+(
+	TENANT_ID TEXT NOT NULL DEFAULT 'default' REFERENCES tenants (ID),
+	NAME TEXT NOT NULL,
+	TYPE TEXT NOT NULL CHECK (TYPE IN ('string', 'number', 'boolean', 'enum')),
+	ALLOWED_VALUES TEXT[],
+	PRIMARY KEY (TENANT_ID, NAME)
 );
 
 INSERT INTO products (NAME) VALUES('Hose');
@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"golang.org/x/crypto/bcrypt"
+	"net/url"
+	"time"
+)
+
+const (
+	passwordResetLifetime   = 24 * time.Hour
+	defaultPasswordResetURL = "https://localhost:8080/password/reset"
+	defaultPageSize         = 20
+	maxPageSize             = 100
+)
+
+var (
+	ErrAccountDisabled    = errors.New("account disabled")
+	ErrUnknownRole        = errors.New("unknown role")
+	ErrAdminNotConfigured = errors.New("user administration not configured")
+	ErrInvalidResetToken  = errors.New("invalid or expired password reset token")
+)
+
+type UserAdminService interface {
+	ListUsers(query repo.UserQuery) (repo.UserPage, error)
+	GetUser(username string) (repo.User, error)
+	ChangeRole(username string, role repo.Role) error
+	SetDisabled(username string, disabled bool) error
+	ForcePasswordReset(username string) (string, error)
+	ResetPassword(token, newPassword string) error
+	DeleteUser(username string) error
+}
+
+func (authService *BasicJwtAuthService) ListUsers(query repo.UserQuery) (repo.UserPage, error) {
+	if authService.Admin == nil {
+		return repo.UserPage{}, ErrAdminNotConfigured
+	}
+	if query.Page < 1 {
+		query.Page = 1
+	}
+	if query.PageSize < 1 {
+		query.PageSize = defaultPageSize
+	}
+	if query.PageSize > maxPageSize {
+		query.PageSize = maxPageSize
+	}
+	return authService.Admin.ListUsers(query)
+}
+
+// GetUser returns the stored user, bypassing the user cache when the admin
+// repository is configured.
+func (authService *BasicJwtAuthService) GetUser(username string) (repo.User, error) {
+	if authService.Admin == nil {
+		return authService.Repo.GetByUsername(username)
+	}
+	return authService.Admin.GetUser(username)
+}
+
+func (authService *BasicJwtAuthService) ChangeRole(username string, role repo.Role) error {
+	if authService.Admin == nil {
+		return ErrAdminNotConfigured
+	}
+	if !authService.roleExists(role) {
+		return ErrUnknownRole
+	}
+	if _, err := authService.Repo.GetByUsername(username); err != nil {
+		return err
+	}
+	err := authService.Admin.SetUserRole(username, role)
+	if err != nil {
+		return err
+	}
+	return authService.revokeAllSessions(username)
+}
+
+func (authService *BasicJwtAuthService) SetDisabled(username string, disabled bool) error {
+	if authService.Admin == nil {
+		return ErrAdminNotConfigured
+	}
+	if _, err := authService.Repo.GetByUsername(username); err != nil {
+		return err
+	}
+	err := authService.Admin.SetUserDisabled(username, disabled)
+	if err != nil || !disabled {
+		return err
+	}
+	return authService.revokeAllSessions(username)
+}
+
+func (authService *BasicJwtAuthService) ForcePasswordReset(username string) (string, error) {
+	if authService.Verifications == nil {
+		return "", ErrAdminNotConfigured
+	}
+	usr, err := authService.Repo.GetByUsername(username)
+	if err != nil {
+		return "", err
+	}
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	unusable, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(unusable), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	usr.Password = string(hashedPassword)
+	err = authService.Repo.UpdateUser(usr)
+	if err != nil {
+		return "", err
+	}
+	err = authService.revokeAllSessions(username)
+	if err != nil {
+		return "", err
+	}
+	err = authService.Verifications.AddVerificationToken(repo.VerificationToken{
+		TokenHash: hashToken(token),
+		Username:  username,
+		Purpose:   purposePasswordReset,
+		Expires:   time.Now().Add(passwordResetLifetime),
+	})
+	if err != nil {
+		return "", err
+	}
+	baseURL := authService.PasswordResetURL
+	if baseURL == "" {
+		baseURL = defaultPasswordResetURL
+	}
+	link := baseURL + "?token=" + url.QueryEscape(token)
+	if usr.Email == "" || authService.Mailer == nil {
+		return link, nil
+	}
+	body := fmt.Sprintf("Hello %s,\n\nan administrator has reset your password. Choose a new one here:\n\n%s\n\nThe link expires in 24 hours.", usr.Username, link)
+	return "", authService.Mailer.Send(usr.Email, "Your password has been reset", body)
+}
+
+func (authService *BasicJwtAuthService) ResetPassword(token, newPassword string) error {
+	if authService.Verifications == nil {
+		return ErrAdminNotConfigured
+	}
+	tokenHash := hashToken(token)
+	stored, err := authService.Verifications.GetVerificationToken(tokenHash)
+	if err != nil || stored.Purpose != purposePasswordReset {
+		return ErrInvalidResetToken
+	}
+	err = authService.Verifications.RemoveVerificationToken(tokenHash)
+	if err != nil {
+		return err
+	}
+	if time.Now().After(stored.Expires) {
+		return ErrInvalidResetToken
+	}
+	usr, err := authService.Repo.GetByUsername(stored.Username)
+	if err != nil {
+		return err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	usr.Password = string(hashedPassword)
+	return authService.Repo.UpdateUser(usr)
+}
+
+func (authService *BasicJwtAuthService) DeleteUser(username string) error {
+	if _, err := authService.Repo.GetByUsername(username); err != nil {
+		return err
+	}
+	return authService.DeleteAccount(username)
+}
+
+func (authService *BasicJwtAuthService) revokeAllSessions(username string) error {
+	if authService.Sessions == nil {
+		return nil
+	}
+	return authService.Sessions.RevokeAllSessions(username)
+}
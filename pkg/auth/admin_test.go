@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"errors"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"net/url"
+	"testing"
+)
+
+type mockUserAdminRepo struct {
+	UserRepo *MockUserRepo
+}
+
+func (mockRepo *mockUserAdminRepo) ListUsers(query repo.UserQuery) (repo.UserPage, error) {
+	return repo.UserPage{Users: mockRepo.UserRepo.Users, Total: len(mockRepo.UserRepo.Users), Page: query.Page, PageSize: query.PageSize}, nil
+}
+
+func (mockRepo *mockUserAdminRepo) GetUser(username string) (repo.User, error) {
+	for _, user := range mockRepo.UserRepo.Users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return repo.User{}, repo.ErrUserNotFound
+}
+
+func (mockRepo *mockUserAdminRepo) SetUserRole(username string, role repo.Role) error {
+	return mockRepo.update(username, func(user *repo.User) { user.Role = role })
+}
+
+func (mockRepo *mockUserAdminRepo) SetUserDisabled(username string, disabled bool) error {
+	return mockRepo.update(username, func(user *repo.User) { user.Disabled = disabled })
+}
+
+func (mockRepo *mockUserAdminRepo) update(username string, change func(user *repo.User)) error {
+	for index := range mockRepo.UserRepo.Users {
+		if mockRepo.UserRepo.Users[index].Username == username {
+			change(&mockRepo.UserRepo.Users[index])
+			return nil
+		}
+	}
+	return errors.New("user not found")
+}
+
+func prepareAdminAuthService() *BasicJwtAuthService {
+	userRepo := &MockUserRepo{}
+	return &BasicJwtAuthService{
+		Repo:          userRepo,
+		Verifications: &mockVerificationRepo{Tokens: map[string]repo.VerificationToken{}, UserRepo: userRepo},
+		Sessions:      &mockSessionRepo{Sessions: map[string]repo.Session{}},
+		Admin:         &mockUserAdminRepo{UserRepo: userRepo},
+	}
+}
+
+func TestBasicJwtAuthService_SetDisabled(t *testing.T) {
+	service := prepareAdminAuthService()
+	_ = service.RegisterUser("hugo", "test")
+	tokenString, err := service.GenerateToken(Credentials{Username: "hugo", Password: "test"})
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	err = service.SetDisabled("hugo", true)
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if _, err = service.GetTokenFromString(tokenString); err != ErrInvalidToken {
+		t.Errorf("expected %v, received %v", ErrInvalidToken, err)
+	}
+	if _, err = service.GenerateToken(Credentials{Username: "hugo", Password: "test"}); err != ErrAccountDisabled {
+		t.Errorf("expected %v, received %v", ErrAccountDisabled, err)
+	}
+	_ = service.SetDisabled("hugo", false)
+	if _, err = service.GenerateToken(Credentials{Username: "hugo", Password: "test"}); err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+	}
+}
+
+func TestBasicJwtAuthService_ChangeRole(t *testing.T) {
+	service := prepareAdminAuthService()
+	_ = service.RegisterUser("hugo", "test")
+	if err := service.ChangeRole("hugo", "ROOT"); err != ErrUnknownRole {
+		t.Errorf("expected %v, received %v", ErrUnknownRole, err)
+	}
+	if err := service.ChangeRole("hugo", repo.ADMIN); err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	usr, _ := service.GetUser("hugo")
+	if usr.Role != repo.ADMIN {
+		t.Errorf("expected %v, received %v", repo.ADMIN, usr.Role)
+	}
+}
+
+func TestBasicJwtAuthService_ForcePasswordReset(t *testing.T) {
+	service := prepareAdminAuthService()
+	_ = service.RegisterUser("hugo", "test")
+	link, err := service.ForcePasswordReset("hugo")
+	if err != nil || link == "" {
+		t.Errorf("expected reset link, received %q, %v", link, err)
+		t.FailNow()
+	}
+	if _, err = service.GenerateToken(Credentials{Username: "hugo", Password: "test"}); err == nil {
+		t.Error("expected old password to be rejected")
+	}
+	parsed, _ := url.Parse(link)
+	token := parsed.Query().Get("token")
+	if err = service.VerifyEmail(token); err != ErrInvalidVerifyToken {
+		t.Errorf("expected %v, received %v", ErrInvalidVerifyToken, err)
+	}
+	if err = service.ResetPassword(token, "secret"); err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if _, err = service.GenerateToken(Credentials{Username: "hugo", Password: "secret"}); err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+	}
+	if err = service.ResetPassword(token, "again"); err != ErrInvalidResetToken {
+		t.Errorf("expected %v, received %v", ErrInvalidResetToken, err)
+	}
+}
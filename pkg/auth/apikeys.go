@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeyPrefix     = "sr"
+	apiKeyPrefixSize = 5
+	apiKeySecretSize = 32
+)
+
+const (
+	ScopeProductsRead   = PermissionProductsRead
+	ScopeProductsWrite  = PermissionProductsWrite
+	ScopeProductsDelete = PermissionProductsDelete
+)
+
+var KnownScopes = []string{ScopeProductsRead, ScopeProductsWrite, ScopeProductsDelete}
+
+var (
+	ErrAPIKeysNotConfigured = errors.New("api keys not configured")
+	ErrInvalidAPIKey        = errors.New("invalid or expired api key")
+	ErrUnknownScope         = errors.New("unknown scope")
+	ErrMissingScopes        = errors.New("at least one scope is required")
+	ErrExpiryInPast         = errors.New("expiry must be in the future")
+)
+
+type APIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Service   string     `json:"service,omitempty"`
+	Role      repo.Role  `json:"role,omitempty"`
+}
+
+var apiKeyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func (authService *BasicJwtAuthService) CreateAPIKey(creator string, request APIKeyRequest) (string, repo.APIKey, error) {
+	if authService.APIKeys == nil {
+		return "", repo.APIKey{}, ErrAPIKeysNotConfigured
+	}
+	if len(request.Scopes) == 0 {
+		return "", repo.APIKey{}, ErrMissingScopes
+	}
+	for _, scope := range request.Scopes {
+		if !isKnownScope(scope) {
+			return "", repo.APIKey{}, ErrUnknownScope
+		}
+	}
+	if request.ExpiresAt != nil && request.ExpiresAt.Before(time.Now()) {
+		return "", repo.APIKey{}, ErrExpiryInPast
+	}
+	key := repo.APIKey{
+		Name:      request.Name,
+		Owner:     creator,
+		OwnerType: repo.USEROWNED,
+		Scopes:    request.Scopes,
+		CreatedBy: creator,
+		Expires:   request.ExpiresAt,
+	}
+	if request.Service != "" {
+		key.Owner = request.Service
+		key.OwnerType = repo.SERVICEOWNED
+		key.Role = request.Role
+		if key.Role == "" {
+			key.Role = repo.USER
+		}
+		if !authService.roleExists(key.Role) {
+			return "", repo.APIKey{}, ErrUnknownRole
+		}
+	}
+	prefixBytes := make([]byte, apiKeyPrefixSize)
+	secretBytes := make([]byte, apiKeySecretSize)
+	if _, err := rand.Read(prefixBytes); err != nil {
+		return "", repo.APIKey{}, err
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", repo.APIKey{}, err
+	}
+	key.Prefix = strings.ToLower(apiKeyEncoding.EncodeToString(prefixBytes))
+	plainKey := apiKeyPrefix + "_" + key.Prefix + "_" + strings.ToLower(apiKeyEncoding.EncodeToString(secretBytes))
+	key.KeyHash = hashToken(plainKey)
+	stored, err := authService.APIKeys.AddAPIKey(key)
+	if err != nil {
+		return "", repo.APIKey{}, err
+	}
+	return plainKey, stored, nil
+}
+
+func (authService *BasicJwtAuthService) ListAPIKeys(creator string) ([]repo.APIKey, error) {
+	if authService.APIKeys == nil {
+		return nil, ErrAPIKeysNotConfigured
+	}
+	return authService.APIKeys.APIKeysByCreator(creator)
+}
+
+func (authService *BasicJwtAuthService) RevokeAPIKey(creator string, id int) error {
+	if authService.APIKeys == nil {
+		return ErrAPIKeysNotConfigured
+	}
+	return authService.APIKeys.RemoveAPIKey(creator, id)
+}
+
+func (authService *BasicJwtAuthService) AuthenticateAPIKey(plainKey string) (*jwt.Token, error) {
+	if authService.APIKeys == nil {
+		return &jwt.Token{}, ErrAPIKeysNotConfigured
+	}
+	parts := strings.Split(plainKey, "_")
+	if len(parts) != 3 || parts[0] != apiKeyPrefix {
+		return &jwt.Token{}, ErrInvalidAPIKey
+	}
+	key, err := authService.APIKeys.GetAPIKeyByPrefix(parts[1])
+	if err != nil {
+		return &jwt.Token{}, ErrInvalidAPIKey
+	}
+	if subtle.ConstantTimeCompare([]byte(key.KeyHash), []byte(hashToken(plainKey))) != 1 {
+		return &jwt.Token{}, ErrInvalidAPIKey
+	}
+	now := time.Now()
+	if key.Expires != nil && now.After(*key.Expires) {
+		return &jwt.Token{}, ErrInvalidAPIKey
+	}
+	role := key.Role
+	var permissions []string
+	if key.OwnerType == repo.USEROWNED {
+		usr, err := authService.Repo.GetByUsername(key.Owner)
+		if err != nil || usr.Disabled {
+			return &jwt.Token{}, ErrInvalidAPIKey
+		}
+		role = usr.Role
+		if permissions, err = authService.effectivePermissions(usr); err != nil {
+			return &jwt.Token{}, err
+		}
+	}
+	go func() {
+		if err := authService.APIKeys.TouchAPIKey(key.Id, now); err != nil {
+			log.Print(err)
+		}
+	}()
+	claims := &Claims{
+		Role:        role,
+		Scopes:      key.Scopes,
+		Permissions: permissions,
+		APIKeyId:    key.Id,
+		Tenant:      authService.Tenant,
+		StandardClaims: jwt.StandardClaims{
+			Subject: key.Owner,
+		},
+	}
+	return &jwt.Token{Claims: claims, Valid: true}, nil
+}
+
+func isKnownScope(scope string) bool {
+	for _, known := range KnownScopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
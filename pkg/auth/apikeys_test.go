@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"errors"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"testing"
+	"time"
+)
+
+type mockAPIKeyRepo struct {
+	Keys []repo.APIKey
+}
+
+func (mockRepo *mockAPIKeyRepo) AddAPIKey(key repo.APIKey) (repo.APIKey, error) {
+	key.Id = len(mockRepo.Keys) + 1
+	key.Created = time.Now()
+	mockRepo.Keys = append(mockRepo.Keys, key)
+	return key, nil
+}
+
+func (mockRepo *mockAPIKeyRepo) GetAPIKeyByPrefix(prefix string) (repo.APIKey, error) {
+	for _, key := range mockRepo.Keys {
+		if key.Prefix == prefix {
+			return key, nil
+		}
+	}
+	return repo.APIKey{}, errors.New("api key not found")
+}
+
+func (mockRepo *mockAPIKeyRepo) APIKeysByCreator(creator string) ([]repo.APIKey, error) {
+	keys := make([]repo.APIKey, 0)
+	for _, key := range mockRepo.Keys {
+		if key.CreatedBy == creator {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (mockRepo *mockAPIKeyRepo) RemoveAPIKey(creator string, id int) error {
+	for index, key := range mockRepo.Keys {
+		if key.Id == id && key.CreatedBy == creator {
+			mockRepo.Keys = append(mockRepo.Keys[:index], mockRepo.Keys[index+1:]...)
+			return nil
+		}
+	}
+	return errors.New("api key not found")
+}
+
+func (mockRepo *mockAPIKeyRepo) TouchAPIKey(id int, lastUsed time.Time) error {
+	return nil
+}
+
+func TestBasicJwtAuthService_AuthenticateAPIKey(t *testing.T) {
+	service := &BasicJwtAuthService{Repo: &MockUserRepo{}, APIKeys: &mockAPIKeyRepo{}}
+	err := service.RegisterUser("hugo", "test")
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	plainKey, key, err := service.CreateAPIKey("hugo", APIKeyRequest{Name: "batch", Scopes: []string{ScopeProductsWrite}})
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	token, err := service.AuthenticateAPIKey(plainKey)
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	claims, _ := ClaimsFromToken(token)
+	if claims.Subject != "hugo" || claims.APIKeyId != key.Id {
+		t.Errorf("unexpected claims %v", claims)
+		t.FailNow()
+	}
+	if _, err = service.AuthenticateAPIKey(plainKey + "x"); err != ErrInvalidAPIKey {
+		t.Errorf("expected %v, received %v", ErrInvalidAPIKey, err)
+		t.FailNow()
+	}
+	err = service.RevokeAPIKey("hugo", key.Id)
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if _, err = service.AuthenticateAPIKey(plainKey); err != ErrInvalidAPIKey {
+		t.Errorf("expected %v, received %v", ErrInvalidAPIKey, err)
+	}
+}
+
+func TestBasicJwtAuthService_CreateAPIKey_Invalid(t *testing.T) {
+	service := &BasicJwtAuthService{Repo: &MockUserRepo{}, APIKeys: &mockAPIKeyRepo{}}
+	past := time.Now().Add(-time.Hour)
+	tests := map[error]APIKeyRequest{
+		ErrUnknownScope:  {Scopes: []string{"everything"}},
+		ErrMissingScopes: {Scopes: []string{}},
+		ErrExpiryInPast:  {Scopes: []string{ScopeProductsRead}, ExpiresAt: &past},
+		ErrUnknownRole:   {Scopes: []string{ScopeProductsRead}, Service: "erp", Role: "ROOT"},
+	}
+	for expected, request := range tests {
+		if _, _, err := service.CreateAPIKey("hugo", request); err != expected {
+			t.Errorf("expected %v, received %v", expected, err)
+		}
+	}
+}
@@ -4,30 +4,68 @@ import (
 	"errors"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/segfaultx/simple_rest/pkg/mail"
 	"github.com/segfaultx/simple_rest/pkg/repo"
 	"golang.org/x/crypto/bcrypt"
 	"log"
-	"os"
+	netmail "net/mail"
 	"time"
 )
 
-var jwtKey = []byte(os.Getenv("API_SECRET"))
-
 type (
 	AuthenticationService interface {
 		GenerateToken(credentials Credentials) (string, error)
 		GetTokenFromString(tokenString string) (*jwt.Token, error)
 		RegisterUser(username, password string) error
+		RegisterUserWithEmail(username, password, email string) error
+		VerifyEmail(token string) error
+		EnrollTOTP(username string) (TOTPEnrollment, error)
+		ConfirmTOTP(username, code string) ([]string, error)
+		VerifyTwoFactor(challengeToken, code string) (string, error)
+		CreateAPIKey(creator string, request APIKeyRequest) (string, repo.APIKey, error)
+		ListAPIKeys(creator string) ([]repo.APIKey, error)
+		RevokeAPIKey(creator string, id int) error
+		AuthenticateAPIKey(plainKey string) (*jwt.Token, error)
+		JWKS() JWKSet
+		OIDCAuthorizationURL(linkUser string) (string, string, error)
+		OIDCLogin(state, code string) (string, error)
+		LinkedIdentities(username string) ([]repo.ExternalIdentity, error)
 		RefreshToken(token *jwt.Token) (string, error)
+		GetProfile(username string) (repo.User, error)
+		UpdateProfile(username string, update ProfileUpdate) (repo.User, error)
+		DeleteAccount(username string) error
+		ListSessions(username, currentSessionId string) ([]repo.Session, error)
+		RevokeSession(username, sessionId string) error
+		Authorize(token *jwt.Token, permission string) bool
 	}
 
 	Credentials struct {
 		Password string `json:"password"`
 		Username string `json:"username"`
+		Email    string `json:"email,omitempty"`
 	}
 
 	BasicJwtAuthService struct {
-		Repo repo.UserRepository
+		Repo                 repo.UserRepository
+		Verifications        repo.VerificationRepository
+		Mailer               mail.Mailer
+		VerificationURL      string
+		RequireVerifiedEmail bool
+		TwoFactors           repo.TwoFactorRepository
+		TOTPIssuer           string
+		APIKeys              repo.APIKeyRepository
+		Keys                 *KeyStore
+		Issuer               string
+		Audience             string
+		Leeway               time.Duration
+		OIDC                 *OIDCProvider
+		Identities           repo.IdentityRepository
+		Revocations          repo.RevocationRepository
+		Sessions             repo.SessionRepository
+		Admin                repo.UserAdminRepository
+		Permissions          repo.PermissionRepository
+		Tenant               string
+		PasswordResetURL     string
 	}
 )
 
@@ -38,16 +76,44 @@ func New(repository repo.UserRepository) AuthenticationService {
 }
 
 func (authService *BasicJwtAuthService) RegisterUser(username, password string) error {
+	return authService.RegisterUserWithEmail(username, password, "")
+}
+
+func (authService *BasicJwtAuthService) RegisterUserWithEmail(username, password, email string) error {
 	_, err := authService.Repo.GetByUsername(username)
 	if err == nil {
 		return errors.New("username already taken")
 	}
+	if email == "" && authService.RequireVerifiedEmail {
+		return ErrEmailRequired
+	}
+	if email != "" {
+		if _, err = netmail.ParseAddress(email); err != nil {
+			return ErrInvalidEmail
+		}
+	}
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
-	usr := repo.User{Username: username, Password: string(hashedPassword), Role: repo.USER}
-	return authService.Repo.AddUser(usr)
+	usr := repo.User{Username: username, Password: string(hashedPassword), Role: repo.USER, Email: email}
+	err = authService.Repo.AddUser(usr)
+	if err != nil {
+		return err
+	}
+	if email == "" {
+		return nil
+	}
+	err = authService.sendVerificationMail(usr)
+	if err != nil {
+		// without the mail the account could never be verified and the
+		// username would stay taken
+		if removeErr := authService.Repo.RemoveUser(username); removeErr != nil {
+			log.Print(removeErr)
+		}
+		return err
+	}
+	return nil
 }
 
 func (authService *BasicJwtAuthService) GenerateToken(credentials Credentials) (string, error) {
@@ -59,14 +125,44 @@ func (authService *BasicJwtAuthService) GenerateToken(credentials Credentials) (
 	if err != nil {
 		return "", err
 	}
-	claims := make(jwt.MapClaims)
-	claims["authorized"] = true
-	claims["userId"] = usr.Username
-	claims["role"] = usr.Role
-	claims["exp"] = time.Now().Add(10 * time.Minute).Unix()
-	token := jwt.New(jwt.SigningMethodHS256)
-	token.Claims = claims
-	return token.SignedString(jwtKey)
+	if usr.Disabled {
+		return "", ErrAccountDisabled
+	}
+	if authService.RequireVerifiedEmail && !usr.Verified {
+		return "", ErrEmailNotVerified
+	}
+	if usr.TOTPEnabled {
+		challenge, err := authService.generateChallengeToken(usr)
+		if err != nil {
+			return "", err
+		}
+		return challenge, ErrTwoFactorRequired
+	}
+	return authService.issueToken(usr)
+}
+
+func (authService *BasicJwtAuthService) issueToken(usr repo.User) (string, error) {
+	if usr.Disabled {
+		return "", ErrAccountDisabled
+	}
+	claims, err := authService.newClaims(usr.Username, tokenLifetime)
+	if err != nil {
+		return "", err
+	}
+	claims.Role = usr.Role
+	claims.Permissions, err = authService.effectivePermissions(usr)
+	if err != nil {
+		return "", err
+	}
+	if authService.Sessions != nil {
+		now := time.Now()
+		claims.SessionId = claims.Id
+		err = authService.Sessions.AddSession(repo.Session{Id: claims.SessionId, Username: usr.Username, Created: now, LastSeen: now})
+		if err != nil {
+			return "", err
+		}
+	}
+	return authService.signToken(claims)
 }
 
 func checkPassword(user repo.User, credentials Credentials) error {
@@ -74,28 +170,102 @@ func checkPassword(user repo.User, credentials Credentials) error {
 }
 
 func (authService *BasicJwtAuthService) GetTokenFromString(tokenString string) (*jwt.Token, error) {
-	token, ok := jwt.ParseWithClaims(tokenString, &jwt.MapClaims{}, func(tok *jwt.Token) (interface{}, error) {
+	token, err := authService.parseToken(tokenString, &Claims{})
+	if err != nil {
+		return &jwt.Token{}, ErrInvalidToken
+	}
+	claims, ok := ClaimsFromToken(token)
+	if !ok || claims.Challenge {
+		return &jwt.Token{}, ErrInvalidToken
+	}
+	if authService.Revocations != nil {
+		revoked, err := authService.Revocations.IsTokenRevoked(claims.Id)
+		if err != nil || revoked {
+			return &jwt.Token{}, ErrInvalidToken
+		}
+	}
+	if usr, err := authService.Repo.GetByUsername(claims.Subject); err == nil && usr.Disabled {
+		return &jwt.Token{}, ErrInvalidToken
+	}
+	if authService.Sessions != nil && claims.SessionId != "" {
+		session, err := authService.Sessions.GetSession(claims.SessionId)
+		if err != nil || session.Revoked || session.Username != claims.Subject {
+			return &jwt.Token{}, ErrInvalidToken
+		}
+	}
+	return token, nil
+}
+
+func (authService *BasicJwtAuthService) RefreshToken(token *jwt.Token) (string, error) {
+	claims, ok := ClaimsFromToken(token)
+	if !ok {
+		return "", ErrInvalidToken
+	}
+	refreshClaims, err := authService.newClaims(claims.Subject, tokenLifetime)
+	if err != nil {
+		return "", err
+	}
+	refreshClaims.Role = claims.Role
+	refreshClaims.Scopes = claims.Scopes
+	if claims.Permissions != nil {
+		// Role edits and assignments must reach sliding sessions, so the
+		// permissions are resolved again instead of being copied.
+		usr, err := authService.Repo.GetByUsername(claims.Subject)
+		if err != nil {
+			return "", ErrInvalidToken
+		}
+		refreshClaims.Role = usr.Role
+		if refreshClaims.Permissions, err = authService.effectivePermissions(usr); err != nil {
+			return "", err
+		}
+	}
+	refreshClaims.ClientId = claims.ClientId
+	refreshClaims.SessionId = claims.SessionId
+	if authService.Sessions != nil && claims.SessionId != "" {
+		if err = authService.Sessions.TouchSession(claims.SessionId, time.Now()); err != nil {
+			return "", err
+		}
+	}
+	return authService.signToken(refreshClaims)
+}
+
+func (authService *BasicJwtAuthService) signToken(claims jwt.Claims) (string, error) {
+	if authService.Keys == nil {
+		if len(jwtKey) == 0 {
+			return "", ErrSecretNotConfigured
+		}
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtKey)
+	}
+	key := authService.Keys.SigningKey()
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.Id
+	return token.SignedString(key.Private)
+}
+
+func (authService *BasicJwtAuthService) keyFunc(tok *jwt.Token) (interface{}, error) {
+	if authService.Keys == nil {
 		if _, ok := tok.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", tok.Header["alg"])
 		}
+		if len(jwtKey) == 0 {
+			return nil, ErrSecretNotConfigured
+		}
 		return jwtKey, nil
-	})
-	if ok != nil {
-		log.Fatal(ok)
 	}
-	if _, err := token.Claims.(*jwt.MapClaims); err && token.Valid {
-		return token, nil
+	kid, _ := tok.Header["kid"].(string)
+	key, ok := authService.Keys.VerificationKey(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %v", tok.Header["kid"])
 	}
-	return &jwt.Token{}, jwt.ErrSignatureInvalid
+	if tok.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", tok.Header["alg"])
+	}
+	return key.Private.Public(), nil
 }
 
-func (authService *BasicJwtAuthService) RefreshToken(token *jwt.Token) (string, error) {
-	claims := *(token.Claims.(*jwt.MapClaims))
-	refreshClaims := make(jwt.MapClaims)
-	refreshClaims["authorized"] = claims["authorized"]
-	refreshClaims["userId"] = claims["userId"]
-	refreshClaims["role"] = claims["role"]
-	refreshClaims["exp"] = time.Now().Add(10 * time.Minute).Unix()
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	return refreshToken.SignedString(jwtKey)
+func (authService *BasicJwtAuthService) JWKS() JWKSet {
+	if authService.Keys == nil {
+		return JWKSet{Keys: []JWK{}}
+	}
+	return authService.Keys.JWKS()
 }
@@ -30,6 +30,26 @@ func (mockRepo *MockUserRepo) GetByUsername(username string) (repo.User, error)
 	return repo.User{}, errors.New("user not found")
 }
 
+func (mockRepo *MockUserRepo) UpdateUser(u repo.User) error {
+	for index, user := range mockRepo.Users {
+		if user.Username == u.Username {
+			mockRepo.Users[index] = u
+			return nil
+		}
+	}
+	return errors.New("user not found")
+}
+
+func (mockRepo *MockUserRepo) RemoveUser(username string) error {
+	for index, user := range mockRepo.Users {
+		if user.Username == username {
+			mockRepo.Users = append(mockRepo.Users[:index], mockRepo.Users[index+1:]...)
+			return nil
+		}
+	}
+	return errors.New("user not found")
+}
+
 const (
 	TokenFormatLength = 3
 )
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"time"
+)
+
+const tokenLifetime = 10 * time.Minute
+
+var ErrInvalidToken = errors.New("invalid token")
+
+type Claims struct {
+	Role        repo.Role `json:"role,omitempty"`
+	Scopes      []string  `json:"scopes,omitempty"`
+	Permissions []string  `json:"perm,omitempty"`
+	Challenge   bool      `json:"challenge,omitempty"`
+	APIKeyId    int       `json:"apiKey,omitempty"`
+	ClientId    string    `json:"client_id,omitempty"`
+	SessionId   string    `json:"sid,omitempty"`
+	Tenant      string    `json:"tid,omitempty"`
+	jwt.StandardClaims
+}
+
+func ClaimsFromToken(token *jwt.Token) (*Claims, bool) {
+	if token == nil {
+		return nil, false
+	}
+	claims, ok := token.Claims.(*Claims)
+	return claims, ok
+}
+
+func (authService *BasicJwtAuthService) newClaims(subject string, lifetime time.Duration) (*Claims, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &Claims{
+		Tenant: authService.Tenant,
+		StandardClaims: jwt.StandardClaims{
+			Id:        hex.EncodeToString(jti),
+			Subject:   subject,
+			Issuer:    authService.Issuer,
+			Audience:  authService.Audience,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(lifetime).Unix(),
+		},
+	}, nil
+}
+
+func (authService *BasicJwtAuthService) validateClaims(claims *Claims) error {
+	now := time.Now().Unix()
+	leeway := int64(authService.Leeway / time.Second)
+	if claims.Subject == "" || claims.ExpiresAt == 0 || claims.Tenant != authService.Tenant {
+		return ErrInvalidToken
+	}
+	if now > claims.ExpiresAt+leeway {
+		return ErrInvalidToken
+	}
+	if claims.IssuedAt > now+leeway || claims.NotBefore > now+leeway {
+		return ErrInvalidToken
+	}
+	if authService.Issuer != "" && claims.Issuer != authService.Issuer {
+		return ErrInvalidToken
+	}
+	if authService.Audience != "" && claims.Audience != authService.Audience {
+		return ErrInvalidToken
+	}
+	return nil
+}
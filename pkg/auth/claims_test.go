@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBasicJwtAuthService_GetTokenFromString_Malformed(t *testing.T) {
+	service := prepareAuthService()
+	_, err := service.GetTokenFromString("not-a-token")
+	if err != ErrInvalidToken {
+		t.Errorf("expected %v, received %v", ErrInvalidToken, err)
+	}
+}
+
+func TestBasicJwtAuthService_GetTokenFromString_Audience_Mismatch(t *testing.T) {
+	userRepo := &MockUserRepo{}
+	issuing := &BasicJwtAuthService{Repo: userRepo, Issuer: "catalog", Audience: "storefront"}
+	verifying := &BasicJwtAuthService{Repo: userRepo, Issuer: "catalog", Audience: "backoffice"}
+	_ = issuing.RegisterUser("hugo", "test")
+	tokenString, err := issuing.GenerateToken(Credentials{Username: "hugo", Password: "test"})
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if _, err = issuing.GetTokenFromString(tokenString); err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+	}
+	if _, err = verifying.GetTokenFromString(tokenString); err != ErrInvalidToken {
+		t.Errorf("expected %v, received %v", ErrInvalidToken, err)
+	}
+}
+
+func TestBasicJwtAuthService_ValidateClaims_Leeway(t *testing.T) {
+	service := &BasicJwtAuthService{Repo: &MockUserRepo{}, Leeway: time.Minute}
+	claims, err := service.newClaims("hugo", tokenLifetime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims.ExpiresAt = time.Now().Add(-30 * time.Second).Unix()
+	if err = service.validateClaims(claims); err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+	}
+	claims.ExpiresAt = time.Now().Add(-2 * time.Minute).Unix()
+	if err = service.validateClaims(claims); err != ErrInvalidToken {
+		t.Errorf("expected %v, received %v", ErrInvalidToken, err)
+	}
+}
+
+func TestBasicJwtAuthService_GetTokenFromString_Tenant_Mismatch(t *testing.T) {
+	userRepo := &MockUserRepo{}
+	storeA := &BasicJwtAuthService{Repo: userRepo, Tenant: "store-a"}
+	storeB := &BasicJwtAuthService{Repo: userRepo, Tenant: "store-b"}
+	_ = storeA.RegisterUser("hugo", "test")
+	tokenString, err := storeA.GenerateToken(Credentials{Username: "hugo", Password: "test"})
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if _, err = storeA.GetTokenFromString(tokenString); err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+	}
+	if _, err = storeB.GetTokenFromString(tokenString); err != ErrInvalidToken {
+		t.Errorf("expected %v, received %v", ErrInvalidToken, err)
+	}
+}
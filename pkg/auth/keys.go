@@ -0,0 +1,297 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	keyFileExtension    = ".pem"
+	keyReloadInterval   = time.Minute
+	defaultKeyRetention = time.Hour
+	defaultKeyAlgorithm = "RS256"
+	rsaKeyBits          = 2048
+
+	// JWKSMaxAge is how long verifiers may cache the published key set.
+	JWKSMaxAge = 5 * time.Minute
+
+	// keyActivationDelay keeps a new key in the key set until every instance
+	// has reloaded it and every cached copy of the key set has expired.
+	keyActivationDelay = JWKSMaxAge + keyReloadInterval
+)
+
+var errNoSigningKeys = errors.New("no signing keys found")
+
+type (
+	SigningKey struct {
+		Id      string
+		Method  jwt.SigningMethod
+		Private crypto.Signer
+		Created time.Time
+	}
+
+	KeyStore struct {
+		Dir              string
+		Algorithm        string
+		RotationInterval time.Duration
+		Retention        time.Duration
+		mutex            sync.RWMutex
+		keys             []SigningKey
+	}
+
+	JWK struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		Alg string `json:"alg"`
+		N   string `json:"n,omitempty"`
+		E   string `json:"e,omitempty"`
+		Crv string `json:"crv,omitempty"`
+		X   string `json:"x,omitempty"`
+		Y   string `json:"y,omitempty"`
+	}
+
+	JWKSet struct {
+		Keys []JWK `json:"keys"`
+	}
+)
+
+func NewKeyStore(dir, algorithm string, rotationInterval time.Duration) (*KeyStore, error) {
+	if algorithm == "" {
+		algorithm = defaultKeyAlgorithm
+	}
+	if _, err := generateKey(algorithm); err != nil {
+		return nil, err
+	}
+	store := &KeyStore{Dir: dir, Algorithm: algorithm, RotationInterval: rotationInterval, Retention: defaultKeyRetention}
+	err := store.Load()
+	if err == errNoSigningKeys {
+		err = store.Rotate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *KeyStore) Load() error {
+	files, err := ioutil.ReadDir(store.Dir)
+	if err != nil {
+		return err
+	}
+	keys := make([]SigningKey, 0)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), keyFileExtension) {
+			continue
+		}
+		key, err := readKeyFile(filepath.Join(store.Dir, file.Name()))
+		if err != nil {
+			return fmt.Errorf("loading key %s: %v", file.Name(), err)
+		}
+		key.Id = strings.TrimSuffix(file.Name(), keyFileExtension)
+		key.Created = file.ModTime()
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return errNoSigningKeys
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	store.mutex.Lock()
+	store.keys = keys
+	store.mutex.Unlock()
+	return nil
+}
+
+func (store *KeyStore) Rotate() error {
+	private, err := generateKey(store.Algorithm)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err = rand.Read(suffix); err != nil {
+		return err
+	}
+	kid := time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	err = ioutil.WriteFile(filepath.Join(store.Dir, kid+keyFileExtension), pemBytes, 0600)
+	if err != nil {
+		return err
+	}
+	err = store.Load()
+	if err != nil {
+		return err
+	}
+	store.prune()
+	return nil
+}
+
+func (store *KeyStore) StartRotation(stop <-chan struct{}) {
+	ticker := time.NewTicker(keyReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := store.Load(); err != nil {
+				log.Print(err)
+				continue
+			}
+			if store.RotationInterval > 0 && time.Since(store.newestKey().Created) >= store.RotationInterval {
+				if err := store.Rotate(); err != nil {
+					log.Print(err)
+				}
+			}
+		}
+	}
+}
+
+// SigningKey returns the newest key that has been published for at least
+// keyActivationDelay, or the oldest key while none has.
+func (store *KeyStore) SigningKey() SigningKey {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	for i := len(store.keys) - 1; i > 0; i-- {
+		if time.Since(store.keys[i].Created) >= keyActivationDelay {
+			return store.keys[i]
+		}
+	}
+	return store.keys[0]
+}
+
+func (store *KeyStore) newestKey() SigningKey {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.keys[len(store.keys)-1]
+}
+
+func (store *KeyStore) VerificationKey(kid string) (SigningKey, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	for _, key := range store.keys {
+		if key.Id == kid {
+			return key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+func (store *KeyStore) JWKS() JWKSet {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	set := JWKSet{Keys: make([]JWK, 0, len(store.keys))}
+	for _, key := range store.keys {
+		set.Keys = append(set.Keys, publicJWK(key))
+	}
+	return set
+}
+
+func (store *KeyStore) prune() {
+	store.mutex.RLock()
+	keys := store.keys
+	store.mutex.RUnlock()
+	// a key stays available for verification for the retention period after its successor took over
+	for i := 0; i < len(keys)-1; i++ {
+		if time.Since(keys[i+1].Created) < keyActivationDelay+store.Retention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(store.Dir, keys[i].Id+keyFileExtension)); err != nil {
+			log.Print(err)
+		}
+	}
+	if err := store.Load(); err != nil {
+		log.Print(err)
+	}
+}
+
+func generateKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case "RS256":
+		return rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case "ES256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EdDSA":
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	}
+	return nil, fmt.Errorf("unsupported signing algorithm: %s", algorithm)
+}
+
+func readKeyFile(path string) (SigningKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return SigningKey{}, errors.New("no PEM data found")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	switch private := parsed.(type) {
+	case *rsa.PrivateKey:
+		return SigningKey{Method: jwt.SigningMethodRS256, Private: private}, nil
+	case *ecdsa.PrivateKey:
+		if private.Curve != elliptic.P256() {
+			return SigningKey{}, errors.New("only P-256 ECDSA keys are supported")
+		}
+		return SigningKey{Method: jwt.SigningMethodES256, Private: private}, nil
+	case ed25519.PrivateKey:
+		return SigningKey{Method: SigningMethodEd25519, Private: private}, nil
+	}
+	return SigningKey{}, errors.New("unsupported key type")
+}
+
+func publicJWK(key SigningKey) JWK {
+	jwk := JWK{Kid: key.Id, Use: "sig", Alg: key.Method.Alg()}
+	switch public := key.Private.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		jwk.X = base64.RawURLEncoding.EncodeToString(padCoordinate(public.X.Bytes()))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(padCoordinate(public.Y.Bytes()))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+	return jwk
+}
+
+func padCoordinate(coordinate []byte) []byte {
+	padded := make([]byte, 32)
+	copy(padded[32-len(coordinate):], coordinate)
+	return padded
+}
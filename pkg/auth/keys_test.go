@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyStore_SignAndVerify(t *testing.T) {
+	for _, algorithm := range []string{"RS256", "ES256", "EdDSA"} {
+		dir, err := ioutil.TempDir("", "keys")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		store, err := NewKeyStore(dir, algorithm, time.Hour)
+		if err != nil {
+			t.Errorf("expected %v, received %v", nil, err)
+			t.FailNow()
+		}
+		service := &BasicJwtAuthService{Repo: &MockUserRepo{}, Keys: store}
+		_ = service.RegisterUser("hugo", "test")
+		tokenString, err := service.GenerateToken(Credentials{Username: "hugo", Password: "test"})
+		if err != nil {
+			t.Errorf("expected %v, received %v", nil, err)
+			t.FailNow()
+		}
+		token, err := service.GetTokenFromString(tokenString)
+		if err != nil {
+			t.Errorf("expected %v, received %v", nil, err)
+			t.FailNow()
+		}
+		if token.Header["alg"] != algorithm || token.Header["kid"] != store.SigningKey().Id {
+			t.Errorf("unexpected header %v", token.Header)
+		}
+		jwks := service.JWKS()
+		if len(jwks.Keys) != 1 || jwks.Keys[0].Alg != algorithm {
+			t.Errorf("unexpected key set %v", jwks)
+		}
+	}
+}
+
+func TestKeyStore_Rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewKeyStore(dir, "ES256", time.Hour)
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	service := &BasicJwtAuthService{Repo: &MockUserRepo{}, Keys: store}
+	_ = service.RegisterUser("hugo", "test")
+	oldToken, _ := service.GenerateToken(Credentials{Username: "hugo", Password: "test"})
+	oldKid := store.SigningKey().Id
+	// file modification times only have second resolution on some filesystems
+	time.Sleep(1100 * time.Millisecond)
+	err = store.Rotate()
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if store.SigningKey().Id != oldKid {
+		t.Error("expected the new key to be published before it signs")
+	}
+	if len(service.JWKS().Keys) != 2 {
+		t.Errorf("expected %d, received %d", 2, len(service.JWKS().Keys))
+	}
+	newKey := store.newestKey()
+	published := time.Now().Add(-keyActivationDelay)
+	_ = os.Chtimes(filepath.Join(dir, oldKid+keyFileExtension), published.Add(-time.Minute), published.Add(-time.Minute))
+	_ = os.Chtimes(filepath.Join(dir, newKey.Id+keyFileExtension), published, published)
+	if err = store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if store.SigningKey().Id != newKey.Id {
+		t.Error("expected a new signing key after the activation delay")
+		t.FailNow()
+	}
+	if _, err = service.GetTokenFromString(oldToken); err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+	}
+}
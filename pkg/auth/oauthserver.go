@@ -0,0 +1,350 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+
+	authorizationCodeLifetime = time.Minute
+)
+
+type (
+	AuthorizationServer interface {
+		RegisterClient(owner string, request ClientRequest) (repo.OAuthClient, string, error)
+		ListClients(owner string) ([]repo.OAuthClient, error)
+		ValidateAuthorizationRequest(request AuthorizationRequest) (repo.OAuthClient, []string, error)
+		Authorize(username string, request AuthorizationRequest) (string, error)
+		ExchangeToken(request TokenRequest) (TokenResponse, error)
+		Introspect(clientId, clientSecret, token string) (Introspection, error)
+		Revoke(clientId, clientSecret, token string) error
+	}
+
+	OAuthServer struct {
+		Service *BasicJwtAuthService
+		Clients repo.OAuthRepository
+	}
+
+	ClientRequest struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirectUris"`
+		Scopes       []string `json:"scopes"`
+		GrantTypes   []string `json:"grantTypes"`
+		Public       bool     `json:"public"`
+	}
+
+	AuthorizationRequest struct {
+		ResponseType        string
+		ClientId            string
+		RedirectURI         string
+		Scope               string
+		State               string
+		CodeChallenge       string
+		CodeChallengeMethod string
+	}
+
+	TokenRequest struct {
+		GrantType    string
+		ClientId     string
+		ClientSecret string
+		Code         string
+		RedirectURI  string
+		CodeVerifier string
+		Scope        string
+	}
+
+	TokenResponse struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+		Scope       string `json:"scope,omitempty"`
+	}
+
+	Introspection struct {
+		Active    bool   `json:"active"`
+		Scope     string `json:"scope,omitempty"`
+		ClientId  string `json:"client_id,omitempty"`
+		Username  string `json:"username,omitempty"`
+		TokenType string `json:"token_type,omitempty"`
+		Exp       int64  `json:"exp,omitempty"`
+		Iat       int64  `json:"iat,omitempty"`
+		Nbf       int64  `json:"nbf,omitempty"`
+		Sub       string `json:"sub,omitempty"`
+		Aud       string `json:"aud,omitempty"`
+		Iss       string `json:"iss,omitempty"`
+		Jti       string `json:"jti,omitempty"`
+	}
+
+	OAuthError struct {
+		Code        string `json:"error"`
+		Description string `json:"error_description,omitempty"`
+		Status      int    `json:"-"`
+	}
+)
+
+func (err *OAuthError) Error() string {
+	return err.Code + ": " + err.Description
+}
+
+func oauthError(status int, code, description string) *OAuthError {
+	return &OAuthError{Code: code, Description: description, Status: status}
+}
+
+var (
+	ErrInvalidClient = oauthError(http.StatusUnauthorized, "invalid_client", "client authentication failed")
+	ErrInvalidGrant  = oauthError(http.StatusBadRequest, "invalid_grant", "authorization code is invalid or expired")
+)
+
+func (server *OAuthServer) RegisterClient(owner string, request ClientRequest) (repo.OAuthClient, string, error) {
+	if request.Name == "" {
+		return repo.OAuthClient{}, "", oauthError(http.StatusBadRequest, "invalid_client_metadata", "name required")
+	}
+	for _, scope := range request.Scopes {
+		if !isKnownScope(scope) {
+			return repo.OAuthClient{}, "", oauthError(http.StatusBadRequest, "invalid_client_metadata", "unknown scope "+scope)
+		}
+	}
+	if len(request.GrantTypes) == 0 {
+		request.GrantTypes = []string{GrantAuthorizationCode}
+	}
+	for _, grantType := range request.GrantTypes {
+		switch grantType {
+		case GrantAuthorizationCode:
+			if len(request.RedirectURIs) == 0 {
+				return repo.OAuthClient{}, "", oauthError(http.StatusBadRequest, "invalid_redirect_uri", "redirect uri required")
+			}
+		case GrantClientCredentials:
+			if request.Public {
+				return repo.OAuthClient{}, "", oauthError(http.StatusBadRequest, "invalid_client_metadata", "public clients cannot use client credentials")
+			}
+		default:
+			return repo.OAuthClient{}, "", oauthError(http.StatusBadRequest, "invalid_client_metadata", "unsupported grant type "+grantType)
+		}
+	}
+	clientId, err := randomToken(16)
+	if err != nil {
+		return repo.OAuthClient{}, "", err
+	}
+	client := repo.OAuthClient{
+		ClientId:     clientId,
+		Name:         request.Name,
+		RedirectURIs: request.RedirectURIs,
+		Scopes:       request.Scopes,
+		GrantTypes:   request.GrantTypes,
+		Owner:        owner,
+	}
+	secret := ""
+	if !request.Public {
+		secret, err = randomToken(32)
+		if err != nil {
+			return repo.OAuthClient{}, "", err
+		}
+		client.SecretHash = hashToken(secret)
+	}
+	stored, err := server.Clients.AddClient(client)
+	return stored, secret, err
+}
+
+func (server *OAuthServer) ListClients(owner string) ([]repo.OAuthClient, error) {
+	return server.Clients.ClientsByOwner(owner)
+}
+
+func (server *OAuthServer) ValidateAuthorizationRequest(request AuthorizationRequest) (repo.OAuthClient, []string, error) {
+	client, err := server.Clients.GetClient(request.ClientId)
+	if err != nil {
+		return repo.OAuthClient{}, nil, oauthError(http.StatusBadRequest, "invalid_request", "unknown client")
+	}
+	if !contains(client.RedirectURIs, request.RedirectURI) {
+		return repo.OAuthClient{}, nil, oauthError(http.StatusBadRequest, "invalid_request", "redirect uri not registered")
+	}
+	if request.ResponseType != "code" || !contains(client.GrantTypes, GrantAuthorizationCode) {
+		return client, nil, oauthError(http.StatusBadRequest, "unsupported_response_type", "only the code response type is supported")
+	}
+	if request.CodeChallenge == "" || request.CodeChallengeMethod != "S256" {
+		return client, nil, oauthError(http.StatusBadRequest, "invalid_request", "PKCE with S256 required")
+	}
+	scopes, err := grantedScopes(client, request.Scope)
+	return client, scopes, err
+}
+
+func (server *OAuthServer) Authorize(username string, request AuthorizationRequest) (string, error) {
+	_, scopes, err := server.ValidateAuthorizationRequest(request)
+	if err != nil {
+		return "", err
+	}
+	code, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	err = server.Clients.AddAuthorizationCode(repo.AuthorizationCode{
+		CodeHash:      hashToken(code),
+		ClientId:      request.ClientId,
+		Username:      username,
+		RedirectURI:   request.RedirectURI,
+		Scopes:        scopes,
+		CodeChallenge: request.CodeChallenge,
+		Expires:       time.Now().Add(authorizationCodeLifetime),
+	})
+	return code, err
+}
+
+func (server *OAuthServer) ExchangeToken(request TokenRequest) (TokenResponse, error) {
+	switch request.GrantType {
+	case GrantAuthorizationCode:
+		return server.exchangeAuthorizationCode(request)
+	case GrantClientCredentials:
+		return server.exchangeClientCredentials(request)
+	}
+	return TokenResponse{}, oauthError(http.StatusBadRequest, "unsupported_grant_type", "")
+}
+
+func (server *OAuthServer) exchangeAuthorizationCode(request TokenRequest) (TokenResponse, error) {
+	client, err := server.authenticateClient(request.ClientId, request.ClientSecret, false)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	code, err := server.Clients.TakeAuthorizationCode(hashToken(request.Code))
+	if err != nil || code.ClientId != client.ClientId || code.RedirectURI != request.RedirectURI || time.Now().After(code.Expires) {
+		return TokenResponse{}, ErrInvalidGrant
+	}
+	challenge := sha256.Sum256([]byte(request.CodeVerifier))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(challenge[:])), []byte(code.CodeChallenge)) != 1 {
+		return TokenResponse{}, ErrInvalidGrant
+	}
+	usr, err := server.Service.Repo.GetByUsername(code.Username)
+	if err != nil {
+		return TokenResponse{}, ErrInvalidGrant
+	}
+	return server.issueAccessToken(usr.Username, usr.Role, client.ClientId, code.Scopes)
+}
+
+func (server *OAuthServer) exchangeClientCredentials(request TokenRequest) (TokenResponse, error) {
+	client, err := server.authenticateClient(request.ClientId, request.ClientSecret, true)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	if !contains(client.GrantTypes, GrantClientCredentials) {
+		return TokenResponse{}, oauthError(http.StatusBadRequest, "unauthorized_client", "")
+	}
+	scopes, err := grantedScopes(client, request.Scope)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	return server.issueAccessToken(client.ClientId, repo.USER, client.ClientId, scopes)
+}
+
+func (server *OAuthServer) issueAccessToken(subject string, role repo.Role, clientId string, scopes []string) (TokenResponse, error) {
+	claims, err := server.Service.newClaims(subject, tokenLifetime)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	claims.Role = role
+	claims.ClientId = clientId
+	claims.Scopes = scopes
+	accessToken, err := server.Service.signToken(claims)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	return TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(tokenLifetime / time.Second),
+		Scope:       strings.Join(scopes, " "),
+	}, nil
+}
+
+func (server *OAuthServer) Introspect(clientId, clientSecret, token string) (Introspection, error) {
+	if _, err := server.authenticateClient(clientId, clientSecret, true); err != nil {
+		return Introspection{}, err
+	}
+	parsed, err := server.Service.GetTokenFromString(token)
+	if err != nil {
+		return Introspection{Active: false}, nil
+	}
+	claims, _ := ClaimsFromToken(parsed)
+	introspection := Introspection{
+		Active:    true,
+		Scope:     strings.Join(claims.Scopes, " "),
+		ClientId:  claims.ClientId,
+		TokenType: "Bearer",
+		Exp:       claims.ExpiresAt,
+		Iat:       claims.IssuedAt,
+		Nbf:       claims.NotBefore,
+		Sub:       claims.Subject,
+		Aud:       claims.Audience,
+		Iss:       claims.Issuer,
+		Jti:       claims.Id,
+	}
+	if claims.ClientId != claims.Subject {
+		introspection.Username = claims.Subject
+	}
+	return introspection, nil
+}
+
+func (server *OAuthServer) Revoke(clientId, clientSecret, token string) error {
+	client, err := server.authenticateClient(clientId, clientSecret, false)
+	if err != nil {
+		return err
+	}
+	if server.Service.Revocations == nil {
+		return errors.New("token revocation not configured")
+	}
+	parsed, err := server.Service.GetTokenFromString(token)
+	if err != nil {
+		// RFC 7009 treats unknown or already invalid tokens as successfully revoked
+		return nil
+	}
+	claims, _ := ClaimsFromToken(parsed)
+	if claims.ClientId != client.ClientId {
+		return nil
+	}
+	return server.Service.Revocations.RevokeToken(claims.Id, time.Unix(claims.ExpiresAt, 0))
+}
+
+func (server *OAuthServer) authenticateClient(clientId, clientSecret string, requireSecret bool) (repo.OAuthClient, error) {
+	client, err := server.Clients.GetClient(clientId)
+	if err != nil {
+		return repo.OAuthClient{}, ErrInvalidClient
+	}
+	if client.SecretHash == "" {
+		if requireSecret {
+			return repo.OAuthClient{}, ErrInvalidClient
+		}
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(hashToken(clientSecret))) != 1 {
+		return repo.OAuthClient{}, ErrInvalidClient
+	}
+	return client, nil
+}
+
+func grantedScopes(client repo.OAuthClient, requested string) ([]string, error) {
+	if requested == "" {
+		return client.Scopes, nil
+	}
+	scopes := strings.Fields(requested)
+	for _, scope := range scopes {
+		if !contains(client.Scopes, scope) {
+			return nil, oauthError(http.StatusBadRequest, "invalid_scope", scope)
+		}
+	}
+	return scopes, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"testing"
+	"time"
+)
+
+type mockOAuthRepo struct {
+	Clients []repo.OAuthClient
+	Codes   map[string]repo.AuthorizationCode
+	Revoked map[string]bool
+}
+
+func (mockRepo *mockOAuthRepo) AddClient(client repo.OAuthClient) (repo.OAuthClient, error) {
+	client.Id = len(mockRepo.Clients) + 1
+	mockRepo.Clients = append(mockRepo.Clients, client)
+	return client, nil
+}
+
+func (mockRepo *mockOAuthRepo) GetClient(clientId string) (repo.OAuthClient, error) {
+	for _, client := range mockRepo.Clients {
+		if client.ClientId == clientId {
+			return client, nil
+		}
+	}
+	return repo.OAuthClient{}, errors.New("client not found")
+}
+
+func (mockRepo *mockOAuthRepo) ClientsByOwner(owner string) ([]repo.OAuthClient, error) {
+	return mockRepo.Clients, nil
+}
+
+func (mockRepo *mockOAuthRepo) AddAuthorizationCode(code repo.AuthorizationCode) error {
+	mockRepo.Codes[code.CodeHash] = code
+	return nil
+}
+
+func (mockRepo *mockOAuthRepo) TakeAuthorizationCode(codeHash string) (repo.AuthorizationCode, error) {
+	code, ok := mockRepo.Codes[codeHash]
+	if !ok {
+		return repo.AuthorizationCode{}, errors.New("authorization code not found")
+	}
+	delete(mockRepo.Codes, codeHash)
+	return code, nil
+}
+
+func (mockRepo *mockOAuthRepo) RevokeToken(jti string, expires time.Time) error {
+	mockRepo.Revoked[jti] = true
+	return nil
+}
+
+func (mockRepo *mockOAuthRepo) IsTokenRevoked(jti string) (bool, error) {
+	return mockRepo.Revoked[jti], nil
+}
+
+func prepareOAuthServer() *OAuthServer {
+	oauthRepo := &mockOAuthRepo{Codes: map[string]repo.AuthorizationCode{}, Revoked: map[string]bool{}}
+	service := &BasicJwtAuthService{Repo: &MockUserRepo{}, Revocations: oauthRepo}
+	return &OAuthServer{Service: service, Clients: oauthRepo}
+}
+
+func TestOAuthServer_ClientCredentials(t *testing.T) {
+	server := prepareOAuthServer()
+	client, secret, err := server.RegisterClient("admin", ClientRequest{
+		Name:       "partner",
+		Scopes:     []string{ScopeProductsRead},
+		GrantTypes: []string{GrantClientCredentials},
+	})
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	_, err = server.ExchangeToken(TokenRequest{GrantType: GrantClientCredentials, ClientId: client.ClientId, ClientSecret: "wrong"})
+	if err != ErrInvalidClient {
+		t.Errorf("expected %v, received %v", ErrInvalidClient, err)
+		t.FailNow()
+	}
+	response, err := server.ExchangeToken(TokenRequest{GrantType: GrantClientCredentials, ClientId: client.ClientId, ClientSecret: secret})
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	introspection, err := server.Introspect(client.ClientId, secret, response.AccessToken)
+	if err != nil || !introspection.Active || introspection.Scope != ScopeProductsRead {
+		t.Errorf("unexpected introspection %v, %v", introspection, err)
+		t.FailNow()
+	}
+	err = server.Revoke(client.ClientId, secret, response.AccessToken)
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	introspection, _ = server.Introspect(client.ClientId, secret, response.AccessToken)
+	if introspection.Active {
+		t.Error("expected revoked token to be inactive")
+	}
+}
+
+func TestOAuthServer_AuthorizationCode_PKCE(t *testing.T) {
+	server := prepareOAuthServer()
+	_ = server.Service.RegisterUser("hugo", "test")
+	client, _, err := server.RegisterClient("admin", ClientRequest{
+		Name:         "partner app",
+		RedirectURIs: []string{"https://partner.example.com/callback"},
+		Scopes:       []string{ScopeProductsRead, ScopeProductsWrite},
+		Public:       true,
+	})
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	verifier := "a-sufficiently-long-code-verifier-for-the-test"
+	sum := sha256.Sum256([]byte(verifier))
+	authRequest := AuthorizationRequest{
+		ResponseType:        "code",
+		ClientId:            client.ClientId,
+		RedirectURI:         "https://partner.example.com/callback",
+		Scope:               ScopeProductsRead,
+		CodeChallenge:       base64.RawURLEncoding.EncodeToString(sum[:]),
+		CodeChallengeMethod: "S256",
+	}
+	code, err := server.Authorize("hugo", authRequest)
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	tokenRequest := TokenRequest{
+		GrantType:    GrantAuthorizationCode,
+		ClientId:     client.ClientId,
+		Code:         code,
+		RedirectURI:  authRequest.RedirectURI,
+		CodeVerifier: "wrong-verifier",
+	}
+	if _, err = server.ExchangeToken(tokenRequest); err != ErrInvalidGrant {
+		t.Errorf("expected %v, received %v", ErrInvalidGrant, err)
+		t.FailNow()
+	}
+	code, _ = server.Authorize("hugo", authRequest)
+	tokenRequest.Code = code
+	tokenRequest.CodeVerifier = verifier
+	response, err := server.ExchangeToken(tokenRequest)
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	token, err := server.Service.GetTokenFromString(response.AccessToken)
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	claims, _ := ClaimsFromToken(token)
+	if claims.Subject != "hugo" || claims.ClientId != client.ClientId || len(claims.Scopes) != 1 {
+		t.Errorf("unexpected claims %v", claims)
+	}
+	if _, err = server.ExchangeToken(tokenRequest); err != ErrInvalidGrant {
+		t.Errorf("expected %v, received %v", ErrInvalidGrant, err)
+	}
+}
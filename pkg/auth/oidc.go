@@ -0,0 +1,423 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"golang.org/x/crypto/bcrypt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcStateLifetime = 10 * time.Minute
+	oidcHTTPTimeout   = 10 * time.Second
+)
+
+var (
+	ErrOIDCNotConfigured = errors.New("oidc login not configured")
+	ErrInvalidOIDCState  = errors.New("invalid or expired login state")
+	ErrInvalidIDToken    = errors.New("invalid id token")
+)
+
+type (
+	OIDCConfig struct {
+		IssuerURL    string
+		ClientID     string
+		ClientSecret string
+		RedirectURL  string
+		Scopes       []string
+		RoleClaim    string
+		AdminValues  []string
+	}
+
+	OIDCProvider struct {
+		Config    OIDCConfig
+		Client    *http.Client
+		discovery oidcDiscovery
+		mutex     sync.Mutex
+		keys      map[string]interface{}
+		pending   map[string]pendingLogin
+	}
+
+	OIDCIdentity struct {
+		Issuer            string
+		Subject           string
+		Email             string
+		EmailVerified     bool
+		PreferredUsername string
+		Role              repo.Role
+	}
+
+	oidcDiscovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+
+	oidcTokenResponse struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+
+	pendingLogin struct {
+		Verifier string
+		Nonce    string
+		LinkUser string
+		Expires  time.Time
+	}
+)
+
+func NewOIDCProvider(config OIDCConfig) (*OIDCProvider, error) {
+	provider := &OIDCProvider{
+		Config:  config,
+		Client:  &http.Client{Timeout: oidcHTTPTimeout},
+		keys:    map[string]interface{}{},
+		pending: map[string]pendingLogin{},
+	}
+	if len(provider.Config.Scopes) == 0 {
+		provider.Config.Scopes = []string{"openid", "email", "profile"}
+	}
+	discoveryURL := strings.TrimSuffix(config.IssuerURL, "/") + "/.well-known/openid-configuration"
+	err := provider.getJSON(discoveryURL, &provider.discovery)
+	if err != nil {
+		return nil, err
+	}
+	if provider.discovery.Issuer != config.IssuerURL {
+		return nil, fmt.Errorf("issuer mismatch: expected %s, got %s", config.IssuerURL, provider.discovery.Issuer)
+	}
+	return provider, nil
+}
+
+func (provider *OIDCProvider) AuthorizationURL(linkUser string) (string, string, error) {
+	state, err := randomToken(24)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomToken(24)
+	if err != nil {
+		return "", "", err
+	}
+	provider.mutex.Lock()
+	provider.removeExpiredLogins()
+	provider.pending[state] = pendingLogin{Verifier: verifier, Nonce: nonce, LinkUser: linkUser, Expires: time.Now().Add(oidcStateLifetime)}
+	provider.mutex.Unlock()
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", provider.Config.ClientID)
+	params.Set("redirect_uri", provider.Config.RedirectURL)
+	params.Set("scope", strings.Join(provider.Config.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+	separator := "?"
+	if strings.Contains(provider.discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return provider.discovery.AuthorizationEndpoint + separator + params.Encode(), state, nil
+}
+
+func (provider *OIDCProvider) Exchange(state, code string) (OIDCIdentity, string, error) {
+	provider.mutex.Lock()
+	login, ok := provider.pending[state]
+	delete(provider.pending, state)
+	provider.mutex.Unlock()
+	if !ok || time.Now().After(login.Expires) {
+		return OIDCIdentity{}, "", ErrInvalidOIDCState
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", provider.Config.RedirectURL)
+	form.Set("client_id", provider.Config.ClientID)
+	form.Set("code_verifier", login.Verifier)
+	request, err := http.NewRequest("POST", provider.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return OIDCIdentity{}, "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if provider.Config.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(provider.Config.ClientID), url.QueryEscape(provider.Config.ClientSecret))
+	}
+	response, err := provider.Client.Do(request)
+	if err != nil {
+		return OIDCIdentity{}, "", err
+	}
+	defer response.Body.Close()
+	tokenResponse := oidcTokenResponse{}
+	err = json.NewDecoder(response.Body).Decode(&tokenResponse)
+	if err != nil {
+		return OIDCIdentity{}, "", err
+	}
+	if response.StatusCode != http.StatusOK || tokenResponse.IDToken == "" {
+		return OIDCIdentity{}, "", fmt.Errorf("token exchange failed: %d %s", response.StatusCode, tokenResponse.Error)
+	}
+	identity, err := provider.verifyIDToken(tokenResponse.IDToken, login.Nonce)
+	return identity, login.LinkUser, err
+}
+
+func (provider *OIDCProvider) verifyIDToken(idToken, nonce string) (OIDCIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, &claims, provider.keyFunc)
+	if err != nil {
+		return OIDCIdentity{}, ErrInvalidIDToken
+	}
+	if claims["iss"] != provider.discovery.Issuer || claims["nonce"] != nonce || !hasAudience(claims["aud"], provider.Config.ClientID) {
+		return OIDCIdentity{}, ErrInvalidIDToken
+	}
+	if _, ok := claims["exp"]; !ok {
+		return OIDCIdentity{}, ErrInvalidIDToken
+	}
+	identity := OIDCIdentity{Issuer: provider.discovery.Issuer, Role: repo.USER}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.EmailVerified, _ = claims["email_verified"].(bool)
+	identity.PreferredUsername, _ = claims["preferred_username"].(string)
+	if identity.Subject == "" {
+		return OIDCIdentity{}, ErrInvalidIDToken
+	}
+	if provider.Config.RoleClaim != "" && claimContainsAny(claims[provider.Config.RoleClaim], provider.Config.AdminValues) {
+		identity.Role = repo.ADMIN
+	}
+	return identity, nil
+}
+
+func (provider *OIDCProvider) keyFunc(tok *jwt.Token) (interface{}, error) {
+	switch tok.Method.Alg() {
+	case "RS256", "ES256", "EdDSA":
+	default:
+		return nil, fmt.Errorf("unexpected signing method: %v", tok.Header["alg"])
+	}
+	kid, _ := tok.Header["kid"].(string)
+	provider.mutex.Lock()
+	key, ok := provider.keys[kid]
+	provider.mutex.Unlock()
+	if ok {
+		return key, nil
+	}
+	// unknown key ids usually mean the provider rotated its keys, so the set is fetched again
+	set := JWKSet{}
+	if err := provider.getJSON(provider.discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		if public, err := jwk.PublicKey(); err == nil {
+			keys[jwk.Kid] = public
+		}
+	}
+	provider.mutex.Lock()
+	provider.keys = keys
+	provider.mutex.Unlock()
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown key id: %v", tok.Header["kid"])
+	}
+	return key, nil
+}
+
+func (provider *OIDCProvider) getJSON(target string, value interface{}) error {
+	response, err := provider.Client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %d", target, response.StatusCode)
+	}
+	return json.NewDecoder(response.Body).Decode(value)
+}
+
+func (provider *OIDCProvider) removeExpiredLogins() {
+	now := time.Now()
+	for state, login := range provider.pending {
+		if now.After(login.Expires) {
+			delete(provider.pending, state)
+		}
+	}
+}
+
+func (jwk JWK) PublicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, errors.New("unsupported curve")
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := decode(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New("unsupported key type")
+}
+
+func (authService *BasicJwtAuthService) OIDCAuthorizationURL(linkUser string) (string, string, error) {
+	if authService.OIDC == nil {
+		return "", "", ErrOIDCNotConfigured
+	}
+	return authService.OIDC.AuthorizationURL(linkUser)
+}
+
+func (authService *BasicJwtAuthService) OIDCLogin(state, code string) (string, error) {
+	if authService.OIDC == nil || authService.Identities == nil {
+		return "", ErrOIDCNotConfigured
+	}
+	identity, linkUser, err := authService.OIDC.Exchange(state, code)
+	if err != nil {
+		return "", err
+	}
+	usr, err := authService.resolveIdentity(identity, linkUser)
+	if err != nil {
+		return "", err
+	}
+	return authService.issueToken(usr)
+}
+
+func (authService *BasicJwtAuthService) resolveIdentity(identity OIDCIdentity, linkUser string) (repo.User, error) {
+	linked, err := authService.Identities.GetIdentity(identity.Issuer, identity.Subject)
+	if err == nil {
+		if linkUser != "" && linked.Username != linkUser {
+			return repo.User{}, errors.New("identity already linked to another user")
+		}
+		usr, err := authService.Repo.GetByUsername(linked.Username)
+		if err != nil {
+			return repo.User{}, err
+		}
+		// Without a role claim the provider says nothing about roles, so the
+		// local role is left alone.
+		if linkUser == "" && authService.OIDC.Config.RoleClaim != "" && usr.Role != identity.Role {
+			if err = authService.Identities.SetUserRole(usr.Username, identity.Role); err != nil {
+				return repo.User{}, err
+			}
+			usr.Role = identity.Role
+		}
+		return usr, nil
+	}
+	var usr repo.User
+	if linkUser != "" {
+		usr, err = authService.Repo.GetByUsername(linkUser)
+	} else {
+		usr, err = authService.provisionUser(identity)
+	}
+	if err != nil {
+		return repo.User{}, err
+	}
+	err = authService.Identities.AddIdentity(repo.ExternalIdentity{
+		Issuer:   identity.Issuer,
+		Subject:  identity.Subject,
+		Username: usr.Username,
+		Email:    identity.Email,
+	})
+	return usr, err
+}
+
+func (authService *BasicJwtAuthService) provisionUser(identity OIDCIdentity) (repo.User, error) {
+	username := identity.PreferredUsername
+	if _, err := authService.Repo.GetByUsername(username); len(username) < 4 || err == nil {
+		sum := sha256.Sum256([]byte(identity.Issuer + "|" + identity.Subject))
+		username = "oidc_" + hex.EncodeToString(sum[:6])
+	}
+	// external users authenticate at the identity provider, so the local password is unguessable
+	password := make([]byte, 32)
+	if _, err := rand.Read(password); err != nil {
+		return repo.User{}, err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	if err != nil {
+		return repo.User{}, err
+	}
+	usr := repo.User{
+		Username: username,
+		Password: string(hashedPassword),
+		Role:     identity.Role,
+		Email:    identity.Email,
+		Verified: identity.EmailVerified,
+	}
+	return usr, authService.Repo.AddUser(usr)
+}
+
+func (authService *BasicJwtAuthService) LinkedIdentities(username string) ([]repo.ExternalIdentity, error) {
+	if authService.Identities == nil {
+		return nil, ErrOIDCNotConfigured
+	}
+	return authService.Identities.IdentitiesByUsername(username)
+}
+
+func hasAudience(aud interface{}, clientID string) bool {
+	switch value := aud.(type) {
+	case string:
+		return value == clientID
+	case []interface{}:
+		for _, item := range value {
+			if item == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func claimContainsAny(claim interface{}, values []string) bool {
+	candidates := make([]string, 0)
+	switch value := claim.(type) {
+	case string:
+		candidates = append(candidates, value)
+	case []interface{}:
+		for _, item := range value {
+			if str, ok := item.(string); ok {
+				candidates = append(candidates, str)
+			}
+		}
+	}
+	for _, candidate := range candidates {
+		for _, expected := range values {
+			if candidate == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
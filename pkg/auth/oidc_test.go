@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type mockIssuer struct {
+	Server    *httptest.Server
+	Key       *rsa.PrivateKey
+	Subject   string
+	Groups    []string
+	nonce     string
+	challenge string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &mockIssuer{Key: key, Subject: "external-1"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(writer http.ResponseWriter, request *http.Request) {
+		_ = json.NewEncoder(writer).Encode(map[string]string{
+			"issuer":                 issuer.Server.URL,
+			"authorization_endpoint": issuer.Server.URL + "/authorize",
+			"token_endpoint":         issuer.Server.URL + "/token",
+			"jwks_uri":               issuer.Server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(writer http.ResponseWriter, request *http.Request) {
+		_ = json.NewEncoder(writer).Encode(JWKSet{Keys: []JWK{{
+			Kty: "RSA",
+			Kid: "mock",
+			Alg: "RS256",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(writer http.ResponseWriter, request *http.Request) {
+		_ = request.ParseForm()
+		sum := sha256.Sum256([]byte(request.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != issuer.challenge || request.PostForm.Get("code") != "valid-code" {
+			writer.WriteHeader(http.StatusBadRequest)
+			_, _ = writer.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		groups := make([]interface{}, len(issuer.Groups))
+		for i, group := range issuer.Groups {
+			groups[i] = group
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":                issuer.Server.URL,
+			"aud":                "catalog",
+			"sub":                issuer.Subject,
+			"exp":                time.Now().Add(time.Minute).Unix(),
+			"nonce":              issuer.nonce,
+			"email":              "hugo@example.com",
+			"email_verified":     true,
+			"preferred_username": "hugo.external",
+			"groups":             groups,
+		})
+		token.Header["kid"] = "mock"
+		idToken, _ := token.SignedString(key)
+		_ = json.NewEncoder(writer).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	return issuer
+}
+
+func (issuer *mockIssuer) authorize(authURL string) string {
+	parsed, _ := url.Parse(authURL)
+	issuer.nonce = parsed.Query().Get("nonce")
+	issuer.challenge = parsed.Query().Get("code_challenge")
+	return parsed.Query().Get("state")
+}
+
+type mockIdentityRepo struct {
+	Identities []repo.ExternalIdentity
+	UserRepo   *MockUserRepo
+}
+
+func (mockRepo *mockIdentityRepo) AddIdentity(identity repo.ExternalIdentity) error {
+	mockRepo.Identities = append(mockRepo.Identities, identity)
+	return nil
+}
+
+func (mockRepo *mockIdentityRepo) GetIdentity(issuer, subject string) (repo.ExternalIdentity, error) {
+	for _, identity := range mockRepo.Identities {
+		if identity.Issuer == issuer && identity.Subject == subject {
+			return identity, nil
+		}
+	}
+	return repo.ExternalIdentity{}, errors.New("identity not found")
+}
+
+func (mockRepo *mockIdentityRepo) IdentitiesByUsername(username string) ([]repo.ExternalIdentity, error) {
+	identities := make([]repo.ExternalIdentity, 0)
+	for _, identity := range mockRepo.Identities {
+		if identity.Username == username {
+			identities = append(identities, identity)
+		}
+	}
+	return identities, nil
+}
+
+func (mockRepo *mockIdentityRepo) SetUserRole(username string, role repo.Role) error {
+	for index, user := range mockRepo.UserRepo.Users {
+		if user.Username == username {
+			mockRepo.UserRepo.Users[index].Role = role
+			return nil
+		}
+	}
+	return errors.New("user not found")
+}
+
+func prepareOIDCAuthService(t *testing.T) (*BasicJwtAuthService, *mockIssuer) {
+	issuer := newMockIssuer(t)
+	provider, err := NewOIDCProvider(OIDCConfig{
+		IssuerURL:   issuer.Server.URL,
+		ClientID:    "catalog",
+		RedirectURL: "https://localhost:8080/login/oidc/callback",
+		RoleClaim:   "groups",
+		AdminValues: []string{"catalog-admins"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userRepo := &MockUserRepo{}
+	return &BasicJwtAuthService{Repo: userRepo, OIDC: provider, Identities: &mockIdentityRepo{UserRepo: userRepo}}, issuer
+}
+
+func TestBasicJwtAuthService_OIDCLogin_Provisions_User(t *testing.T) {
+	service, issuer := prepareOIDCAuthService(t)
+	defer issuer.Server.Close()
+	issuer.Groups = []string{"catalog-admins"}
+	authURL, _, err := service.OIDCAuthorizationURL("")
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	tokenString, err := service.OIDCLogin(issuer.authorize(authURL), "valid-code")
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	token, err := service.GetTokenFromString(tokenString)
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	claims, _ := ClaimsFromToken(token)
+	if claims.Subject != "hugo.external" || claims.Role != repo.ADMIN {
+		t.Errorf("unexpected claims %v", claims)
+	}
+}
+
+func TestBasicJwtAuthService_OIDCLogin_Links_Existing_User(t *testing.T) {
+	service, issuer := prepareOIDCAuthService(t)
+	defer issuer.Server.Close()
+	_ = service.RegisterUser("hugo", "test")
+	authURL, _, _ := service.OIDCAuthorizationURL("hugo")
+	_, err := service.OIDCLogin(issuer.authorize(authURL), "valid-code")
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	authURL, _, _ = service.OIDCAuthorizationURL("")
+	tokenString, err := service.OIDCLogin(issuer.authorize(authURL), "valid-code")
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	token, _ := service.GetTokenFromString(tokenString)
+	if claims, _ := ClaimsFromToken(token); claims.Subject != "hugo" {
+		t.Errorf("expected %s, received %s", "hugo", claims.Subject)
+	}
+}
+
+func TestBasicJwtAuthService_OIDCLogin_Keeps_Role_Without_Role_Claim(t *testing.T) {
+	service, issuer := prepareOIDCAuthService(t)
+	defer issuer.Server.Close()
+	service.OIDC.Config.RoleClaim = ""
+	_ = service.RegisterUser("hugo", "test")
+	_ = service.Identities.SetUserRole("hugo", repo.ADMIN)
+	authURL, _, _ := service.OIDCAuthorizationURL("hugo")
+	if _, err := service.OIDCLogin(issuer.authorize(authURL), "valid-code"); err != nil {
+		t.Fatal(err)
+	}
+	authURL, _, _ = service.OIDCAuthorizationURL("")
+	tokenString, err := service.OIDCLogin(issuer.authorize(authURL), "valid-code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := service.GetTokenFromString(tokenString)
+	if claims, _ := ClaimsFromToken(token); claims.Role != repo.ADMIN {
+		t.Errorf("expected %v, received %v", repo.ADMIN, claims.Role)
+	}
+}
+
+func TestBasicJwtAuthService_OIDCLogin_Invalid_State(t *testing.T) {
+	service, issuer := prepareOIDCAuthService(t)
+	defer issuer.Server.Close()
+	_, err := service.OIDCLogin("forged", "valid-code")
+	if err != ErrInvalidOIDCState {
+		t.Errorf("expected %v, received %v", ErrInvalidOIDCState, err)
+	}
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"log"
+)
+
+const (
+	PermissionProductsRead   = "products:read"
+	PermissionProductsWrite  = "products:write"
+	PermissionProductsDelete = "products:delete"
+	PermissionUsersAdmin     = "users:admin"
+	PermissionClientsAdmin   = "clients:admin"
+)
+
+var KnownPermissions = []string{
+	PermissionProductsRead,
+	PermissionProductsWrite,
+	PermissionProductsDelete,
+	PermissionUsersAdmin,
+	PermissionClientsAdmin,
+}
+
+var defaultRolePermissions = map[repo.Role][]string{
+	repo.ADMIN: KnownPermissions,
+	repo.USER:  {PermissionProductsRead, PermissionProductsWrite},
+}
+
+var (
+	ErrPermissionsNotConfigured = errors.New("permissions not configured")
+	ErrUnknownPermission        = errors.New("unknown permission")
+	ErrProtectedRole            = errors.New("role cannot be removed")
+)
+
+type PermissionService interface {
+	ListRoles() ([]repo.RoleDefinition, error)
+	SaveRole(role repo.RoleDefinition) error
+	DeleteRole(name repo.Role) error
+	SetUserRoles(username string, roles []repo.Role) error
+	UserPermissions(username string) ([]string, error)
+}
+
+func (authService *BasicJwtAuthService) Authorize(token *jwt.Token, permission string) bool {
+	claims, ok := ClaimsFromToken(token)
+	if !ok {
+		return false
+	}
+	permissions := claims.Permissions
+	if permissions == nil {
+		permissions = authService.tokenPermissions(claims)
+	}
+	return contains(permissions, permission)
+}
+
+// tokenPermissions resolves the permissions of a token without a perm claim.
+// OAuth tokens issued on behalf of a user get the effective permissions of
+// that user, like RefreshToken; client and service tokens those of their role.
+func (authService *BasicJwtAuthService) tokenPermissions(claims *Claims) []string {
+	if claims.ClientId == "" || claims.Subject == claims.ClientId {
+		return authService.permissionsForRoles([]repo.Role{claims.Role})
+	}
+	usr, err := authService.Repo.GetByUsername(claims.Subject)
+	if err != nil || usr.Disabled {
+		return nil
+	}
+	permissions, err := authService.effectivePermissions(usr)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	return permissions
+}
+
+func (authService *BasicJwtAuthService) ListRoles() ([]repo.RoleDefinition, error) {
+	if authService.Permissions == nil {
+		roles := make([]repo.RoleDefinition, 0, len(defaultRolePermissions))
+		for _, name := range []repo.Role{repo.ADMIN, repo.USER} {
+			roles = append(roles, repo.RoleDefinition{Name: name, Permissions: defaultRolePermissions[name]})
+		}
+		return roles, nil
+	}
+	return authService.Permissions.AllRoles()
+}
+
+func (authService *BasicJwtAuthService) SaveRole(role repo.RoleDefinition) error {
+	if authService.Permissions == nil {
+		return ErrPermissionsNotConfigured
+	}
+	if role.Name == "" {
+		return ErrUnknownRole
+	}
+	for _, permission := range role.Permissions {
+		if !contains(KnownPermissions, permission) {
+			return ErrUnknownPermission
+		}
+	}
+	if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+	return authService.Permissions.SaveRole(role)
+}
+
+func (authService *BasicJwtAuthService) DeleteRole(name repo.Role) error {
+	if authService.Permissions == nil {
+		return ErrPermissionsNotConfigured
+	}
+	if name == repo.ADMIN || name == repo.USER {
+		return ErrProtectedRole
+	}
+	return authService.Permissions.RemoveRole(name)
+}
+
+func (authService *BasicJwtAuthService) SetUserRoles(username string, roles []repo.Role) error {
+	if authService.Permissions == nil {
+		return ErrPermissionsNotConfigured
+	}
+	if _, err := authService.Repo.GetByUsername(username); err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if !authService.roleExists(role) {
+			return ErrUnknownRole
+		}
+	}
+	err := authService.Permissions.SetUserRoles(username, roles)
+	if err != nil {
+		return err
+	}
+	return authService.revokeAllSessions(username)
+}
+
+func (authService *BasicJwtAuthService) UserPermissions(username string) ([]string, error) {
+	usr, err := authService.Repo.GetByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	return authService.effectivePermissions(usr)
+}
+
+func (authService *BasicJwtAuthService) effectivePermissions(usr repo.User) ([]string, error) {
+	roles := []repo.Role{usr.Role}
+	if authService.Permissions != nil {
+		additional, err := authService.Permissions.UserRoles(usr.Username)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, additional...)
+	}
+	return authService.permissionsForRoles(roles), nil
+}
+
+func (authService *BasicJwtAuthService) permissionsForRoles(roles []repo.Role) []string {
+	permissions := make([]string, 0)
+	for _, name := range roles {
+		granted := defaultRolePermissions[name]
+		if authService.Permissions != nil {
+			role, err := authService.Permissions.GetRole(name)
+			if err != nil {
+				continue
+			}
+			granted = role.Permissions
+		}
+		for _, permission := range granted {
+			if !contains(permissions, permission) {
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	return permissions
+}
+
+func (authService *BasicJwtAuthService) roleExists(name repo.Role) bool {
+	if authService.Permissions == nil {
+		_, ok := defaultRolePermissions[name]
+		return ok
+	}
+	_, err := authService.Permissions.GetRole(name)
+	return err == nil
+}
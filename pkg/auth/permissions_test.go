@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"testing"
+)
+
+type mockPermissionRepo struct {
+	Roles    map[repo.Role]repo.RoleDefinition
+	Assigned map[string][]repo.Role
+}
+
+func newMockPermissionRepo() *mockPermissionRepo {
+	return &mockPermissionRepo{
+		Roles: map[repo.Role]repo.RoleDefinition{
+			repo.ADMIN: {Name: repo.ADMIN, Permissions: KnownPermissions},
+			repo.USER:  {Name: repo.USER, Permissions: []string{PermissionProductsRead}},
+		},
+		Assigned: map[string][]repo.Role{},
+	}
+}
+
+func (mockRepo *mockPermissionRepo) AllRoles() ([]repo.RoleDefinition, error) {
+	roles := make([]repo.RoleDefinition, 0)
+	for _, role := range mockRepo.Roles {
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+func (mockRepo *mockPermissionRepo) GetRole(name repo.Role) (repo.RoleDefinition, error) {
+	role, ok := mockRepo.Roles[name]
+	if !ok {
+		return repo.RoleDefinition{}, repo.ErrRoleNotFound
+	}
+	return role, nil
+}
+
+func (mockRepo *mockPermissionRepo) SaveRole(role repo.RoleDefinition) error {
+	mockRepo.Roles[role.Name] = role
+	return nil
+}
+
+func (mockRepo *mockPermissionRepo) RemoveRole(name repo.Role) error {
+	delete(mockRepo.Roles, name)
+	return nil
+}
+
+func (mockRepo *mockPermissionRepo) UserRoles(username string) ([]repo.Role, error) {
+	return mockRepo.Assigned[username], nil
+}
+
+func (mockRepo *mockPermissionRepo) SetUserRoles(username string, roles []repo.Role) error {
+	mockRepo.Assigned[username] = roles
+	return nil
+}
+
+func TestBasicJwtAuthService_Authorize_DefaultRoles(t *testing.T) {
+	service := &BasicJwtAuthService{Repo: &MockUserRepo{}}
+	_ = service.RegisterUser("hugo", "test")
+	tokenString, _ := service.GenerateToken(Credentials{Username: "hugo", Password: "test"})
+	token, err := service.GetTokenFromString(tokenString)
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if !service.Authorize(token, PermissionProductsWrite) {
+		t.Errorf("expected %v to be granted", PermissionProductsWrite)
+	}
+	if service.Authorize(token, PermissionProductsDelete) {
+		t.Errorf("expected %v to be denied", PermissionProductsDelete)
+	}
+}
+
+func TestBasicJwtAuthService_SetUserRoles(t *testing.T) {
+	permissions := newMockPermissionRepo()
+	service := &BasicJwtAuthService{Repo: &MockUserRepo{}, Permissions: permissions}
+	_ = service.RegisterUser("hugo", "test")
+	if err := service.SaveRole(repo.RoleDefinition{Name: "PRICING", Permissions: []string{"prices:fly"}}); err != ErrUnknownPermission {
+		t.Errorf("expected %v, received %v", ErrUnknownPermission, err)
+	}
+	if err := service.SetUserRoles("hugo", []repo.Role{"PRICING"}); err != ErrUnknownRole {
+		t.Errorf("expected %v, received %v", ErrUnknownRole, err)
+	}
+	_ = service.SaveRole(repo.RoleDefinition{Name: "PRICING", Permissions: []string{PermissionProductsWrite}})
+	if err := service.SetUserRoles("hugo", []repo.Role{"PRICING"}); err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	granted, _ := service.UserPermissions("hugo")
+	if !contains(granted, PermissionProductsRead) || !contains(granted, PermissionProductsWrite) || contains(granted, PermissionProductsDelete) {
+		t.Errorf("unexpected permissions %v", granted)
+	}
+	tokenString, _ := service.GenerateToken(Credentials{Username: "hugo", Password: "test"})
+	token, _ := service.GetTokenFromString(tokenString)
+	claims, _ := ClaimsFromToken(token)
+	if !contains(claims.Permissions, PermissionProductsWrite) {
+		t.Errorf("expected token permissions to contain %v, received %v", PermissionProductsWrite, claims.Permissions)
+	}
+	if err := service.DeleteRole(repo.ADMIN); err != ErrProtectedRole {
+		t.Errorf("expected %v, received %v", ErrProtectedRole, err)
+	}
+}
+
+func TestBasicJwtAuthService_RefreshTokenResolvesPermissions(t *testing.T) {
+	permissions := newMockPermissionRepo()
+	service := &BasicJwtAuthService{Repo: &MockUserRepo{}, Permissions: permissions}
+	_ = service.RegisterUser("hugo", "test")
+	tokenString, _ := service.GenerateToken(Credentials{Username: "hugo", Password: "test"})
+	token, _ := service.GetTokenFromString(tokenString)
+	if !service.Authorize(token, PermissionProductsRead) {
+		t.Fatalf("expected %v to be granted", PermissionProductsRead)
+	}
+	_ = service.SaveRole(repo.RoleDefinition{Name: repo.USER, Permissions: []string{}})
+	refreshed, err := service.RefreshToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ = service.GetTokenFromString(refreshed)
+	if service.Authorize(token, PermissionProductsRead) {
+		t.Errorf("expected %v to be denied after the role was edited", PermissionProductsRead)
+	}
+}
+
+func TestBasicJwtAuthService_Authorize_OAuthTokenUsesUserRoles(t *testing.T) {
+	permissions := newMockPermissionRepo()
+	service := &BasicJwtAuthService{Repo: &MockUserRepo{}, Permissions: permissions}
+	_ = service.RegisterUser("hugo", "test")
+	_ = service.SaveRole(repo.RoleDefinition{Name: "PRICING", Permissions: []string{PermissionProductsDelete}})
+	_ = service.SetUserRoles("hugo", []repo.Role{"PRICING"})
+	delegated := &jwt.Token{Claims: &Claims{Role: repo.USER, ClientId: "shop", StandardClaims: jwt.StandardClaims{Subject: "hugo"}}}
+	if !service.Authorize(delegated, PermissionProductsDelete) {
+		t.Errorf("expected %v to be granted", PermissionProductsDelete)
+	}
+	client := &jwt.Token{Claims: &Claims{Role: repo.USER, ClientId: "hugo", StandardClaims: jwt.StandardClaims{Subject: "hugo"}}}
+	if service.Authorize(client, PermissionProductsDelete) {
+		t.Errorf("expected %v to be denied", PermissionProductsDelete)
+	}
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"errors"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"golang.org/x/crypto/bcrypt"
+	netmail "net/mail"
+	"time"
+)
+
+var (
+	ErrWrongPassword         = errors.New("current password is incorrect")
+	ErrSessionsNotConfigured = errors.New("sessions not configured")
+)
+
+type ProfileUpdate struct {
+	Email           *string `json:"email,omitempty"`
+	CurrentPassword string  `json:"currentPassword,omitempty"`
+	NewPassword     string  `json:"newPassword,omitempty"`
+	// CurrentSession stays signed in when the password changes.
+	CurrentSession string `json:"-"`
+}
+
+func (authService *BasicJwtAuthService) GetProfile(username string) (repo.User, error) {
+	return authService.GetUser(username)
+}
+
+func (authService *BasicJwtAuthService) UpdateProfile(username string, update ProfileUpdate) (repo.User, error) {
+	usr, err := authService.Repo.GetByUsername(username)
+	if err != nil {
+		return repo.User{}, err
+	}
+	emailChanged := false
+	if update.Email != nil && *update.Email != usr.Email {
+		if *update.Email == "" && authService.RequireVerifiedEmail {
+			return repo.User{}, ErrEmailRequired
+		}
+		if *update.Email != "" {
+			if _, err = netmail.ParseAddress(*update.Email); err != nil {
+				return repo.User{}, ErrInvalidEmail
+			}
+		}
+		usr.Email = *update.Email
+		usr.Verified = false
+		emailChanged = true
+	}
+	if update.NewPassword != "" {
+		if checkPassword(usr, Credentials{Password: update.CurrentPassword}) != nil {
+			return repo.User{}, ErrWrongPassword
+		}
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(update.NewPassword), bcrypt.DefaultCost)
+		if err != nil {
+			return repo.User{}, err
+		}
+		usr.Password = string(hashedPassword)
+	}
+	err = authService.Repo.UpdateUser(usr)
+	if err != nil {
+		return repo.User{}, err
+	}
+	if update.NewPassword != "" {
+		if err = authService.revokeOtherSessions(username, update.CurrentSession); err != nil {
+			return repo.User{}, err
+		}
+	}
+	if emailChanged && usr.Email != "" {
+		err = authService.sendVerificationMail(usr)
+	}
+	return usr, err
+}
+
+// revokeOtherSessions signs username out everywhere except in session keep.
+func (authService *BasicJwtAuthService) revokeOtherSessions(username, keep string) error {
+	if authService.Sessions == nil {
+		return nil
+	}
+	sessions, err := authService.Sessions.SessionsByUsername(username, time.Time{})
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.Id == keep {
+			continue
+		}
+		if err = authService.Sessions.RevokeSession(username, session.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (authService *BasicJwtAuthService) DeleteAccount(username string) error {
+	if err := authService.revokeAllSessions(username); err != nil {
+		return err
+	}
+	return authService.Repo.RemoveUser(username)
+}
+
+func (authService *BasicJwtAuthService) ListSessions(username, currentSessionId string) ([]repo.Session, error) {
+	if authService.Sessions == nil {
+		return nil, ErrSessionsNotConfigured
+	}
+	sessions, err := authService.Sessions.SessionsByUsername(username, time.Now().Add(-tokenLifetime))
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].Id == currentSessionId
+	}
+	return sessions, nil
+}
+
+func (authService *BasicJwtAuthService) RevokeSession(username, sessionId string) error {
+	if authService.Sessions == nil {
+		return ErrSessionsNotConfigured
+	}
+	return authService.Sessions.RevokeSession(username, sessionId)
+}
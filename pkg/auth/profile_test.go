@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockSessionRepo struct {
+	Sessions map[string]repo.Session
+}
+
+func (mockRepo *mockSessionRepo) AddSession(session repo.Session) error {
+	mockRepo.Sessions[session.Id] = session
+	return nil
+}
+
+func (mockRepo *mockSessionRepo) GetSession(id string) (repo.Session, error) {
+	session, ok := mockRepo.Sessions[id]
+	if !ok {
+		return repo.Session{}, errors.New("session not found")
+	}
+	return session, nil
+}
+
+func (mockRepo *mockSessionRepo) SessionsByUsername(username string, activeSince time.Time) ([]repo.Session, error) {
+	sessions := make([]repo.Session, 0)
+	for _, session := range mockRepo.Sessions {
+		if session.Username == username && !session.Revoked && !session.LastSeen.Before(activeSince) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (mockRepo *mockSessionRepo) TouchSession(id string, lastSeen time.Time) error {
+	session := mockRepo.Sessions[id]
+	session.LastSeen = lastSeen
+	mockRepo.Sessions[id] = session
+	return nil
+}
+
+func (mockRepo *mockSessionRepo) RevokeSession(username, id string) error {
+	session, ok := mockRepo.Sessions[id]
+	if !ok || session.Username != username {
+		return errors.New("session not found")
+	}
+	session.Revoked = true
+	mockRepo.Sessions[id] = session
+	return nil
+}
+
+func (mockRepo *mockSessionRepo) RevokeAllSessions(username string) error {
+	for id, session := range mockRepo.Sessions {
+		if session.Username == username {
+			session.Revoked = true
+			mockRepo.Sessions[id] = session
+		}
+	}
+	return nil
+}
+
+func TestBasicJwtAuthService_RevokeSession(t *testing.T) {
+	service := &BasicJwtAuthService{Repo: &MockUserRepo{}, Sessions: &mockSessionRepo{Sessions: map[string]repo.Session{}}}
+	_ = service.RegisterUser("hugo", "test")
+	tokenString, err := service.GenerateToken(Credentials{Username: "hugo", Password: "test"})
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	token, err := service.GetTokenFromString(tokenString)
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	claims, _ := ClaimsFromToken(token)
+	sessions, err := service.ListSessions("hugo", claims.SessionId)
+	if err != nil || len(sessions) != 1 || !sessions[0].Current {
+		t.Errorf("unexpected sessions %v, %v", sessions, err)
+		t.FailNow()
+	}
+	err = service.RevokeSession("hugo", claims.SessionId)
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if _, err = service.GetTokenFromString(tokenString); err != ErrInvalidToken {
+		t.Errorf("expected %v, received %v", ErrInvalidToken, err)
+	}
+}
+
+func TestBasicJwtAuthService_UpdateProfile_Password(t *testing.T) {
+	service := prepareAuthService()
+	_ = service.RegisterUser("hugo", "test")
+	_, err := service.UpdateProfile("hugo", ProfileUpdate{CurrentPassword: "wrong", NewPassword: "secret"})
+	if err != ErrWrongPassword {
+		t.Errorf("expected %v, received %v", ErrWrongPassword, err)
+		t.FailNow()
+	}
+	usr, err := service.UpdateProfile("hugo", ProfileUpdate{CurrentPassword: "test", NewPassword: "secret"})
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if _, err = service.GenerateToken(Credentials{Username: "hugo", Password: "secret"}); err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+	}
+	profile, _ := json.Marshal(usr)
+	if strings.Contains(string(profile), "password") || strings.Contains(string(profile), usr.Password) {
+		t.Errorf("profile must not contain the password hash: %s", profile)
+	}
+}
+
+func TestBasicJwtAuthService_UpdateProfile_Password_Revokes_Other_Sessions(t *testing.T) {
+	sessions := &mockSessionRepo{Sessions: map[string]repo.Session{}}
+	service := &BasicJwtAuthService{Repo: &MockUserRepo{}, Sessions: sessions}
+	_ = service.RegisterUser("hugo", "test")
+	sessions.Sessions["current"] = repo.Session{Id: "current", Username: "hugo", LastSeen: time.Now()}
+	sessions.Sessions["stolen"] = repo.Session{Id: "stolen", Username: "hugo", LastSeen: time.Now()}
+	_, err := service.UpdateProfile("hugo", ProfileUpdate{CurrentPassword: "test", NewPassword: "secret", CurrentSession: "current"})
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if sessions.Sessions["current"].Revoked || !sessions.Sessions["stolen"].Revoked {
+		t.Errorf("expected only the other session to be revoked, got %v", sessions.Sessions)
+	}
+}
+
+func TestBasicJwtAuthService_UpdateProfile_Invalid_Email(t *testing.T) {
+	service := prepareAuthService()
+	_ = service.RegisterUser("hugo", "test")
+	email := "not an address"
+	if _, err := service.UpdateProfile("hugo", ProfileUpdate{Email: &email}); err != ErrInvalidEmail {
+		t.Errorf("expected %v, received %v", ErrInvalidEmail, err)
+	}
+}
+
+func TestBasicJwtAuthService_DeleteAccount(t *testing.T) {
+	service := prepareAuthService()
+	_ = service.RegisterUser("hugo", "test")
+	err := service.DeleteAccount("hugo")
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if _, err = service.GetProfile("hugo"); err == nil {
+		t.Error("expected deleted user to be gone")
+	}
+}
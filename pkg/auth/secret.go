@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const MinSecretLength = 32
+
+var (
+	jwtKey         []byte
+	previousJwtKey []byte
+)
+
+var ErrSecretNotConfigured = errors.New("API_SECRET not configured")
+
+func LoadSecrets() error {
+	secret, err := readSecret("API_SECRET")
+	if err != nil {
+		return err
+	}
+	if secret == "" {
+		return ErrSecretNotConfigured
+	}
+	if len(secret) < MinSecretLength {
+		return fmt.Errorf("API_SECRET must be at least %d characters long", MinSecretLength)
+	}
+	previous, err := readSecret("API_SECRET_PREVIOUS")
+	if err != nil {
+		return err
+	}
+	if previous != "" && len(previous) < MinSecretLength {
+		return fmt.Errorf("API_SECRET_PREVIOUS must be at least %d characters long", MinSecretLength)
+	}
+	jwtKey = []byte(secret)
+	previousJwtKey = []byte(previous)
+	return nil
+}
+
+func readSecret(name string) (string, error) {
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading %s_FILE: %v", name, err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+	return os.Getenv(name), nil
+}
+
+func (authService *BasicJwtAuthService) parseToken(tokenString string, claims *Claims) (*jwt.Token, error) {
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.ParseWithClaims(tokenString, claims, authService.keyFunc)
+	if err != nil && authService.Keys == nil && len(previousJwtKey) != 0 {
+		if validationErr, ok := err.(*jwt.ValidationError); ok && validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
+			token, err = parser.ParseWithClaims(tokenString, claims, func(tok *jwt.Token) (interface{}, error) {
+				if _, ok := tok.Method.(*jwt.SigningMethodHMAC); !ok {
+					return nil, fmt.Errorf("unexpected signing method: %v", tok.Header["alg"])
+				}
+				return previousJwtKey, nil
+			})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = authService.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func TestMain(m *testing.M) {
+	jwtKey = []byte(testSecret)
+	os.Exit(m.Run())
+}
+
+func restoreSecrets() {
+	jwtKey = []byte(testSecret)
+	previousJwtKey = nil
+	_ = os.Unsetenv("API_SECRET")
+	_ = os.Unsetenv("API_SECRET_FILE")
+	_ = os.Unsetenv("API_SECRET_PREVIOUS")
+}
+
+func TestLoadSecrets_Missing(t *testing.T) {
+	defer restoreSecrets()
+	_ = os.Unsetenv("API_SECRET")
+	if err := LoadSecrets(); err != ErrSecretNotConfigured {
+		t.Errorf("expected %v, received %v", ErrSecretNotConfigured, err)
+	}
+}
+
+func TestLoadSecrets_Too_Short(t *testing.T) {
+	defer restoreSecrets()
+	_ = os.Setenv("API_SECRET", "short")
+	if err := LoadSecrets(); err == nil {
+		t.Error("expected short secret to be rejected")
+	}
+}
+
+func TestLoadSecrets_From_File(t *testing.T) {
+	defer restoreSecrets()
+	file, err := ioutil.TempFile("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	secret := strings.Repeat("s", MinSecretLength)
+	_, _ = file.WriteString(secret + "\n")
+	_ = file.Close()
+	_ = os.Setenv("API_SECRET_FILE", file.Name())
+	if err = LoadSecrets(); err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if string(jwtKey) != secret {
+		t.Errorf("expected %s, received %s", secret, jwtKey)
+	}
+}
+
+func TestBasicJwtAuthService_GetTokenFromString_Previous_Secret(t *testing.T) {
+	defer restoreSecrets()
+	service := prepareAuthService()
+	_ = service.RegisterUser("hugo", "test")
+	tokenString, err := service.GenerateToken(Credentials{Username: "hugo", Password: "test"})
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	_ = os.Setenv("API_SECRET", strings.Repeat("n", MinSecretLength))
+	_ = os.Setenv("API_SECRET_PREVIOUS", testSecret)
+	if err = LoadSecrets(); err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if _, err = service.GetTokenFromString(tokenString); err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+	}
+}
@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"golang.org/x/crypto/bcrypt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod             = 30
+	totpDigits             = 6
+	totpSkewSteps          = 1
+	totpSecretSize         = 20
+	recoveryCodeCount      = 10
+	challengeTokenLifetime = 5 * time.Minute
+	maxChallengeAttempts   = 5
+	defaultTOTPIssuer      = "simple_rest"
+)
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+var (
+	ErrTwoFactorRequired      = errors.New("two-factor authentication required")
+	ErrTwoFactorNotConfigured = errors.New("two-factor authentication not configured")
+	ErrTwoFactorEnabled       = errors.New("two-factor authentication already enabled")
+	ErrInvalidTwoFactorCode   = errors.New("invalid two-factor code")
+	ErrInvalidChallenge       = errors.New("invalid or expired challenge token")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func (authService *BasicJwtAuthService) EnrollTOTP(username string) (TOTPEnrollment, error) {
+	if authService.TwoFactors == nil {
+		return TOTPEnrollment{}, ErrTwoFactorNotConfigured
+	}
+	usr, err := authService.Repo.GetByUsername(username)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	if usr.TOTPEnabled {
+		return TOTPEnrollment{}, ErrTwoFactorEnabled
+	}
+	buf := make([]byte, totpSecretSize)
+	if _, err = rand.Read(buf); err != nil {
+		return TOTPEnrollment{}, err
+	}
+	secret := totpEncoding.EncodeToString(buf)
+	err = authService.TwoFactors.SetTOTPSecret(username, secret, false)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	return TOTPEnrollment{Secret: secret, URI: authService.totpURI(username, secret)}, nil
+}
+
+func (authService *BasicJwtAuthService) ConfirmTOTP(username, code string) ([]string, error) {
+	if authService.TwoFactors == nil {
+		return nil, ErrTwoFactorNotConfigured
+	}
+	usr, err := authService.Repo.GetByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	if usr.TOTPEnabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	if usr.TOTPSecret == "" {
+		return nil, errors.New("two-factor enrollment not started")
+	}
+	if !authService.useTOTP(usr, code) {
+		return nil, ErrInvalidTwoFactorCode
+	}
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i], err = generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(codes[i]), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = string(hash)
+	}
+	err = authService.TwoFactors.SetRecoveryCodes(username, hashes)
+	if err != nil {
+		return nil, err
+	}
+	err = authService.TwoFactors.SetTOTPSecret(username, usr.TOTPSecret, true)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (authService *BasicJwtAuthService) VerifyTwoFactor(challengeToken, code string) (string, error) {
+	if authService.TwoFactors == nil {
+		return "", ErrTwoFactorNotConfigured
+	}
+	claims, err := authService.parseChallengeToken(challengeToken)
+	if err != nil {
+		return "", err
+	}
+	attempts, err := authService.TwoFactors.CountTwoFactorAttempt(claims.Id, time.Now().Add(-challengeTokenLifetime))
+	if err != nil {
+		return "", err
+	}
+	if attempts > maxChallengeAttempts {
+		return "", ErrInvalidChallenge
+	}
+	usr, err := authService.Repo.GetByUsername(claims.Subject)
+	if err != nil {
+		return "", err
+	}
+	if !usr.TOTPEnabled {
+		return "", ErrInvalidChallenge
+	}
+	if !authService.useTOTP(usr, code) {
+		err = authService.useRecoveryCode(usr.Username, code)
+		if err != nil {
+			return "", err
+		}
+	}
+	return authService.issueToken(usr)
+}
+
+// useTOTP checks code against the secret of usr and consumes its time step,
+// so that a code cannot be replayed within its validity window.
+func (authService *BasicJwtAuthService) useTOTP(usr repo.User, code string) bool {
+	step, ok := validateTOTP(usr.TOTPSecret, code, time.Now())
+	if !ok {
+		return false
+	}
+	unused, err := authService.TwoFactors.UseTOTPStep(usr.Username, step)
+	return err == nil && unused
+}
+
+func (authService *BasicJwtAuthService) useRecoveryCode(username, code string) error {
+	codes, err := authService.TwoFactors.RecoveryCodes(username)
+	if err != nil {
+		return err
+	}
+	normalized := strings.ToUpper(strings.TrimSpace(code))
+	for _, stored := range codes {
+		if bcrypt.CompareHashAndPassword([]byte(stored.CodeHash), []byte(normalized)) != nil {
+			continue
+		}
+		unused, err := authService.TwoFactors.UseRecoveryCode(stored.Id)
+		if err != nil {
+			return err
+		}
+		if !unused {
+			break
+		}
+		return nil
+	}
+	return ErrInvalidTwoFactorCode
+}
+
+func (authService *BasicJwtAuthService) totpURI(username, secret string) string {
+	issuer := authService.TOTPIssuer
+	if issuer == "" {
+		issuer = defaultTOTPIssuer
+	}
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(issuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func (authService *BasicJwtAuthService) generateChallengeToken(usr repo.User) (string, error) {
+	claims, err := authService.newClaims(usr.Username, challengeTokenLifetime)
+	if err != nil {
+		return "", err
+	}
+	claims.Challenge = true
+	return authService.signToken(claims)
+}
+
+func (authService *BasicJwtAuthService) parseChallengeToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := authService.parseToken(tokenString, claims)
+	if err != nil || !claims.Challenge || claims.Id == "" {
+		return nil, ErrInvalidChallenge
+	}
+	return claims, nil
+}
+
+func totpCode(secret string, counter uint64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000), nil
+}
+
+// validateTOTP returns the time step code belongs to, if it is valid
+// within the allowed clock skew.
+func validateTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	counter := now.Unix() / totpPeriod
+	for step := counter - totpSkewSteps; step <= counter+totpSkewSteps; step++ {
+		expected, err := totpCode(secret, uint64(step))
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func generateRecoveryCode() (string, error) {
+	buf := make([]byte, 5)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"errors"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"testing"
+	"time"
+)
+
+type mockTwoFactorRepo struct {
+	UserRepo  *MockUserRepo
+	Codes     []repo.RecoveryCode
+	LastSteps map[string]int64
+	Attempts  map[string]int
+	// StaleCodes stands in for a read that raced with another login.
+	StaleCodes []repo.RecoveryCode
+}
+
+func (mockRepo *mockTwoFactorRepo) SetTOTPSecret(username, secret string, enabled bool) error {
+	for index, user := range mockRepo.UserRepo.Users {
+		if user.Username == username {
+			mockRepo.UserRepo.Users[index].TOTPSecret = secret
+			mockRepo.UserRepo.Users[index].TOTPEnabled = enabled
+			return nil
+		}
+	}
+	return errors.New("user not found")
+}
+
+func (mockRepo *mockTwoFactorRepo) UseTOTPStep(username string, step int64) (bool, error) {
+	if step <= mockRepo.LastSteps[username] {
+		return false, nil
+	}
+	mockRepo.LastSteps[username] = step
+	return true, nil
+}
+
+func (mockRepo *mockTwoFactorRepo) CountTwoFactorAttempt(challengeId string, expiredBefore time.Time) (int, error) {
+	mockRepo.Attempts[challengeId]++
+	return mockRepo.Attempts[challengeId], nil
+}
+
+func (mockRepo *mockTwoFactorRepo) SetRecoveryCodes(username string, codeHashes []string) error {
+	mockRepo.Codes = make([]repo.RecoveryCode, 0)
+	for index, codeHash := range codeHashes {
+		mockRepo.Codes = append(mockRepo.Codes, repo.RecoveryCode{Id: index, Username: username, CodeHash: codeHash})
+	}
+	return nil
+}
+
+func (mockRepo *mockTwoFactorRepo) RecoveryCodes(username string) ([]repo.RecoveryCode, error) {
+	if mockRepo.StaleCodes != nil {
+		return mockRepo.StaleCodes, nil
+	}
+	return mockRepo.Codes, nil
+}
+
+func (mockRepo *mockTwoFactorRepo) UseRecoveryCode(id int) (bool, error) {
+	for index, code := range mockRepo.Codes {
+		if code.Id == id {
+			mockRepo.Codes = append(mockRepo.Codes[:index], mockRepo.Codes[index+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func prepareTwoFactorAuthService() *BasicJwtAuthService {
+	userRepo := &MockUserRepo{}
+	twoFactors := &mockTwoFactorRepo{UserRepo: userRepo, LastSteps: make(map[string]int64), Attempts: make(map[string]int)}
+	return &BasicJwtAuthService{Repo: userRepo, TwoFactors: twoFactors}
+}
+
+func TestTotpCode_RFC6238(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	code, err := totpCode(secret, uint64(59/totpPeriod))
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if code != "287082" {
+		t.Errorf("expected %s, received %s", "287082", code)
+	}
+}
+
+func TestBasicJwtAuthService_TwoFactorLogin(t *testing.T) {
+	service := prepareTwoFactorAuthService()
+	err := service.RegisterUser("hugo", "test")
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	enrollment, err := service.EnrollTOTP("hugo")
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	code, _ := totpCode(enrollment.Secret, uint64(time.Now().Unix()/totpPeriod))
+	recoveryCodes, err := service.ConfirmTOTP("hugo", code)
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Errorf("expected %d, received %d", recoveryCodeCount, len(recoveryCodes))
+		t.FailNow()
+	}
+	challenge, err := service.GenerateToken(Credentials{Username: "hugo", Password: "test"})
+	if err != ErrTwoFactorRequired {
+		t.Errorf("expected %v, received %v", ErrTwoFactorRequired, err)
+		t.FailNow()
+	}
+	if _, err = service.GetTokenFromString(challenge); err == nil {
+		t.Error("challenge token must not be accepted as access token")
+		t.FailNow()
+	}
+	if _, err = service.VerifyTwoFactor(challenge, "abcdef"); err != ErrInvalidTwoFactorCode {
+		t.Errorf("expected %v, received %v", ErrInvalidTwoFactorCode, err)
+		t.FailNow()
+	}
+	tokenString, err := service.VerifyTwoFactor(challenge, recoveryCodes[0])
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if _, err = service.GetTokenFromString(tokenString); err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if _, err = service.VerifyTwoFactor(challenge, recoveryCodes[0]); err != ErrInvalidTwoFactorCode {
+		t.Errorf("expected %v, received %v", ErrInvalidTwoFactorCode, err)
+	}
+	twoFactors := service.TwoFactors.(*mockTwoFactorRepo)
+	twoFactors.StaleCodes = append([]repo.RecoveryCode{}, twoFactors.Codes...)
+	if _, err = service.VerifyTwoFactor(challenge, recoveryCodes[1]); err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+	}
+	if _, err = service.VerifyTwoFactor(challenge, recoveryCodes[1]); err != ErrInvalidTwoFactorCode {
+		t.Errorf("expected %v, received %v", ErrInvalidTwoFactorCode, err)
+	}
+}
+
+func TestBasicJwtAuthService_TwoFactorRejectsReplayAndGuessing(t *testing.T) {
+	service := prepareTwoFactorAuthService()
+	_ = service.RegisterUser("hugo", "test")
+	enrollment, _ := service.EnrollTOTP("hugo")
+	step := time.Now().Unix() / totpPeriod
+	code, _ := totpCode(enrollment.Secret, uint64(step))
+	if _, err := service.ConfirmTOTP("hugo", code); err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	challenge, _ := service.GenerateToken(Credentials{Username: "hugo", Password: "test"})
+	if _, err := service.VerifyTwoFactor(challenge, code); err != ErrInvalidTwoFactorCode {
+		t.Errorf("expected %v, received %v", ErrInvalidTwoFactorCode, err)
+	}
+	next, _ := totpCode(enrollment.Secret, uint64(step+1))
+	if _, err := service.VerifyTwoFactor(challenge, next); err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+	}
+
+	challenge, _ = service.GenerateToken(Credentials{Username: "hugo", Password: "test"})
+	for attempt := 0; attempt < maxChallengeAttempts; attempt++ {
+		if _, err := service.VerifyTwoFactor(challenge, "000000"); err != ErrInvalidTwoFactorCode {
+			t.Errorf("expected %v, received %v", ErrInvalidTwoFactorCode, err)
+		}
+	}
+	delete(service.TwoFactors.(*mockTwoFactorRepo).LastSteps, "hugo")
+	if _, err := service.VerifyTwoFactor(challenge, next); err != ErrInvalidChallenge {
+		t.Errorf("expected %v, received %v", ErrInvalidChallenge, err)
+	}
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"net/url"
+	"time"
+)
+
+const (
+	verificationTokenLifetime = 24 * time.Hour
+	defaultVerificationURL    = "https://localhost:8080/verify"
+
+	purposeVerifyEmail   = "verify"
+	purposePasswordReset = "reset"
+)
+
+var (
+	ErrEmailRequired      = errors.New("email address required")
+	ErrInvalidEmail       = errors.New("invalid email address")
+	ErrEmailNotVerified   = errors.New("email address not verified")
+	ErrInvalidVerifyToken = errors.New("invalid or expired verification token")
+)
+
+func (authService *BasicJwtAuthService) sendVerificationMail(usr repo.User) error {
+	if authService.Verifications == nil || authService.Mailer == nil {
+		return nil
+	}
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	err = authService.Verifications.AddVerificationToken(repo.VerificationToken{
+		TokenHash: hashToken(token),
+		Username:  usr.Username,
+		Purpose:   purposeVerifyEmail,
+		Expires:   time.Now().Add(verificationTokenLifetime),
+	})
+	if err != nil {
+		return err
+	}
+	baseURL := authService.VerificationURL
+	if baseURL == "" {
+		baseURL = defaultVerificationURL
+	}
+	link := baseURL + "?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("Hello %s,\n\nplease confirm your email address by opening the following link:\n\n%s\n\nThe link expires in 24 hours.", usr.Username, link)
+	return authService.Mailer.Send(usr.Email, "Please verify your email address", body)
+}
+
+func (authService *BasicJwtAuthService) VerifyEmail(token string) error {
+	if authService.Verifications == nil {
+		return errors.New("email verification not configured")
+	}
+	tokenHash := hashToken(token)
+	stored, err := authService.Verifications.GetVerificationToken(tokenHash)
+	if err != nil || stored.Purpose != purposeVerifyEmail {
+		return ErrInvalidVerifyToken
+	}
+	err = authService.Verifications.RemoveVerificationToken(tokenHash)
+	if err != nil {
+		return err
+	}
+	if time.Now().After(stored.Expires) {
+		return ErrInvalidVerifyToken
+	}
+	return authService.Verifications.SetUserVerified(stored.Username)
+}
+
+func randomToken(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"errors"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type mockVerificationRepo struct {
+	Tokens   map[string]repo.VerificationToken
+	UserRepo *MockUserRepo
+}
+
+func (mockRepo *mockVerificationRepo) AddVerificationToken(token repo.VerificationToken) error {
+	mockRepo.Tokens[token.TokenHash] = token
+	return nil
+}
+
+func (mockRepo *mockVerificationRepo) GetVerificationToken(tokenHash string) (repo.VerificationToken, error) {
+	token, ok := mockRepo.Tokens[tokenHash]
+	if !ok {
+		return repo.VerificationToken{}, errors.New("verification token not found")
+	}
+	return token, nil
+}
+
+func (mockRepo *mockVerificationRepo) RemoveVerificationToken(tokenHash string) error {
+	delete(mockRepo.Tokens, tokenHash)
+	return nil
+}
+
+func (mockRepo *mockVerificationRepo) SetUserVerified(username string) error {
+	for index, user := range mockRepo.UserRepo.Users {
+		if user.Username == username {
+			mockRepo.UserRepo.Users[index].Verified = true
+			return nil
+		}
+	}
+	return errors.New("user not found")
+}
+
+type mockMailer struct {
+	To   string
+	Body string
+	Err  error
+}
+
+func (mailer *mockMailer) Send(to, subject, body string) error {
+	if mailer.Err != nil {
+		return mailer.Err
+	}
+	mailer.To = to
+	mailer.Body = body
+	return nil
+}
+
+func prepareVerifyingAuthService() (*BasicJwtAuthService, *mockMailer) {
+	userRepo := &MockUserRepo{}
+	mailer := &mockMailer{}
+	service := &BasicJwtAuthService{
+		Repo:                 userRepo,
+		Verifications:        &mockVerificationRepo{Tokens: map[string]repo.VerificationToken{}, UserRepo: userRepo},
+		Mailer:               mailer,
+		RequireVerifiedEmail: true,
+	}
+	return service, mailer
+}
+
+func tokenFromMail(body string) string {
+	link := body[strings.Index(body, "https://"):]
+	link = strings.Fields(link)[0]
+	parsed, _ := url.Parse(link)
+	return parsed.Query().Get("token")
+}
+
+func TestBasicJwtAuthService_RegisterUserWithEmail_Requires_Email(t *testing.T) {
+	service, _ := prepareVerifyingAuthService()
+	err := service.RegisterUserWithEmail("hugo", "test", "")
+	if err != ErrEmailRequired {
+		t.Errorf("expected %v, received %v", ErrEmailRequired, err)
+	}
+}
+
+func TestBasicJwtAuthService_RegisterUserWithEmail_Invalid_Email(t *testing.T) {
+	service, _ := prepareVerifyingAuthService()
+	err := service.RegisterUserWithEmail("hugo", "test", "not an address")
+	if err != ErrInvalidEmail {
+		t.Errorf("expected %v, received %v", ErrInvalidEmail, err)
+	}
+}
+
+func TestBasicJwtAuthService_RegisterUserWithEmail_Mail_Failure(t *testing.T) {
+	service, mailer := prepareVerifyingAuthService()
+	mailer.Err = errors.New("smtp unavailable")
+	err := service.RegisterUserWithEmail("hugo", "test", "hugo@example.com")
+	if err != mailer.Err {
+		t.Errorf("expected %v, received %v", mailer.Err, err)
+	}
+	if _, err = service.Repo.GetByUsername("hugo"); err == nil {
+		t.Error("expected the user to be removed after the mail failed")
+	}
+}
+
+func TestBasicJwtAuthService_VerifyEmail(t *testing.T) {
+	service, mailer := prepareVerifyingAuthService()
+	err := service.RegisterUserWithEmail("hugo", "test", "hugo@example.com")
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	if mailer.To != "hugo@example.com" {
+		t.Errorf("expected %s, received %s", "hugo@example.com", mailer.To)
+		t.FailNow()
+	}
+	creds := Credentials{Username: "hugo", Password: "test"}
+	_, err = service.GenerateToken(creds)
+	if err != ErrEmailNotVerified {
+		t.Errorf("expected %v, received %v", ErrEmailNotVerified, err)
+		t.FailNow()
+	}
+	err = service.VerifyEmail(tokenFromMail(mailer.Body))
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+		t.FailNow()
+	}
+	_, err = service.GenerateToken(creds)
+	if err != nil {
+		t.Errorf("expected %v, received %v", nil, err)
+	}
+}
+
+func TestBasicJwtAuthService_VerifyEmail_Invalid_Token(t *testing.T) {
+	service, _ := prepareVerifyingAuthService()
+	err := service.VerifyEmail("unknown")
+	if err != ErrInvalidVerifyToken {
+		t.Errorf("expected %v, received %v", ErrInvalidVerifyToken, err)
+	}
+}
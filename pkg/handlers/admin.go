@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/segfaultx/simple_rest/pkg/auth"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type (
+	roleChange struct {
+		Role repo.Role `json:"role"`
+	}
+
+	roleAssignment struct {
+		Roles []repo.Role `json:"roles"`
+	}
+
+	permissionSet struct {
+		Permissions []string `json:"permissions"`
+	}
+
+	passwordReset struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+)
+
+func MakeAdminUsersHandler(service auth.UserAdminService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		params := request.URL.Query()
+		query := repo.UserQuery{Search: params.Get("q"), Role: repo.Role(params.Get("role"))}
+		query.Page, _ = strconv.Atoi(params.Get("page"))
+		query.PageSize, _ = strconv.Atoi(params.Get("pageSize"))
+		page, err := service.ListUsers(query)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			log.Print(err)
+			return
+		}
+		resp, _ := json.Marshal(page)
+		setDefaultHeader(writer)
+		_, _ = writer.Write(resp)
+	}
+}
+
+func MakeAdminUserHandler(service auth.UserAdminService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		username := mux.Vars(request)["username"]
+		switch request.Method {
+		case "GET":
+			usr, err := service.GetUser(username)
+			if err != nil {
+				writer.WriteHeader(http.StatusNotFound)
+				return
+			}
+			resp, _ := json.Marshal(usr)
+			setDefaultHeader(writer)
+			_, _ = writer.Write(resp)
+		case "DELETE":
+			if username == usernameFromRequest(request) {
+				writer.WriteHeader(http.StatusConflict)
+				return
+			}
+			err := service.DeleteUser(username)
+			if err != nil {
+				writer.WriteHeader(http.StatusNotFound)
+				return
+			}
+			recordAuditAfter(request, nil)
+			writer.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+func MakeAdminRoleHandler(service auth.UserAdminService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		username := mux.Vars(request)["username"]
+		change := roleChange{}
+		err := decodeRequestBody(&change, request)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if username == usernameFromRequest(request) && change.Role != repo.ADMIN {
+			writer.WriteHeader(http.StatusConflict)
+			return
+		}
+		err = service.ChangeRole(username, change.Role)
+		writeAdminResult(writer, err)
+	}
+}
+
+func MakeAdminDisableHandler(service auth.UserAdminService, disabled bool) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		username := mux.Vars(request)["username"]
+		if disabled && username == usernameFromRequest(request) {
+			writer.WriteHeader(http.StatusConflict)
+			return
+		}
+		writeAdminResult(writer, service.SetDisabled(username, disabled))
+	}
+}
+
+func MakeAdminPasswordResetHandler(service auth.UserAdminService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		link, err := service.ForcePasswordReset(mux.Vars(request)["username"])
+		if err != nil {
+			writeAdminResult(writer, err)
+			return
+		}
+		if link == "" {
+			writer.WriteHeader(http.StatusAccepted)
+			return
+		}
+		resp, _ := json.Marshal(map[string]string{"resetUrl": link})
+		setDefaultHeader(writer)
+		writer.WriteHeader(http.StatusCreated)
+		_, _ = writer.Write(resp)
+	}
+}
+
+func MakePasswordResetHandler(service auth.UserAdminService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		reset := passwordReset{}
+		err := decodeRequestBody(&reset, request)
+		if err != nil || reset.Token == "" || reset.Password == "" {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		err = service.ResetPassword(reset.Token, reset.Password)
+		if err == auth.ErrInvalidResetToken {
+			writer.WriteHeader(http.StatusBadRequest)
+			_, _ = writer.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			log.Print(err)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func MakeRolesHandler(service auth.PermissionService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		roles, err := service.ListRoles()
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			log.Print(err)
+			return
+		}
+		resp, _ := json.Marshal(roles)
+		setDefaultHeader(writer)
+		_, _ = writer.Write(resp)
+	}
+}
+
+func MakeRoleHandler(service auth.PermissionService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		name := repo.Role(mux.Vars(request)["name"])
+		switch request.Method {
+		case "PUT":
+			permissions := permissionSet{}
+			err := decodeRequestBody(&permissions, request)
+			if err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			writeAdminResult(writer, service.SaveRole(repo.RoleDefinition{Name: name, Permissions: permissions.Permissions}))
+		case "DELETE":
+			writeAdminResult(writer, service.DeleteRole(name))
+		}
+	}
+}
+
+func MakeUserRolesHandler(service auth.PermissionService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		username := mux.Vars(request)["username"]
+		switch request.Method {
+		case "GET":
+			permissions, err := service.UserPermissions(username)
+			if err != nil {
+				writer.WriteHeader(http.StatusNotFound)
+				return
+			}
+			resp, _ := json.Marshal(permissionSet{Permissions: permissions})
+			setDefaultHeader(writer)
+			_, _ = writer.Write(resp)
+		case "PUT":
+			assignment := roleAssignment{}
+			err := decodeRequestBody(&assignment, request)
+			if err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			writeAdminResult(writer, service.SetUserRoles(username, assignment.Roles))
+		}
+	}
+}
+
+func writeAdminResult(writer http.ResponseWriter, err error) {
+	switch err {
+	case nil:
+		writer.WriteHeader(http.StatusNoContent)
+	case auth.ErrUnknownRole, auth.ErrUnknownPermission:
+		writer.WriteHeader(http.StatusBadRequest)
+		_, _ = writer.Write([]byte(err.Error()))
+	case auth.ErrProtectedRole:
+		writer.WriteHeader(http.StatusConflict)
+		_, _ = writer.Write([]byte(err.Error()))
+	case auth.ErrAdminNotConfigured, auth.ErrPermissionsNotConfigured:
+		writer.WriteHeader(http.StatusNotImplemented)
+	case repo.ErrUserNotFound, repo.ErrRoleNotFound:
+		writer.WriteHeader(http.StatusNotFound)
+		_, _ = writer.Write([]byte(err.Error()))
+	default:
+		writer.WriteHeader(http.StatusInternalServerError)
+		log.Print(err)
+	}
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/segfaultx/simple_rest/pkg/auth"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type createdAPIKeyResponse struct {
+	Key    string      `json:"key"`
+	APIKey repo.APIKey `json:"apiKey"`
+}
+
+func MakeAPIKeysHandler(service auth.AuthenticationService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		token := tokenFromRequest(request)
+		username := usernameFromRequest(request)
+		switch request.Method {
+		case "GET":
+			keys, err := service.ListAPIKeys(username)
+			if err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				log.Print(err)
+				return
+			}
+			resp, _ := json.Marshal(keys)
+			setDefaultHeader(writer)
+			_, _ = writer.Write(resp)
+		case "POST":
+			keyRequest := auth.APIKeyRequest{}
+			err := decodeRequestBody(&keyRequest, request)
+			if err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if keyRequest.Service != "" && !service.Authorize(token, auth.PermissionClientsAdmin) {
+				writer.WriteHeader(http.StatusForbidden)
+				_, _ = writer.Write([]byte("only admins may create service keys"))
+				return
+			}
+			plainKey, key, err := service.CreateAPIKey(username, keyRequest)
+			switch err {
+			case nil:
+			case auth.ErrUnknownScope, auth.ErrMissingScopes, auth.ErrExpiryInPast, auth.ErrUnknownRole:
+				writer.WriteHeader(http.StatusBadRequest)
+				_, _ = writer.Write([]byte(err.Error()))
+				return
+			default:
+				writer.WriteHeader(http.StatusInternalServerError)
+				log.Print(err)
+				return
+			}
+			resp, _ := json.Marshal(createdAPIKeyResponse{Key: plainKey, APIKey: key})
+			setDefaultHeader(writer)
+			writer.WriteHeader(http.StatusCreated)
+			_, _ = writer.Write(resp)
+		}
+	}
+}
+
+func MakeAPIKeyHandler(service auth.AuthenticationService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(request)["id"])
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		err = service.RevokeAPIKey(usernameFromRequest(request), id)
+		if err != nil {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"log"
+	"net/http"
+)
+
+// MakeAttributeDefinitionsHandler lists the attribute definitions of the
+// tenant.
+func MakeAttributeDefinitionsHandler(attributes repo.AttributeRepository) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		definitions, err := attributes.AttributeDefinitions()
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			_, _ = writer.Write([]byte("Error loading attributes"))
+			log.Print(err)
+			return
+		}
+		writeJSON(writer, http.StatusOK, definitions)
+	}
+}
+
+// MakeAttributeDefinitionHandler creates, replaces and removes a single
+// attribute definition.
+func MakeAttributeDefinitionHandler(attributes repo.AttributeRepository) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		name := mux.Vars(request)["name"]
+		if request.Method == "DELETE" {
+			err := attributes.RemoveAttributeDefinition(name)
+			if err == repo.ErrAttributeNotFound {
+				writer.WriteHeader(http.StatusNotFound)
+				_, _ = writer.Write([]byte(err.Error()))
+				return
+			}
+			if err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				_, _ = writer.Write([]byte("Error removing attribute"))
+				log.Print(err)
+				return
+			}
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		definition := repo.AttributeDefinition{}
+		if err := decodeRequestBody(&definition, request); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		definition.Name = name
+		if err := repo.ValidateAttributeDefinition(definition); err != nil {
+			writer.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = writer.Write([]byte(err.Error()))
+			return
+		}
+		saved, err := attributes.SaveAttributeDefinition(definition)
+		if err == repo.ErrAttributeInUse {
+			writer.WriteHeader(http.StatusConflict)
+			_, _ = writer.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			_, _ = writer.Write([]byte("Error saving attribute"))
+			log.Print(err)
+			return
+		}
+		writeJSON(writer, http.StatusOK, saved)
+	}
+}
@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/segfaultx/simple_rest/pkg/auth"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	requestIdHeader                = "X-Request-ID"
+	requestIdContextKey contextKey = "requestId"
+	auditContextKey     contextKey = "audit"
+	auditPageSize                  = 50
+	auditExportBatch               = 500
+	maxAuditBodyPeek               = 1 << 16
+)
+
+type (
+	SnapshotFunc func(request *http.Request) interface{}
+
+	readCloser struct {
+		io.Reader
+		io.Closer
+	}
+
+	statusRecorder struct {
+		http.ResponseWriter
+		status int
+	}
+
+	// auditRecord lets a handler hand the state it persisted back to the
+	// audit middleware.
+	auditRecord struct {
+		after    interface{}
+		recorded bool
+	}
+)
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(body []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return recorder.ResponseWriter.Write(body)
+}
+
+func RequestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requestId := request.Header.Get(requestIdHeader)
+		if requestId == "" || len(requestId) > 128 {
+			id := make([]byte, 12)
+			_, _ = rand.Read(id)
+			requestId = hex.EncodeToString(id)
+		}
+		writer.Header().Set(requestIdHeader, requestId)
+		ctx := context.WithValue(request.Context(), requestIdContextKey, requestId)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+func requestIdFromRequest(request *http.Request) string {
+	requestId, _ := request.Context().Value(requestIdContextKey).(string)
+	return requestId
+}
+
+// MakeAuditMiddleware records every request that is not a read.
+func MakeAuditMiddleware(audit repo.AuditRepository, snapshot SnapshotFunc) mux.MiddlewareFunc {
+	return makeAuditMiddleware(audit, snapshot, false)
+}
+
+// MakeAuthEventAuditMiddleware records every request, including GETs, for
+// routes such as the OIDC callback whose GETs sign users in or change them.
+func MakeAuthEventAuditMiddleware(audit repo.AuditRepository) mux.MiddlewareFunc {
+	return makeAuditMiddleware(audit, nil, true)
+}
+
+func makeAuditMiddleware(audit repo.AuditRepository, snapshot SnapshotFunc, auditReads bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if !auditReads && (request.Method == "GET" || request.Method == "HEAD" || request.Method == "OPTIONS") {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			entry := repo.AuditEntry{
+				Actor:     auditActor(request),
+				Action:    request.Method + " " + routeTemplate(request),
+				Target:    request.URL.Path,
+				RequestId: requestIdFromRequest(request),
+			}
+			if snapshot != nil {
+				entry.Before = marshalSnapshot(snapshot(request))
+			}
+			record := &auditRecord{}
+			recorder := &statusRecorder{ResponseWriter: writer}
+			next.ServeHTTP(recorder, request.WithContext(context.WithValue(request.Context(), auditContextKey, record)))
+			entry.Status = recorder.status
+			if entry.Status == 0 {
+				entry.Status = http.StatusOK
+			}
+			if record.recorded && entry.Status < http.StatusBadRequest {
+				entry.After = marshalSnapshot(record.after)
+			} else if snapshot != nil && entry.Status < http.StatusBadRequest {
+				entry.After = marshalSnapshot(snapshot(request))
+			}
+			if err := audit.AddAuditEntry(entry); err != nil {
+				log.Print(err)
+			}
+		})
+	}
+}
+
+// recordAuditAfter reports the state a handler wrote, so that the after
+// snapshot reflects the stored row rather than a cached read. A nil after
+// records a deletion.
+func recordAuditAfter(request *http.Request, after interface{}) {
+	if record, ok := request.Context().Value(auditContextKey).(*auditRecord); ok {
+		record.after, record.recorded = after, true
+	}
+}
+
+func ProductSnapshot(repository repo.ProductRepository) SnapshotFunc {
+	return func(request *http.Request) interface{} {
+		id, err := strconv.Atoi(mux.Vars(request)["id"])
+		if err != nil {
+			return nil
+		}
+		product, err := repository.GetProductById(id)
+		if err != nil {
+			return nil
+		}
+		return product
+	}
+}
+
+func UserSnapshot(service auth.UserAdminService) SnapshotFunc {
+	return func(request *http.Request) interface{} {
+		username, ok := mux.Vars(request)["username"]
+		if !ok {
+			return nil
+		}
+		usr, err := service.GetUser(username)
+		if err != nil {
+			return nil
+		}
+		return usr
+	}
+}
+
+func ProfileSnapshot(service auth.AuthenticationService) SnapshotFunc {
+	return func(request *http.Request) interface{} {
+		usr, err := service.GetProfile(usernameFromRequest(request))
+		if err != nil {
+			return nil
+		}
+		return usr
+	}
+}
+
+func MakeAuditLogHandler(audit repo.AuditRepository) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		params := request.URL.Query()
+		query := repo.AuditQuery{Actor: params.Get("actor"), Action: params.Get("action"), Target: params.Get("target")}
+		var err error
+		if query.Since, err = parseTimeParam(params.Get("since")); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			_, _ = writer.Write([]byte("invalid since"))
+			return
+		}
+		if query.Until, err = parseTimeParam(params.Get("until")); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			_, _ = writer.Write([]byte("invalid until"))
+			return
+		}
+		if params.Get("format") == "jsonl" {
+			exportAuditLog(writer, audit, query)
+			return
+		}
+		page, _ := strconv.Atoi(params.Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		pageSize, _ := strconv.Atoi(params.Get("pageSize"))
+		if pageSize < 1 || pageSize > auditExportBatch {
+			pageSize = auditPageSize
+		}
+		query.Limit = pageSize
+		query.Offset = (page - 1) * pageSize
+		entries, err := audit.AuditEntries(query)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			log.Print(err)
+			return
+		}
+		resp, _ := json.Marshal(entries)
+		setDefaultHeader(writer)
+		_, _ = writer.Write(resp)
+	}
+}
+
+func exportAuditLog(writer http.ResponseWriter, audit repo.AuditRepository, query repo.AuditQuery) {
+	writer.Header().Set("Content-Type", "application/x-ndjson")
+	writer.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	encoder := json.NewEncoder(writer)
+	query.Limit = auditExportBatch
+	query.Offset = 0
+	for {
+		entries, err := audit.AuditEntries(query)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		for _, entry := range entries {
+			if err = encoder.Encode(entry); err != nil {
+				return
+			}
+		}
+		if len(entries) < query.Limit {
+			return
+		}
+		query.BeforeId = entries[len(entries)-1].Id
+	}
+}
+
+func auditActor(request *http.Request) string {
+	if username := usernameFromRequest(request); username != "" {
+		return username
+	}
+	if request.Body == nil {
+		return ""
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, maxAuditBodyPeek))
+	request.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), request.Body), Closer: request.Body}
+	if err != nil {
+		return ""
+	}
+	credentials := struct {
+		Username string `json:"username"`
+	}{}
+	_ = json.Unmarshal(body, &credentials)
+	return credentials.Username
+}
+
+func parseTimeParam(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
+
+func routeTemplate(request *http.Request) string {
+	if route := mux.CurrentRoute(request); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return request.URL.Path
+}
+
+func marshalSnapshot(snapshot interface{}) json.RawMessage {
+	if snapshot == nil {
+		return nil
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil
+	}
+	return data
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/segfaultx/simple_rest/pkg/auth"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"log"
+	"net/http"
+)
+
+const (
+	batchModeAtomic     = "atomic"
+	batchModeBestEffort = "bestEffort"
+	maxBatchOperations  = 10000
+)
+
+type (
+	productBatchRequest struct {
+		Mode       string                  `json:"mode"`
+		Operations []repo.ProductOperation `json:"operations"`
+	}
+
+	productBatchResult struct {
+		Index   int           `json:"index"`
+		Status  int           `json:"status"`
+		Product *repo.Product `json:"product,omitempty"`
+		Error   string        `json:"error,omitempty"`
+	}
+)
+
+func MakeProductBatchHandler(batch repo.ProductBatchRepository, service auth.AuthenticationService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		batchRequest := productBatchRequest{Mode: batchModeAtomic}
+		if err := decodeRequestBody(&batchRequest, request); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			_, _ = writer.Write([]byte("Malformed JSON request"))
+			return
+		}
+		if batchRequest.Mode != batchModeAtomic && batchRequest.Mode != batchModeBestEffort {
+			writer.WriteHeader(http.StatusBadRequest)
+			_, _ = writer.Write([]byte("mode must be atomic or bestEffort"))
+			return
+		}
+		if len(batchRequest.Operations) == 0 || len(batchRequest.Operations) > maxBatchOperations {
+			writer.WriteHeader(http.StatusBadRequest)
+			_, _ = writer.Write([]byte("invalid number of operations"))
+			return
+		}
+		token := tokenFromRequest(request)
+		atomic := batchRequest.Mode == batchModeAtomic
+		results := make([]productBatchResult, len(batchRequest.Operations))
+		valid := make([]int, 0, len(batchRequest.Operations))
+		for index, operation := range batchRequest.Operations {
+			results[index].Index = index
+			if err := validateOperation(operation); err != nil {
+				results[index].Status = http.StatusUnprocessableEntity
+				results[index].Error = err.Error()
+				continue
+			}
+			if operation.Op == repo.BatchDelete && (!hasScope(token, auth.PermissionProductsDelete) || !service.Authorize(token, auth.PermissionProductsDelete)) {
+				results[index].Status = http.StatusForbidden
+				results[index].Error = http.StatusText(http.StatusForbidden)
+				continue
+			}
+			valid = append(valid, index)
+		}
+		if atomic && len(valid) != len(results) {
+			for _, index := range valid {
+				results[index].Status = http.StatusFailedDependency
+				results[index].Error = repo.ErrBatchAborted.Error()
+			}
+			writeBatchResults(writer, http.StatusUnprocessableEntity, results)
+			return
+		}
+		operations := make([]repo.ProductOperation, len(valid))
+		for position, index := range valid {
+			operations[position] = batchRequest.Operations[index]
+		}
+		applied, err := batch.ApplyProductBatch(operations, atomic)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			_, _ = writer.Write([]byte("Error applying batch"))
+			log.Print(err)
+			return
+		}
+		status := http.StatusOK
+		for position, index := range valid {
+			results[index] = batchResult(index, operations[position].Op, applied[position])
+			if atomic && applied[position].Err != nil && applied[position].Err != repo.ErrBatchAborted {
+				status = results[index].Status
+			}
+		}
+		writeBatchResults(writer, status, results)
+	}
+}
+
+func validateOperation(operation repo.ProductOperation) error {
+	switch operation.Op {
+	case repo.BatchCreate:
+		return repo.ValidateProduct(operation.Product)
+	case repo.BatchUpdate:
+		if operation.Id < 1 {
+			return repo.ErrProductNotFound
+		}
+		return repo.ValidateProduct(operation.Product)
+	case repo.BatchDelete:
+		if operation.Id < 1 {
+			return repo.ErrProductNotFound
+		}
+		return nil
+	}
+	return repo.ErrUnknownBatchOperation
+}
+
+func batchResult(index int, op string, applied repo.ProductOperationResult) productBatchResult {
+	result := productBatchResult{Index: index}
+	switch applied.Err {
+	case nil:
+		result.Status = http.StatusOK
+		if op == repo.BatchCreate {
+			result.Status = http.StatusCreated
+		}
+		result.Product = &applied.Product
+		return result
+	case repo.ErrProductNotFound:
+		result.Status = http.StatusNotFound
+	case repo.ErrVersionConflict:
+		result.Status = http.StatusPreconditionFailed
+	case repo.ErrDuplicateSku:
+		result.Status = http.StatusConflict
+	case repo.ErrBatchAborted:
+		result.Status = http.StatusFailedDependency
+	default:
+		if _, ok := applied.Err.(*repo.AttributeError); ok {
+			result.Status = http.StatusUnprocessableEntity
+			break
+		}
+		result.Status = http.StatusInternalServerError
+		result.Error = "Error applying operation"
+		log.Print(applied.Err)
+		return result
+	}
+	result.Error = applied.Err.Error()
+	return result
+}
+
+func writeBatchResults(writer http.ResponseWriter, status int, results []productBatchResult) {
+	resp, _ := json.Marshal(struct {
+		Results []productBatchResult `json:"results"`
+	}{results})
+	setDefaultHeader(writer)
+	writer.WriteHeader(status)
+	_, _ = writer.Write(resp)
+}
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type categoryMove struct {
+	ParentId *int `json:"parentId"`
+	Position int  `json:"position"`
+}
+
+func writeCategoryError(writer http.ResponseWriter, err error) {
+	switch err {
+	case repo.ErrCategoryNotFound, repo.ErrProductNotFound:
+		writer.WriteHeader(http.StatusNotFound)
+	case repo.ErrDuplicateSlug, repo.ErrCategoryCycle, repo.ErrCategoryNotEmpty:
+		writer.WriteHeader(http.StatusConflict)
+	default:
+		writer.WriteHeader(http.StatusInternalServerError)
+		_, _ = writer.Write([]byte("Error processing categories"))
+		log.Print(err)
+		return
+	}
+	_, _ = writer.Write([]byte(err.Error()))
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	resp, _ := json.Marshal(value)
+	setDefaultHeader(writer)
+	writer.WriteHeader(status)
+	_, _ = writer.Write(resp)
+}
+
+// decodeCategory reads a category from the request body, deriving a missing
+// slug from its name.
+func decodeCategory(writer http.ResponseWriter, request *http.Request) (repo.Category, bool) {
+	category := repo.Category{}
+	if err := decodeRequestBody(&category, request); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return repo.Category{}, false
+	}
+	if category.Slug == "" {
+		category.Slug = repo.Slugify(category.Name)
+	}
+	if err := repo.ValidateCategory(category); err != nil {
+		writer.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = writer.Write([]byte(err.Error()))
+		return repo.Category{}, false
+	}
+	return category, true
+}
+
+func categoryId(writer http.ResponseWriter, request *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(request)["id"])
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// MakeCategoriesHandler lists the category tree and creates categories.
+func MakeCategoriesHandler(categories repo.CategoryRepository) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method == "POST" {
+			category, ok := decodeCategory(writer, request)
+			if !ok {
+				return
+			}
+			created, err := categories.SaveCategory(category)
+			if err != nil {
+				writeCategoryError(writer, err)
+				return
+			}
+			writer.Header().Set("Location", request.URL.Path+"/"+strconv.Itoa(created.Id))
+			writeJSON(writer, http.StatusCreated, created)
+			return
+		}
+		all, err := categories.Categories()
+		if err != nil {
+			writeCategoryError(writer, err)
+			return
+		}
+		if request.URL.Query().Get("flat") == "true" {
+			writeJSON(writer, http.StatusOK, all)
+			return
+		}
+		writeJSON(writer, http.StatusOK, repo.BuildCategoryTree(all))
+	}
+}
+
+func MakeCategoryHandler(categories repo.CategoryRepository) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id, ok := categoryId(writer, request)
+		if !ok {
+			return
+		}
+		switch request.Method {
+		case "GET":
+			category, err := categories.GetCategory(id)
+			if err != nil {
+				writeCategoryError(writer, err)
+				return
+			}
+			writeJSON(writer, http.StatusOK, category)
+		case "PUT":
+			category, ok := decodeCategory(writer, request)
+			if !ok {
+				return
+			}
+			category.Id = id
+			updated, err := categories.SaveCategory(category)
+			if err != nil {
+				writeCategoryError(writer, err)
+				return
+			}
+			writeJSON(writer, http.StatusOK, updated)
+		case "DELETE":
+			if err := categories.RemoveCategory(id); err != nil {
+				writeCategoryError(writer, err)
+				return
+			}
+			writer.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// MakeMoveCategoryHandler moves a category with its subtree below a new
+// parent, or to the top level when parentId is null.
+func MakeMoveCategoryHandler(categories repo.CategoryRepository) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id, ok := categoryId(writer, request)
+		if !ok {
+			return
+		}
+		move := categoryMove{}
+		if err := decodeRequestBody(&move, request); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if move.ParentId != nil && *move.ParentId == id {
+			writeCategoryError(writer, repo.ErrCategoryCycle)
+			return
+		}
+		moved, err := categories.MoveCategory(id, move.ParentId, move.Position)
+		if err != nil {
+			writeCategoryError(writer, err)
+			return
+		}
+		writeJSON(writer, http.StatusOK, moved)
+	}
+}
+
+// MakeCategoryProductsHandler lists the products of a category including its
+// descendants unless descendants=false is given.
+func MakeCategoryProductsHandler(categories repo.CategoryRepository) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id, ok := categoryId(writer, request)
+		if !ok {
+			return
+		}
+		descendants := request.URL.Query().Get("descendants") != "false"
+		products, err := categories.CategoryProducts(id, descendants)
+		if err != nil {
+			writeCategoryError(writer, err)
+			return
+		}
+		writeJSON(writer, http.StatusOK, products)
+	}
+}
+
+// MakeProductCategoriesHandler reads and replaces the categories a product
+// is assigned to.
+func MakeProductCategoriesHandler(categories repo.CategoryRepository) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id, ok := categoryId(writer, request)
+		if !ok {
+			return
+		}
+		if request.Method == "PUT" {
+			ids := make([]int, 0)
+			if err := decodeRequestBody(&ids, request); err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if err := categories.SetProductCategories(id, uniqueIds(ids)); err != nil {
+				writeCategoryError(writer, err)
+				return
+			}
+		}
+		assigned, err := categories.ProductCategories(id)
+		if err != nil {
+			writeCategoryError(writer, err)
+			return
+		}
+		writeJSON(writer, http.StatusOK, assigned)
+	}
+}
+
+func uniqueIds(ids []int) []int {
+	seen := make(map[int]bool, len(ids))
+	unique := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errInvalidPrecondition = errors.New("invalid If-Match header")
+
+func productETag(product repo.Product) string {
+	return fmt.Sprintf(`"%d"`, product.Version)
+}
+
+func listETag(products []repo.Product) string {
+	hash := sha256.New()
+	for _, product := range products {
+		_, _ = fmt.Fprintf(hash, "%d:%d;", product.Id, product.Version)
+	}
+	return `W/"` + hex.EncodeToString(hash.Sum(nil))[:16] + `"`
+}
+
+func notModified(writer http.ResponseWriter, request *http.Request, etag string) bool {
+	writer.Header().Set("ETag", etag)
+	for _, candidate := range strings.Split(request.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			writer.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// expectedVersion returns the product version named by the If-Match header,
+// or 0 when the request is unconditional.
+func expectedVersion(request *http.Request) (int, error) {
+	ifMatch := strings.TrimSpace(request.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return 0, nil
+	}
+	if strings.HasPrefix(ifMatch, "W/") || strings.Contains(ifMatch, ",") {
+		return 0, errInvalidPrecondition
+	}
+	version, err := strconv.Atoi(strings.Trim(ifMatch, `"`))
+	if err != nil || version < 1 {
+		return 0, errInvalidPrecondition
+	}
+	return version, nil
+}
+
+func RequireIfMatch(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != "GET" && request.Method != "POST" && request.Header.Get("If-Match") == "" {
+			writer.WriteHeader(http.StatusPreconditionRequired)
+			_, _ = writer.Write([]byte("If-Match header required"))
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const attributeParamPrefix = "attr."
+
+var facetParams = []string{"brand", "price", "inStock", "category", "tag", "facets"}
+
+func parsePaging(request *http.Request, defaultLimit, maxLimit int) (int, int, error) {
+	limit, offset := defaultLimit, 0
+	var err error
+	if value := request.URL.Query().Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxLimit {
+			return 0, 0, errors.New("invalid limit")
+		}
+	}
+	if value := request.URL.Query().Get("offset"); value != "" {
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+	}
+	return limit, offset, nil
+}
+
+// productFilterFromRequest reads the facet filters of request and reports
+// whether the client asked for a faceted response at all.
+func productFilterFromRequest(request *http.Request) (repo.ProductFilter, bool, error) {
+	values := request.URL.Query()
+	faceted := false
+	for _, param := range facetParams {
+		if _, ok := values[param]; ok {
+			faceted = true
+		}
+	}
+	filter := repo.ProductFilter{Text: values.Get("q"), Brands: values["brand"], Categories: values["category"], Tags: values["tag"]}
+	for param, accepted := range values {
+		if strings.HasPrefix(param, attributeParamPrefix) {
+			if filter.Attributes == nil {
+				filter.Attributes = make(map[string][]string)
+			}
+			filter.Attributes[strings.TrimPrefix(param, attributeParamPrefix)] = accepted
+			faceted = true
+		}
+	}
+	var err error
+	if filter.Limit, filter.Offset, err = parsePaging(request, defaultSearchLimit, maxSearchLimit); err != nil {
+		return repo.ProductFilter{}, false, err
+	}
+	for _, value := range values["price"] {
+		priceRange, err := repo.ParsePriceRange(value)
+		if err != nil {
+			return repo.ProductFilter{}, false, err
+		}
+		filter.PriceRanges = append(filter.PriceRanges, priceRange)
+	}
+	if value := values.Get("inStock"); value != "" {
+		inStock, err := strconv.ParseBool(value)
+		if err != nil {
+			return repo.ProductFilter{}, false, errors.New("invalid inStock")
+		}
+		filter.InStock = &inStock
+	}
+	return filter, faceted, nil
+}
+
+// writeFacetedProducts answers a faceted request, or returns false when the
+// request does not ask for facets.
+func writeFacetedProducts(writer http.ResponseWriter, request *http.Request, repository repo.ProductRepository) bool {
+	filter, faceted, err := productFilterFromRequest(request)
+	if err == nil && !faceted {
+		return false
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		_, _ = writer.Write([]byte(err.Error()))
+		return true
+	}
+	facets, ok := repository.(repo.FacetRepository)
+	if !ok {
+		writer.WriteHeader(http.StatusNotImplemented)
+		_, _ = writer.Write([]byte("facets are not supported by this repository"))
+		return true
+	}
+	page, err := facets.FilterProducts(filter)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		_, _ = writer.Write([]byte("Error filtering products"))
+		log.Print(err)
+		return true
+	}
+	resp, _ := json.Marshal(page)
+	setDefaultHeader(writer)
+	writer.WriteHeader(http.StatusOK)
+	_, _ = writer.Write(resp)
+	return true
+}
@@ -10,6 +10,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -26,54 +27,108 @@ func MakeProductsHandler(repository repo.ProductRepository) http.HandlerFunc {
 		}
 		switch request.Method {
 		case "GET":
-			handleGet(repository, writer, id)
+			handleGet(repository, writer, request, id)
 		case "DELETE":
-			handleDelete(repository, writer, id)
+			handleDelete(repository, writer, request, id)
 		case "PUT":
 			handlePut(repository, writer, request, id)
+		case "PATCH":
+			handlePatch(repository, writer, request, id)
 		}
 	}
 }
 
-func handleGet(repository repo.ProductRepository, writer http.ResponseWriter, id int) {
+func handleGet(repository repo.ProductRepository, writer http.ResponseWriter, request *http.Request, id int) {
 	product, err := repository.GetProductById(id)
 	if err != nil {
 		writer.WriteHeader(http.StatusInternalServerError)
 		_, _ = writer.Write([]byte("couldn't find the requested object"))
 		return
 	}
+	if notModified(writer, request, productETag(product)) {
+		return
+	}
 	resp, _ := json.Marshal(product)
 	writer.WriteHeader(http.StatusOK)
 	_, _ = writer.Write(resp)
 }
 
-func handleDelete(repository repo.ProductRepository, writer http.ResponseWriter, id int) {
-	err := repository.RemoveProduct(repo.Product{Id: id})
+func handleDelete(repository repo.ProductRepository, writer http.ResponseWriter, request *http.Request, id int) {
+	version, err := expectedVersion(request)
+	if err != nil {
+		writer.WriteHeader(http.StatusPreconditionFailed)
+		_, _ = writer.Write([]byte(err.Error()))
+		return
+	}
+	err = repository.RemoveProduct(repo.Product{Id: id, Version: version})
+	if err == repo.ErrVersionConflict {
+		writer.WriteHeader(http.StatusPreconditionFailed)
+		_, _ = writer.Write([]byte(err.Error()))
+		return
+	}
+	if err == repo.ErrProductNotFound {
+		writer.WriteHeader(http.StatusNotFound)
+		_, _ = writer.Write([]byte(err.Error()))
+		return
+	}
 	if err != nil {
 		writer.WriteHeader(http.StatusInternalServerError)
 		_, _ = writer.Write([]byte("Error removing Product"))
 		log.Print(err)
+		return
 	}
+	recordAuditAfter(request, nil)
 }
 
 func handlePut(repository repo.ProductRepository, writer http.ResponseWriter, request *http.Request, id int) {
+	version, err := expectedVersion(request)
+	if err != nil {
+		writer.WriteHeader(http.StatusPreconditionFailed)
+		_, _ = writer.Write([]byte(err.Error()))
+		return
+	}
 	product := repo.Product{}
-	err := decodeRequestBody(&product, request)
+	err = decodeRequestBody(&product, request)
 	if err != nil {
 		writer.WriteHeader(http.StatusInternalServerError)
 		_, _ = writer.Write([]byte("Malformed JSON request"))
 		log.Print(err)
+		return
+	}
+	if err = repo.ValidateProduct(product); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		_, _ = writer.Write([]byte(err.Error()))
+		return
 	}
 	product.Id = id
-	err = repository.UpdateProduct(product)
+	product.Version = version
+	product, err = repository.UpdateProduct(product)
+	if err == repo.ErrVersionConflict {
+		writer.WriteHeader(http.StatusPreconditionFailed)
+		_, _ = writer.Write([]byte(err.Error()))
+		return
+	}
+	if err == repo.ErrDuplicateSku {
+		writer.WriteHeader(http.StatusConflict)
+		_, _ = writer.Write([]byte(err.Error()))
+		return
+	}
+	if _, ok := err.(*repo.AttributeError); ok {
+		writer.WriteHeader(http.StatusBadRequest)
+		_, _ = writer.Write([]byte(err.Error()))
+		return
+	}
 	if err != nil {
 		writer.WriteHeader(http.StatusInternalServerError)
 		_, _ = writer.Write([]byte("Error updating product"))
 		log.Print(err)
+		return
 	}
+	recordAuditAfter(request, product)
+	setDefaultHeader(writer)
+	writer.Header().Set("ETag", productETag(product))
 	writer.WriteHeader(http.StatusOK)
 	resp, _ := json.Marshal(product)
-	setDefaultHeader(writer)
 	_, _ = writer.Write(resp)
 }
 
@@ -81,7 +136,9 @@ func MakeAllProductsHandler(repository repo.ProductRepository, service auth.Auth
 	return func(writer http.ResponseWriter, request *http.Request) {
 		userAuthenticated := false
 		token, err := checkUserAuthentication(request, service)
-		if err == nil {
+		if err == nil && !isCookieAuthenticated(request) {
+			userAuthenticated = true
+		} else if err == nil {
 			userAuthenticated = true
 			refreshedToken, err := service.RefreshToken(token)
 			if err != nil {
@@ -95,7 +152,19 @@ func MakeAllProductsHandler(repository repo.ProductRepository, service auth.Auth
 		switch request.Method {
 		case "GET":
 			{
-				products := repository.AllProducts()
+				if writeFacetedProducts(writer, request, repository) {
+					return
+				}
+				products, err := repository.ListProducts()
+				if err != nil {
+					writer.WriteHeader(http.StatusInternalServerError)
+					_, _ = writer.Write([]byte("Error listing products"))
+					log.Print(err)
+					return
+				}
+				if notModified(writer, request, listETag(products)) {
+					return
+				}
 				resp, _ := json.Marshal(products)
 				setDefaultHeader(writer)
 				_, _ = writer.Write(resp)
@@ -106,25 +175,43 @@ func MakeAllProductsHandler(repository repo.ProductRepository, service auth.Auth
 					writer.WriteHeader(http.StatusUnauthorized)
 					return
 				}
+				if !hasScope(token, auth.ScopeProductsWrite) {
+					writer.WriteHeader(http.StatusForbidden)
+					return
+				}
 				product := repo.Product{}
 				err = decodeRequestBody(&product, request)
 				if err != nil {
 					writer.WriteHeader(http.StatusBadRequest)
 					return
 				}
-				if len(product.Name) <= 3 {
+				if err = repo.ValidateProduct(product); err != nil {
 					writer.WriteHeader(http.StatusBadRequest)
-					_, _ = writer.Write([]byte("invalid product name"))
+					_, _ = writer.Write([]byte(err.Error()))
+					return
+				}
+				product, err = repository.AddProduct(product)
+				if err == repo.ErrDuplicateSku {
+					writer.WriteHeader(http.StatusConflict)
+					_, _ = writer.Write([]byte(err.Error()))
+					return
+				}
+				if _, ok := err.(*repo.AttributeError); ok {
+					writer.WriteHeader(http.StatusBadRequest)
+					_, _ = writer.Write([]byte(err.Error()))
 					return
 				}
-				err = repository.AddProduct(product)
 				if err != nil {
 					writer.WriteHeader(http.StatusInternalServerError)
 					_, _ = writer.Write([]byte("Error adding Product to database"))
 					return
 				}
+				recordAuditAfter(request, product)
 				resp, _ := json.Marshal(product)
 				setDefaultHeader(writer)
+				writer.Header().Set("Location", strings.TrimSuffix(request.URL.Path, "/")+"/"+strconv.Itoa(product.Id))
+				writer.Header().Set("ETag", productETag(product))
+				writer.WriteHeader(http.StatusCreated)
 				_, _ = writer.Write(resp)
 			}
 		}
@@ -132,6 +219,12 @@ func MakeAllProductsHandler(repository repo.ProductRepository, service auth.Auth
 }
 
 func checkUserAuthentication(request *http.Request, service auth.AuthenticationService) (*jwt.Token, error) {
+	if apiKey := request.Header.Get(apiKeyHeader); apiKey != "" {
+		return service.AuthenticateAPIKey(apiKey)
+	}
+	if authorization := request.Header.Get("Authorization"); strings.HasPrefix(authorization, bearerPrefix) {
+		return service.GetTokenFromString(strings.TrimPrefix(authorization, bearerPrefix))
+	}
 	tokenCookie, err := request.Cookie("token")
 	if err != nil {
 		return &jwt.Token{}, errors.New("user not authenticated")
@@ -147,7 +240,12 @@ func MakeRegisterHandler(service auth.AuthenticationService) http.HandlerFunc {
 			writer.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		err = service.RegisterUser(credentials.Username, credentials.Password)
+		err = service.RegisterUserWithEmail(credentials.Username, credentials.Password, credentials.Email)
+		if err == auth.ErrEmailRequired || err == auth.ErrInvalidEmail {
+			writer.WriteHeader(http.StatusBadRequest)
+			_, _ = writer.Write([]byte(err.Error()))
+			return
+		}
 		if err != nil {
 			writer.WriteHeader(http.StatusInternalServerError)
 			return
@@ -156,6 +254,29 @@ func MakeRegisterHandler(service auth.AuthenticationService) http.HandlerFunc {
 	}
 }
 
+func MakeVerifyEmailHandler(service auth.AuthenticationService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		token := request.URL.Query().Get("token")
+		if token == "" {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		err := service.VerifyEmail(token)
+		if err == auth.ErrInvalidVerifyToken {
+			writer.WriteHeader(http.StatusBadRequest)
+			_, _ = writer.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			log.Print(err)
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+		_, _ = writer.Write([]byte("email address verified"))
+	}
+}
+
 func MakeLoginHandler(service auth.AuthenticationService) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		credentials := auth.Credentials{}
@@ -165,6 +286,18 @@ func MakeLoginHandler(service auth.AuthenticationService) http.HandlerFunc {
 			return
 		}
 		token, err := service.GenerateToken(credentials)
+		if err == auth.ErrTwoFactorRequired {
+			resp, _ := json.Marshal(twoFactorChallengeResponse{TwoFactorRequired: true, ChallengeToken: token})
+			setDefaultHeader(writer)
+			writer.WriteHeader(http.StatusAccepted)
+			_, _ = writer.Write(resp)
+			return
+		}
+		if err == auth.ErrEmailNotVerified {
+			writer.WriteHeader(http.StatusForbidden)
+			_, _ = writer.Write([]byte(err.Error()))
+			return
+		}
 		if err != nil {
 			writer.WriteHeader(http.StatusInternalServerError)
 			return
@@ -175,13 +308,20 @@ func MakeLoginHandler(service auth.AuthenticationService) http.HandlerFunc {
 	}
 }
 
+// SecureCookies marks session cookies as HTTPS only.
+var SecureCookies = true
+
 func addCookieToRequest(writer http.ResponseWriter, token string) {
 	expiration := time.Now().Add(time.Minute * 10)
 	cookie := http.Cookie{Name: "token",
 		Value:    token,
 		Expires:  expiration,
 		HttpOnly: true,
-		Secure:   false,
+		Secure:   SecureCookies,
+		// Lax keeps the session on top-level navigations such as the
+		// redirect to /oauth/authorize while withholding it from
+		// cross-site form posts.
+		SameSite: http.SameSiteLaxMode,
 		Path:     "/"}
 	http.SetCookie(writer, &cookie)
 }
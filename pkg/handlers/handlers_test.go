@@ -7,38 +7,80 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/segfaultx/simple_rest/pkg/auth"
 	"github.com/segfaultx/simple_rest/pkg/repo"
+	"github.com/segfaultx/simple_rest/pkg/suggest"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
+func TestMain(m *testing.M) {
+	_ = os.Setenv("API_SECRET", "0123456789abcdef0123456789abcdef")
+	if err := auth.LoadSecrets(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
 type mockRepo struct {
 	Products []repo.Product
 }
 
-func (mockRepo *mockRepo) AddProduct(product repo.Product) error {
+func (mockRepo *mockRepo) AddProduct(product repo.Product) (repo.Product, error) {
 	if product.Id == -1 {
-		return errors.New("-1 is the signal from test to throw an error")
+		return repo.Product{}, errors.New("-1 is the signal from test to throw an error")
 	}
+	product.Id = len(mockRepo.Products) + 1
+	product.Version = 1
 	mockRepo.Products = append(mockRepo.Products, product)
-	return nil
+	return product, nil
 }
 
-func (mockRepo *mockRepo) UpdateProduct(product repo.Product) error {
-	for _, item := range mockRepo.Products {
+func (mockRepo *mockRepo) UpdateProduct(product repo.Product) (repo.Product, error) {
+	for index, item := range mockRepo.Products {
 		if item.Id == product.Id {
-			item.Name = product.Name
-			return nil
+			if product.Version != 0 && product.Version != item.Version {
+				return repo.Product{}, repo.ErrVersionConflict
+			}
+			product.Version = item.Version + 1
+			mockRepo.Products[index] = product
+			return product, nil
 		}
 	}
-	return errors.New("could not find requested item")
+	return repo.Product{}, errors.New("could not find requested item")
+}
+
+func (mockRepo *mockRepo) PatchProduct(id, version int, apply func(repo.Product) (repo.Product, error)) (repo.Product, error) {
+	for index, item := range mockRepo.Products {
+		if item.Id == id {
+			if version != 0 && version != item.Version {
+				return repo.Product{}, repo.ErrVersionConflict
+			}
+			patched, err := apply(item)
+			if err != nil {
+				return repo.Product{}, err
+			}
+			patched.Version++
+			mockRepo.Products[index] = patched
+			return patched, nil
+		}
+	}
+	return repo.Product{}, repo.ErrProductNotFound
 }
 
 func (mockRepo *mockRepo) AllProducts() []repo.Product {
 	return mockRepo.Products
 }
 
+func (mockRepo *mockRepo) ListProducts() ([]repo.Product, error) {
+	return mockRepo.Products, nil
+}
+
 func (mockRepo *mockRepo) InitRepo(user, passwd, dbname string) error {
 	return nil
 }
@@ -57,7 +99,7 @@ func (mockRepo *mockRepo) RemoveProduct(product repo.Product) error {
 			return nil
 		}
 	}
-	return errors.New("couldn't remove product")
+	return repo.ErrProductNotFound
 }
 
 func (mockRepo *mockRepo) Close() {
@@ -75,8 +117,9 @@ const baseUrl = "/catalog/products"
 func initMockRepo() {
 	testProducts := make([]repo.Product, 0)
 	testProduct := repo.Product{
-		Id:   1,
-		Name: "Hosen",
+		Id:      1,
+		Name:    "Hosen",
+		Version: 1,
 	}
 	testProducts = append(testProducts, testProduct)
 	repository = mockRepo{
@@ -102,7 +145,27 @@ func (mockRepo *MockUserRepo) GetByUsername(username string) (repo.User, error)
 			return user, nil
 		}
 	}
-	return repo.User{}, errors.New("user not found")
+	return repo.User{}, repo.ErrUserNotFound
+}
+
+func (mockRepo *MockUserRepo) UpdateUser(u repo.User) error {
+	for index, user := range mockRepo.Users {
+		if user.Username == u.Username {
+			mockRepo.Users[index] = u
+			return nil
+		}
+	}
+	return repo.ErrUserNotFound
+}
+
+func (mockRepo *MockUserRepo) RemoveUser(username string) error {
+	for index, user := range mockRepo.Users {
+		if user.Username == username {
+			mockRepo.Users = append(mockRepo.Users[:index], mockRepo.Users[index+1:]...)
+			return nil
+		}
+	}
+	return errors.New("user not found")
 }
 
 
@@ -151,7 +214,7 @@ func TestMakeAllProductsHandlerGET(t *testing.T) {
 func TestMakeAllProductsHandlerPOST(t *testing.T) {
 	initMockRepo()
 	service := prepareAuthService()
-	newProduct := repo.Product{Id: 2, Name: "Schuhe"}
+	newProduct := repo.Product{Name: "Schuhe"}
 	newProductJson, _ := json.Marshal(newProduct)
 	reader := bytes.NewReader(newProductJson)
 	req, err := http.NewRequest("POST", baseUrl, reader)
@@ -163,15 +226,18 @@ func TestMakeAllProductsHandlerPOST(t *testing.T) {
 	rr := httptest.NewRecorder()
 	handler := MakeAllProductsHandler(&repository, service)
 	handler.ServeHTTP(rr, req)
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf(errorMsgStatusCode, status, http.StatusOK)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf(errorMsgStatusCode, status, http.StatusCreated)
 		t.FailNow()
 	}
 
-	expected, _ := json.Marshal(newProduct)
+	expected, _ := json.Marshal(repo.Product{Id: 2, Name: "Schuhe", Version: 1})
 	if response := rr.Body.String(); response != string(expected) {
 		t.Errorf(errorMsgResponseBody, response, expected)
 	}
+	if location := rr.Header().Get("Location"); location != baseUrl+"/2" {
+		t.Errorf("expected %v, received %v", baseUrl+"/2", location)
+	}
 }
 
 func TestMakeAllProductsHandlerPOSTFail(t *testing.T) {
@@ -266,8 +332,8 @@ func TestMakeProductsHandlerDELETENotExistingProduct(t *testing.T) {
 	rr := httptest.NewRecorder()
 	handler := MakeProductsHandler(&repository)
 	initRouter(handler, "DELETE").ServeHTTP(rr, req)
-	if status := rr.Code; status != http.StatusInternalServerError {
-		t.Errorf(errorMsgStatusCode, status, http.StatusInternalServerError)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf(errorMsgStatusCode, status, http.StatusNotFound)
 	}
 }
 
@@ -341,4 +407,1105 @@ func TestMakeProductsHandlerBADURLParam(t *testing.T) {
 	if status := rr.Code; status != http.StatusBadRequest {
 		t.Errorf(errorMsgStatusCode, status, http.StatusBadRequest)
 	}
-}
\ No newline at end of file
+}
+
+func TestMakeProductAuthorizationMiddleware(t *testing.T) {
+	initMockRepo()
+	service := prepareAuthService()
+	router := mux.NewRouter()
+	router.Handle(baseUrl+"/{id}", MakeProductAuthorizationMiddleware(service)(MakeProductsHandler(&repository))).Methods("GET", "DELETE")
+
+	req, _ := http.NewRequest("GET", baseUrl+"/1", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf(errorMsgStatusCode, status, http.StatusOK)
+	}
+
+	req, _ = http.NewRequest("DELETE", baseUrl+"/1", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf(errorMsgStatusCode, status, http.StatusUnauthorized)
+	}
+
+	req, _ = http.NewRequest("DELETE", baseUrl+"/1", nil)
+	authenticate(req, service)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf(errorMsgStatusCode, status, http.StatusForbidden)
+	}
+}
+
+type mockAuditRepo struct {
+	Entries []repo.AuditEntry
+}
+
+func (mockRepo *mockAuditRepo) AddAuditEntry(entry repo.AuditEntry) error {
+	mockRepo.Entries = append(mockRepo.Entries, entry)
+	return nil
+}
+
+func (mockRepo *mockAuditRepo) AuditEntries(query repo.AuditQuery) ([]repo.AuditEntry, error) {
+	if query.Limit == 0 {
+		return mockRepo.Entries, nil
+	}
+	entries := make([]repo.AuditEntry, 0)
+	for index := len(mockRepo.Entries) - 1; index >= 0 && len(entries) < query.Limit; index-- {
+		if entry := mockRepo.Entries[index]; query.BeforeId == 0 || entry.Id < query.BeforeId {
+			entries = append(entries, entry)
+		}
+	}
+	// an entry written while the export is running
+	mockRepo.Entries = append(mockRepo.Entries, repo.AuditEntry{Id: len(mockRepo.Entries) + 1})
+	return entries, nil
+}
+
+func TestMakeAuditMiddleware(t *testing.T) {
+	initMockRepo()
+	audit := &mockAuditRepo{}
+	service := prepareAuthService()
+	router := mux.NewRouter()
+	router.Use(RequestIdMiddleware)
+	router.Handle(baseUrl+"/{id}", MakeAuditMiddleware(audit, ProductSnapshot(&repository))(MakeProductsHandler(&repository))).Methods("GET", "PUT", "DELETE")
+	router.Handle("/login", MakeAuditMiddleware(audit, nil)(MakeLoginHandler(service))).Methods("POST")
+
+	req, _ := http.NewRequest("GET", baseUrl+"/1", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if len(audit.Entries) != 0 {
+		t.Errorf("expected reads not to be audited, got %v", audit.Entries)
+	}
+
+	req, _ = http.NewRequest("PUT", baseUrl+"/1", bytes.NewReader([]byte(`{"name":"Hemd"}`)))
+	req.Header.Set(requestIdHeader, "req-1")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if len(audit.Entries) != 1 {
+		t.Fatalf("expected one audit entry, got %d", len(audit.Entries))
+	}
+	entry := audit.Entries[0]
+	if entry.Action != "PUT "+baseUrl+"/{id}" || entry.Target != baseUrl+"/1" || entry.RequestId != "req-1" || entry.Status != http.StatusOK {
+		t.Errorf("unexpected audit entry %+v", entry)
+	}
+	if len(entry.Before) == 0 || len(entry.After) == 0 {
+		t.Errorf("expected before and after snapshots, got %s and %s", entry.Before, entry.After)
+	}
+	after := repo.Product{}
+	_ = json.Unmarshal(entry.After, &after)
+	if after.Name != "Hemd" || after.Version != 2 {
+		t.Errorf("expected the stored product as after snapshot, got %s", entry.After)
+	}
+
+	req, _ = http.NewRequest("DELETE", baseUrl+"/1", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	entry = audit.Entries[len(audit.Entries)-1]
+	if entry.Status != http.StatusOK || len(entry.Before) == 0 || entry.After != nil {
+		t.Errorf("unexpected audit entry %+v", entry)
+	}
+
+	req, _ = http.NewRequest("POST", "/login", bytes.NewReader([]byte(`{"username":"hugo","password":"wrong"}`)))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	entry = audit.Entries[len(audit.Entries)-1]
+	if entry.Actor != "hugo" || entry.Status < http.StatusBadRequest || entry.RequestId == "" {
+		t.Errorf("unexpected audit entry %+v", entry)
+	}
+
+	router.Handle("/verify", MakeAuthEventAuditMiddleware(audit)(MakeVerifyEmailHandler(service))).Methods("GET")
+	req, _ = http.NewRequest("GET", "/verify?token=secret", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	entry = audit.Entries[len(audit.Entries)-1]
+	if entry.Action != "GET /verify" || entry.Target != "/verify" {
+		t.Errorf("unexpected audit entry %+v", entry)
+	}
+}
+
+type mockTrashRepo struct {
+	Trashed []repo.Product
+}
+
+func (mockRepo *mockTrashRepo) TrashedProducts() ([]repo.Product, error) {
+	return mockRepo.Trashed, nil
+}
+
+func (mockRepo *mockTrashRepo) RestoreProduct(id int) (repo.Product, error) {
+	for index, item := range mockRepo.Trashed {
+		if item.Id == id && item.Sku == "taken" {
+			return repo.Product{}, repo.ErrDuplicateSku
+		}
+		if item.Id == id {
+			mockRepo.Trashed = append(mockRepo.Trashed[:index], mockRepo.Trashed[index+1:]...)
+			item.DeletedAt = nil
+			return item, nil
+		}
+	}
+	if id < 0 {
+		return repo.Product{}, errors.New("-1 is the signal from test to throw an error")
+	}
+	return repo.Product{}, repo.ErrNotInTrash
+}
+
+func (mockRepo *mockTrashRepo) PurgeProducts(deletedBefore time.Time) (int64, error) {
+	return 0, nil
+}
+
+func TestMakeRestoreProductHandler(t *testing.T) {
+	deletedAt := time.Now()
+	trash := &mockTrashRepo{Trashed: []repo.Product{{Id: 2, Name: "Socken", DeletedAt: &deletedAt},
+		{Id: 3, Name: "Schal", Sku: "taken", DeletedAt: &deletedAt}}}
+	router := mux.NewRouter()
+	router.HandleFunc(baseUrl+"/{id}/restore", MakeRestoreProductHandler(trash)).Methods("POST")
+
+	req, _ := http.NewRequest("POST", baseUrl+"/2/restore", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Errorf(errorMsgStatusCode, status, http.StatusNoContent)
+	}
+
+	req, _ = http.NewRequest("POST", baseUrl+"/2/restore", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf(errorMsgStatusCode, status, http.StatusNotFound)
+	}
+
+	req, _ = http.NewRequest("POST", baseUrl+"/3/restore", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf(errorMsgStatusCode, status, http.StatusConflict)
+	}
+
+	req, _ = http.NewRequest("POST", baseUrl+"/-1/restore", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf(errorMsgStatusCode, status, http.StatusInternalServerError)
+	}
+}
+
+func TestMakeProductsHandlerConditionalRequests(t *testing.T) {
+	initMockRepo()
+	router := mux.NewRouter()
+	router.Handle(baseUrl+"/{id}", RequireIfMatch(MakeProductsHandler(&repository))).Methods("GET", "PUT")
+
+	req, _ := http.NewRequest("GET", baseUrl+"/1", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	etag := rr.Header().Get("ETag")
+	if etag != `"1"` {
+		t.Errorf("unexpected ETag %s", etag)
+	}
+
+	req, _ = http.NewRequest("GET", baseUrl+"/1", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNotModified {
+		t.Errorf(errorMsgStatusCode, status, http.StatusNotModified)
+	}
+
+	req, _ = http.NewRequest("PUT", baseUrl+"/1", bytes.NewReader([]byte(`{"name":"Hemd"}`)))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusPreconditionRequired {
+		t.Errorf(errorMsgStatusCode, status, http.StatusPreconditionRequired)
+	}
+
+	req, _ = http.NewRequest("PUT", baseUrl+"/1", bytes.NewReader([]byte(`{"name":"Hemd"}`)))
+	req.Header.Set("If-Match", `"7"`)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusPreconditionFailed {
+		t.Errorf(errorMsgStatusCode, status, http.StatusPreconditionFailed)
+	}
+
+	req, _ = http.NewRequest("PUT", baseUrl+"/1", bytes.NewReader([]byte(`{"name":"Hemd"}`)))
+	req.Header.Set("If-Match", etag)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf(errorMsgStatusCode, status, http.StatusOK)
+	}
+	if next := rr.Header().Get("ETag"); next != `"2"` {
+		t.Errorf("unexpected ETag %s", next)
+	}
+	stored := repo.Product{}
+	_ = json.Unmarshal(rr.Body.Bytes(), &stored)
+	if stored.Version != 2 || stored.Name != "Hemd" {
+		t.Errorf("unexpected product %+v", stored)
+	}
+}
+
+func TestMakeProductsHandlerPATCH(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		ifMatch     string
+		status      int
+		name        string
+	}{
+		{"application/merge-patch+json", `{"name":"Hemd"}`, "", http.StatusOK, "Hemd"},
+		{"application/json-patch+json", `[{"op":"test","path":"/name","value":"Hosen"},{"op":"replace","path":"/name","value":"Jacke"}]`, `"1"`, http.StatusOK, "Jacke"},
+		{"application/json-patch+json", `[{"op":"test","path":"/name","value":"Hemd"}]`, "", http.StatusConflict, ""},
+		{"application/json-patch+json", `[{"op":"remove","path":"/weight"}]`, "", http.StatusUnprocessableEntity, ""},
+		{"application/merge-patch+json", `{"name":"Hut"}`, "", http.StatusUnprocessableEntity, ""},
+		{"application/merge-patch+json", `{"id":5}`, "", http.StatusUnprocessableEntity, ""},
+		{"application/merge-patch+json", `{"color":"red"}`, "", http.StatusUnprocessableEntity, ""},
+		{"application/merge-patch+json", `{"name":"Hemd"}`, `"3"`, http.StatusPreconditionFailed, ""},
+		{"application/json-patch+json", `{"op":"add"}`, "", http.StatusBadRequest, ""},
+		{"application/json", `{"name":"Hemd"}`, "", http.StatusUnsupportedMediaType, ""},
+	}
+	for _, test := range tests {
+		initMockRepo()
+		router := mux.NewRouter()
+		router.HandleFunc(baseUrl+"/{id}", MakeProductsHandler(&repository)).Methods("PATCH")
+		req, _ := http.NewRequest("PATCH", baseUrl+"/1", bytes.NewReader([]byte(test.body)))
+		req.Header.Set("Content-Type", test.contentType)
+		if test.ifMatch != "" {
+			req.Header.Set("If-Match", test.ifMatch)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != test.status {
+			t.Errorf(errorMsgStatusCode, status, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		product := repo.Product{}
+		_ = json.Unmarshal(rr.Body.Bytes(), &product)
+		if product.Name != test.name || product.Version != 2 {
+			t.Errorf("expected %v, received %v", test.name, product)
+		}
+		if etag := rr.Header().Get("ETag"); etag != `"2"` {
+			t.Errorf("unexpected ETag %s", etag)
+		}
+	}
+}
+
+type mockIdempotencyRepo struct {
+	sync.Mutex
+	Responses map[string]repo.IdempotentResponse
+	SaveErr   error
+}
+
+func (mockRepo *mockIdempotencyRepo) ReserveIdempotencyKey(key repo.IdempotencyKey, expiredBefore time.Time) (repo.IdempotentResponse, bool, error) {
+	mockRepo.Lock()
+	defer mockRepo.Unlock()
+	if stored, ok := mockRepo.Responses[key.Username+"/"+key.Key]; ok {
+		return stored, false, nil
+	}
+	mockRepo.Responses[key.Username+"/"+key.Key] = repo.IdempotentResponse{RequestHash: key.RequestHash}
+	return repo.IdempotentResponse{}, true, nil
+}
+
+func (mockRepo *mockIdempotencyRepo) SaveIdempotentResponse(key repo.IdempotencyKey, response repo.IdempotentResponse) error {
+	mockRepo.Lock()
+	defer mockRepo.Unlock()
+	if mockRepo.SaveErr != nil {
+		return mockRepo.SaveErr
+	}
+	response.RequestHash = key.RequestHash
+	response.Completed = true
+	mockRepo.Responses[key.Username+"/"+key.Key] = response
+	return nil
+}
+
+func (mockRepo *mockIdempotencyRepo) ReleaseIdempotencyKey(key repo.IdempotencyKey) error {
+	mockRepo.Lock()
+	defer mockRepo.Unlock()
+	delete(mockRepo.Responses, key.Username+"/"+key.Key)
+	return nil
+}
+
+func (mockRepo *mockIdempotencyRepo) PurgeIdempotencyKeys(before time.Time) (int64, error) {
+	return 0, nil
+}
+
+func TestMakeIdempotencyMiddleware(t *testing.T) {
+	store := &mockIdempotencyRepo{Responses: make(map[string]repo.IdempotentResponse)}
+	created := 0
+	release := make(chan struct{})
+	router := mux.NewRouter()
+	router.Handle(baseUrl, MakeIdempotencyMiddleware(store, time.Hour)(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("X-Block") != "" {
+			<-release
+		}
+		created++
+		body, _ := ioutil.ReadAll(request.Body)
+		writer.Header().Set("Location", baseUrl+"/"+strconv.Itoa(created))
+		writer.WriteHeader(http.StatusCreated)
+		_, _ = writer.Write(body)
+	}))).Methods("POST")
+
+	send := func(key, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", baseUrl, bytes.NewReader([]byte(body)))
+		if key != "" {
+			req.Header.Set(idempotencyKeyHeader, key)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := send("key-1", `{"name":"Hemd"}`)
+	retry := send("key-1", `{"name":"Hemd"}`)
+	if created != 1 {
+		t.Errorf("expected %v, received %v", 1, created)
+	}
+	if retry.Code != http.StatusCreated || retry.Body.String() != first.Body.String() ||
+		retry.Header().Get("Location") != first.Header().Get("Location") || retry.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Errorf("expected replay of %v, received %v", first, retry)
+	}
+	if status := send("key-1", `{"name":"Jacke"}`).Code; status != http.StatusConflict {
+		t.Errorf(errorMsgStatusCode, status, http.StatusConflict)
+	}
+	send("", `{"name":"Hemd"}`)
+	send("", `{"name":"Hemd"}`)
+	if created != 3 {
+		t.Errorf("expected %v, received %v", 3, created)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		req, _ := http.NewRequest("POST", baseUrl, bytes.NewReader([]byte(`{"name":"Hut"}`)))
+		req.Header.Set(idempotencyKeyHeader, "key-2")
+		req.Header.Set("X-Block", "true")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	for {
+		store.Lock()
+		_, pending := store.Responses["/key-2"]
+		store.Unlock()
+		if pending {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	inFlight := send("key-2", `{"name":"Hut"}`)
+	if inFlight.Code != http.StatusConflict || inFlight.Header().Get("Retry-After") == "" {
+		t.Errorf(errorMsgStatusCode, inFlight.Code, http.StatusConflict)
+	}
+	close(release)
+	<-done
+	if status := send("key-2", `{"name":"Hut"}`).Code; status != http.StatusCreated || created != 4 {
+		t.Errorf(errorMsgStatusCode, status, http.StatusCreated)
+	}
+
+	store.SaveErr = errors.New("connection reset")
+	send("key-3", `{"name":"Schal"}`)
+	store.SaveErr = nil
+	if status := send("key-3", `{"name":"Schal"}`).Code; status != http.StatusCreated || created != 6 {
+		t.Errorf(errorMsgStatusCode, status, http.StatusCreated)
+	}
+}
+
+type mockBatchRepo struct {
+	*mockRepo
+}
+
+func (mockRepo *mockBatchRepo) ApplyProductBatch(operations []repo.ProductOperation, atomic bool) ([]repo.ProductOperationResult, error) {
+	results := make([]repo.ProductOperationResult, len(operations))
+	for index, operation := range operations {
+		result := &results[index]
+		switch operation.Op {
+		case repo.BatchCreate:
+			result.Product, result.Err = mockRepo.AddProduct(operation.Product)
+		case repo.BatchUpdate:
+			result.Product, result.Err = mockRepo.PatchProduct(operation.Id, operation.Version, func(product repo.Product) (repo.Product, error) {
+				product.Name = operation.Product.Name
+				return product, nil
+			})
+		}
+	}
+	return results, nil
+}
+
+func TestMakeProductBatchHandler(t *testing.T) {
+	service := prepareAuthService()
+	router := mux.NewRouter()
+	router.Handle(baseUrl+":batch", MakeProductAuthorizationMiddleware(service)(MakeProductBatchHandler(&mockBatchRepo{&repository}, service))).Methods("POST")
+	send := func(body string) (int, []productBatchResult) {
+		req, _ := http.NewRequest("POST", baseUrl+":batch", bytes.NewReader([]byte(body)))
+		authenticate(req, service)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		response := struct {
+			Results []productBatchResult `json:"results"`
+		}{}
+		_ = json.Unmarshal(rr.Body.Bytes(), &response)
+		return rr.Code, response.Results
+	}
+
+	initMockRepo()
+	status, results := send(`{"operations":[{"op":"create","product":{"name":"Schuhe"}},{"op":"update","id":1,"version":1,"product":{"name":"Jeans"}}]}`)
+	if status != http.StatusOK || len(results) != 2 || results[0].Status != http.StatusCreated || results[0].Product.Id != 2 || results[1].Product.Name != "Jeans" {
+		t.Errorf("unexpected batch result %d %+v", status, results)
+	}
+
+	initMockRepo()
+	status, results = send(`{"operations":[{"op":"create","product":{"name":"Schuhe"}},{"op":"create","product":{"name":"Hut"}}]}`)
+	if status != http.StatusUnprocessableEntity || results[0].Status != http.StatusFailedDependency || results[1].Status != http.StatusUnprocessableEntity {
+		t.Errorf("unexpected batch result %d %+v", status, results)
+	}
+	if len(repository.Products) != 1 {
+		t.Errorf("expected atomic batch not to be applied, got %v", repository.Products)
+	}
+
+	status, results = send(`{"mode":"bestEffort","operations":[{"op":"create","product":{"name":"Schuhe"}},{"op":"update","id":1,"version":4,"product":{"name":"Jeans"}},{"op":"delete","id":1}]}`)
+	if status != http.StatusOK || results[0].Status != http.StatusCreated || results[1].Status != http.StatusPreconditionFailed || results[2].Status != http.StatusForbidden {
+		t.Errorf("unexpected batch result %d %+v", status, results)
+	}
+
+	status, _ = send(`{"mode":"whatever","operations":[{"op":"create","product":{"name":"Schuhe"}}]}`)
+	if status != http.StatusBadRequest {
+		t.Errorf(errorMsgStatusCode, status, http.StatusBadRequest)
+	}
+}
+
+type mockTransferRepo struct {
+	*mockRepo
+}
+
+func (mockRepo *mockTransferRepo) StreamProducts(visit func(repo.Product) error) error {
+	for _, product := range mockRepo.Products {
+		if err := visit(product); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mockRepo *mockTransferRepo) ImportProducts(products []repo.Product, options repo.ImportOptions) ([]repo.ProductOperationResult, error) {
+	if mockRepo.mockRepo == nil {
+		return nil, errors.New("connection refused")
+	}
+	results := make([]repo.ProductOperationResult, len(products))
+	for index, product := range products {
+		if !options.DryRun {
+			results[index].Product, results[index].Err = mockRepo.AddProduct(product)
+		}
+	}
+	return results, nil
+}
+
+func TestMakeProductExportHandler(t *testing.T) {
+	initMockRepo()
+	handler := MakeProductExportHandler(&mockTransferRepo{&repository})
+	tests := []struct {
+		query       string
+		accept      string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"", "", http.StatusOK, "text/csv; charset=UTF-8", "id,sku,name,description,price,brand,stock,tags,attributes\n1,,Hosen,,0,,0,,\n"},
+		{"", "application/x-ndjson", http.StatusOK, "application/x-ndjson", "{\"id\":1,\"name\":\"Hosen\",\"price\":0,\"stock\":0,\"version\":1}\n"},
+		{"?format=xml", "", http.StatusBadRequest, "", ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", baseUrl+"/export"+test.query, nil)
+		req.Header.Set("Accept", test.accept)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != test.status {
+			t.Errorf(errorMsgStatusCode, status, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if contentType := rr.Header().Get("Content-Type"); contentType != test.contentType {
+			t.Errorf("expected %v, received %v", test.contentType, contentType)
+		}
+		if body := rr.Body.String(); body != test.body {
+			t.Errorf(errorMsgResponseBody, body, test.body)
+		}
+	}
+}
+
+func TestMakeProductImportHandler(t *testing.T) {
+	initMockRepo()
+	handler := MakeProductImportHandler(&mockTransferRepo{&repository})
+	req, _ := http.NewRequest("POST", "/admin/products/import?dryRun=true", bytes.NewReader([]byte("name\nSchuhe\nHut\n")))
+	req.Header.Set(contentTypeHeader, "text/csv")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	report := struct {
+		DryRun   bool `json:"dryRun"`
+		Imported int  `json:"imported"`
+		Errors   []struct {
+			Line int `json:"line"`
+		} `json:"errors"`
+	}{}
+	_ = json.Unmarshal(rr.Body.Bytes(), &report)
+	if rr.Code != http.StatusOK || !report.DryRun || report.Imported != 1 || len(report.Errors) != 1 || report.Errors[0].Line != 3 {
+		t.Errorf("unexpected import report %s", rr.Body.String())
+	}
+	if len(repository.Products) != 1 {
+		t.Errorf("expected dry run not to import, got %v", repository.Products)
+	}
+
+	req, _ = http.NewRequest("POST", "/admin/products/import", bytes.NewReader([]byte("name\nSchuhe\n")))
+	req.Header.Set(contentTypeHeader, "application/json")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusUnsupportedMediaType {
+		t.Errorf(errorMsgStatusCode, status, http.StatusUnsupportedMediaType)
+	}
+
+	failures := []struct {
+		handler http.HandlerFunc
+		body    string
+		status  int
+	}{
+		{handler, "title\nSchuhe\n", http.StatusBadRequest},
+		{MakeProductImportHandler(&mockTransferRepo{}), "name\nSchuhe\n", http.StatusInternalServerError},
+	}
+	for _, test := range failures {
+		req, _ = http.NewRequest("POST", "/admin/products/import", bytes.NewReader([]byte(test.body)))
+		req.Header.Set(contentTypeHeader, "text/csv")
+		rr = httptest.NewRecorder()
+		test.handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != test.status {
+			t.Errorf(errorMsgStatusCode, status, test.status)
+		}
+	}
+}
+
+func TestMakeSearchHandler(t *testing.T) {
+	initMockRepo()
+	repository.Products = append(repository.Products,
+		repo.Product{Id: 2, Name: "Regenjacke", Description: "Wasserdichte Jacke mit Kapuze"},
+		repo.Product{Id: 3, Name: "Kapuzenpullover", Description: "Warm"},
+		repo.Product{Id: 4, Name: "Schal", Description: "<img src=x onerror=alert(1)> & mehr"})
+	handler := MakeSearchHandler(&repository)
+	tests := []struct {
+		query    string
+		status   int
+		ids      []int
+		snippets []string
+	}{
+		{"?q=kapu", http.StatusOK, []int{3, 2}, []string{"<mark>Kapuzenpullover</mark> Warm", "Regenjacke Wasserdichte Jacke mit <mark>Kapuze</mark>"}},
+		{"?q=Jacke+kap", http.StatusOK, []int{2}, []string{"Regenjacke Wasserdichte <mark>Jacke</mark> mit <mark>Kapuze</mark>"}},
+		{"?q=kapu&limit=1&offset=1", http.StatusOK, []int{2}, nil},
+		{"?q=socken", http.StatusOK, []int{}, nil},
+		{"?q=img", http.StatusOK, []int{4}, []string{"Schal &lt;<mark>img</mark> src=x onerror=alert(1)&gt; &amp; mehr"}},
+		{"", http.StatusBadRequest, nil, nil},
+		{"?q=hose&limit=1000", http.StatusBadRequest, nil, nil},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/catalog/search"+test.query, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != test.status {
+			t.Errorf(errorMsgStatusCode, status, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		results := make([]repo.SearchResult, 0)
+		_ = json.Unmarshal(rr.Body.Bytes(), &results)
+		if len(results) != len(test.ids) {
+			t.Errorf("expected %v, received %v", test.ids, results)
+			continue
+		}
+		for index, result := range results {
+			if result.Id != test.ids[index] || (test.snippets != nil && result.Snippet != test.snippets[index]) {
+				t.Errorf("expected %v %v, received %+v", test.ids[index], test.snippets, result)
+			}
+		}
+	}
+}
+
+type mockSuggestRepo struct {
+	Suggestions []repo.Suggestion
+}
+
+func (mockRepo *mockSuggestRepo) SuggestProducts(text string, limit int) ([]repo.Suggestion, error) {
+	return mockRepo.Suggestions, nil
+}
+
+func TestMakeSuggestHandler(t *testing.T) {
+	index := suggest.NewIndex()
+	index.Rebuild([]repo.Product{{Id: 1, Name: "Hosen"}, {Id: 2, Name: "Hosenträger"}})
+	similar := &mockSuggestRepo{Suggestions: []repo.Suggestion{{Id: 2, Name: "Hosenträger"}, {Id: 3, Name: "Hemd"}}}
+	handler := MakeSuggestHandler(index, similar)
+	tests := []struct {
+		query    string
+		status   int
+		expected []int
+	}{
+		{"?q=hos", http.StatusOK, []int{1, 2, 3}},
+		{"?q=hos&limit=2", http.StatusOK, []int{1, 2}},
+		{"?q=hsoen", http.StatusOK, []int{2, 3}},
+		{"?q=", http.StatusBadRequest, nil},
+		{"?q=hos&limit=0", http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/catalog/suggest"+test.query, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != test.status {
+			t.Errorf(errorMsgStatusCode, status, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		suggestions := make([]repo.Suggestion, 0)
+		_ = json.Unmarshal(rr.Body.Bytes(), &suggestions)
+		ids := make([]int, len(suggestions))
+		for index, suggestion := range suggestions {
+			ids[index] = suggestion.Id
+		}
+		if len(ids) != len(test.expected) {
+			t.Errorf("expected %v, received %v", test.expected, ids)
+			continue
+		}
+		for index := range ids {
+			if ids[index] != test.expected[index] {
+				t.Errorf("expected %v, received %v", test.expected, ids)
+				break
+			}
+		}
+	}
+}
+
+type mockFacetRepo struct {
+	*mockRepo
+	Filter repo.ProductFilter
+}
+
+func (mockRepo *mockFacetRepo) FilterProducts(filter repo.ProductFilter) (repo.ProductPage, error) {
+	mockRepo.Filter = filter
+	return repo.ProductPage{
+		Products: mockRepo.Products,
+		Total:    len(mockRepo.Products),
+		Facets:   map[string][]repo.FacetCount{repo.FacetBrand: {{Value: "Acme", Count: 1}}},
+	}, nil
+}
+
+func TestMakeAllProductsHandlerFacets(t *testing.T) {
+	initMockRepo()
+	service := prepareAuthService()
+	facets := &mockFacetRepo{mockRepo: &repository}
+
+	req, _ := http.NewRequest("GET", baseUrl+"?brand=Acme&brand=Umbrella&price=10-50&price=500-&inStock=true&category=shoes&tag=sale&attr.color=red&attr.color=blue&limit=5", nil)
+	rr := httptest.NewRecorder()
+	MakeAllProductsHandler(facets, service).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf(errorMsgStatusCode, status, http.StatusOK)
+	}
+	filter := facets.Filter
+	if len(filter.Brands) != 2 || len(filter.PriceRanges) != 2 || filter.PriceRanges[0] != (repo.PriceRange{Min: 1000, Max: 5000}) ||
+		filter.PriceRanges[1] != (repo.PriceRange{Min: 50000}) || filter.InStock == nil || !*filter.InStock || len(filter.Categories) != 1 || len(filter.Tags) != 1 ||
+		len(filter.Attributes["color"]) != 2 || filter.Limit != 5 {
+		t.Errorf("unexpected filter %+v", filter)
+	}
+	page := repo.ProductPage{}
+	_ = json.Unmarshal(rr.Body.Bytes(), &page)
+	if page.Total != 1 || len(page.Facets[repo.FacetBrand]) != 1 {
+		t.Errorf("unexpected page %+v", page)
+	}
+
+	for _, test := range []struct {
+		repository repo.ProductRepository
+		query      string
+		status     int
+	}{
+		{facets, "?price=50-10", http.StatusBadRequest},
+		{facets, "?inStock=maybe", http.StatusBadRequest},
+		{&repository, "?attr.size=42", http.StatusNotImplemented},
+		{&repository, "?facets", http.StatusNotImplemented},
+		{&repository, "", http.StatusOK},
+	} {
+		req, _ = http.NewRequest("GET", baseUrl+test.query, nil)
+		rr = httptest.NewRecorder()
+		MakeAllProductsHandler(test.repository, service).ServeHTTP(rr, req)
+		if status := rr.Code; status != test.status {
+			t.Errorf(errorMsgStatusCode, status, test.status)
+		}
+	}
+}
+
+type mockCategoryRepo struct {
+	Items       []repo.Category
+	Assigned    map[int][]int
+	Descendants bool
+}
+
+func (mockRepo *mockCategoryRepo) Categories() ([]repo.Category, error) {
+	return append([]repo.Category(nil), mockRepo.Items...), nil
+}
+
+func (mockRepo *mockCategoryRepo) GetCategory(id int) (repo.Category, error) {
+	for _, category := range mockRepo.Items {
+		if category.Id == id {
+			return category, nil
+		}
+	}
+	return repo.Category{}, repo.ErrCategoryNotFound
+}
+
+func (mockRepo *mockCategoryRepo) SaveCategory(category repo.Category) (repo.Category, error) {
+	for _, existing := range mockRepo.Items {
+		if existing.Slug == category.Slug && existing.Id != category.Id {
+			return repo.Category{}, repo.ErrDuplicateSlug
+		}
+	}
+	category.Id = len(mockRepo.Items) + 1
+	mockRepo.Items = append(mockRepo.Items, category)
+	return category, nil
+}
+
+func (mockRepo *mockCategoryRepo) MoveCategory(id int, parentId *int, position int) (repo.Category, error) {
+	for parent := parentId; parent != nil; {
+		if *parent == id {
+			return repo.Category{}, repo.ErrCategoryCycle
+		}
+		category, err := mockRepo.GetCategory(*parent)
+		if err != nil {
+			return repo.Category{}, err
+		}
+		parent = category.ParentId
+	}
+	for index := range mockRepo.Items {
+		if mockRepo.Items[index].Id == id {
+			mockRepo.Items[index].ParentId, mockRepo.Items[index].Position = parentId, position
+			return mockRepo.Items[index], nil
+		}
+	}
+	return repo.Category{}, repo.ErrCategoryNotFound
+}
+
+func (mockRepo *mockCategoryRepo) RemoveCategory(id int) error {
+	return repo.ErrCategoryNotEmpty
+}
+
+func (mockRepo *mockCategoryRepo) CategoryProducts(id int, descendants bool) ([]repo.Product, error) {
+	mockRepo.Descendants = descendants
+	if _, err := mockRepo.GetCategory(id); err != nil {
+		return nil, err
+	}
+	return repository.Products, nil
+}
+
+func (mockRepo *mockCategoryRepo) ProductCategories(productId int) ([]repo.Category, error) {
+	categories := make([]repo.Category, 0)
+	for _, id := range mockRepo.Assigned[productId] {
+		category, _ := mockRepo.GetCategory(id)
+		categories = append(categories, category)
+	}
+	return categories, nil
+}
+
+func (mockRepo *mockCategoryRepo) SetProductCategories(productId int, categoryIds []int) error {
+	mockRepo.Assigned[productId] = categoryIds
+	return nil
+}
+
+func TestMakeCategoriesHandler(t *testing.T) {
+	initMockRepo()
+	categories := &mockCategoryRepo{Assigned: make(map[int][]int)}
+	router := mux.NewRouter()
+	router.HandleFunc("/catalog/categories", MakeCategoriesHandler(categories)).Methods("GET", "POST")
+	router.HandleFunc("/catalog/categories/{id}", MakeCategoryHandler(categories)).Methods("GET", "PUT", "DELETE")
+	router.HandleFunc("/catalog/categories/{id}/move", MakeMoveCategoryHandler(categories)).Methods("POST")
+	router.HandleFunc("/catalog/categories/{id}/products", MakeCategoryProductsHandler(categories)).Methods("GET")
+	router.HandleFunc(baseUrl+"/{id}/categories", MakeProductCategoriesHandler(categories)).Methods("GET", "PUT")
+
+	for _, test := range []struct {
+		method string
+		url    string
+		body   string
+		status int
+	}{
+		{"POST", "/catalog/categories", `{"name":"Clothing & Shoes"}`, http.StatusCreated},
+		{"POST", "/catalog/categories", `{"name":"Boots","parentId":1}`, http.StatusCreated},
+		{"POST", "/catalog/categories", `{"name":"Other","slug":"clothing-shoes"}`, http.StatusConflict},
+		{"POST", "/catalog/categories", `{"name":"Other","slug":"Not A Slug"}`, http.StatusUnprocessableEntity},
+		{"POST", "/catalog/categories/1/move", `{"parentId":2}`, http.StatusConflict},
+		{"POST", "/catalog/categories/1/move", `{"parentId":1}`, http.StatusConflict},
+		{"POST", "/catalog/categories/2/move", `{"parentId":null,"position":1}`, http.StatusOK},
+		{"POST", "/catalog/categories/2/move", `{"parentId":1}`, http.StatusOK},
+		{"DELETE", "/catalog/categories/1", "", http.StatusConflict},
+		{"GET", "/catalog/categories/3", "", http.StatusNotFound},
+		{"PUT", baseUrl + "/1/categories", "[2, 2]", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(test.method, test.url, bytes.NewBufferString(test.body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != test.status {
+			t.Errorf("%s %s: "+errorMsgStatusCode, test.method, test.url, status, test.status)
+		}
+	}
+	if first := categories.Items[0]; first.Slug != "clothing-shoes" {
+		t.Errorf("expected %v, received %v", "clothing-shoes", first.Slug)
+	}
+	if assigned := categories.Assigned[1]; len(assigned) != 1 || assigned[0] != 2 {
+		t.Errorf("expected %v, received %v", []int{2}, assigned)
+	}
+
+	req, _ := http.NewRequest("GET", "/catalog/categories", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	expected := `[{"id":1,"parentId":null,"slug":"clothing-shoes","name":"Clothing \u0026 Shoes","position":0,` +
+		`"children":[{"id":2,"parentId":1,"slug":"boots","name":"Boots","position":0}]}]`
+	if body := rr.Body.String(); body != expected {
+		t.Errorf(errorMsgResponseBody, body, expected)
+	}
+
+	req, _ = http.NewRequest("GET", "/catalog/categories/1/products?descendants=false", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK || categories.Descendants {
+		t.Errorf(errorMsgStatusCode, status, http.StatusOK)
+	}
+}
+
+type mockAttributeRepo struct {
+	Definitions []repo.AttributeDefinition
+}
+
+func (mockRepo *mockAttributeRepo) AttributeDefinitions() ([]repo.AttributeDefinition, error) {
+	return mockRepo.Definitions, nil
+}
+
+func (mockRepo *mockAttributeRepo) SaveAttributeDefinition(definition repo.AttributeDefinition) (repo.AttributeDefinition, error) {
+	for index, existing := range mockRepo.Definitions {
+		if existing.Name == definition.Name {
+			if existing.Type != definition.Type {
+				return repo.AttributeDefinition{}, repo.ErrAttributeInUse
+			}
+			mockRepo.Definitions[index] = definition
+			return definition, nil
+		}
+	}
+	mockRepo.Definitions = append(mockRepo.Definitions, definition)
+	return definition, nil
+}
+
+func (mockRepo *mockAttributeRepo) RemoveAttributeDefinition(name string) error {
+	for index, existing := range mockRepo.Definitions {
+		if existing.Name == name {
+			mockRepo.Definitions = append(mockRepo.Definitions[:index], mockRepo.Definitions[index+1:]...)
+			return nil
+		}
+	}
+	return repo.ErrAttributeNotFound
+}
+
+func TestMakeAttributeDefinitionHandler(t *testing.T) {
+	attributes := &mockAttributeRepo{}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/attributes", MakeAttributeDefinitionsHandler(attributes)).Methods("GET")
+	router.HandleFunc("/admin/attributes/{name}", MakeAttributeDefinitionHandler(attributes)).Methods("PUT", "DELETE")
+
+	for _, test := range []struct {
+		method string
+		url    string
+		body   string
+		status int
+	}{
+		{"PUT", "/admin/attributes/color", `{"type":"enum","values":["red","blue"]}`, http.StatusOK},
+		{"PUT", "/admin/attributes/size", `{"type":"number"}`, http.StatusOK},
+		{"PUT", "/admin/attributes/size", `{"type":"string"}`, http.StatusConflict},
+		{"PUT", "/admin/attributes/weight", `{"type":"number","values":["1"]}`, http.StatusUnprocessableEntity},
+		{"PUT", "/admin/attributes/material", `{"type":"enum","values":["wool","wool"]}`, http.StatusUnprocessableEntity},
+		{"PUT", "/admin/attributes/material", `{"type":"date"}`, http.StatusUnprocessableEntity},
+		{"PUT", "/admin/attributes/Material", `{"type":"string"}`, http.StatusUnprocessableEntity},
+		{"PUT", "/admin/attributes/material", `not json`, http.StatusBadRequest},
+		{"DELETE", "/admin/attributes/size", "", http.StatusNoContent},
+		{"DELETE", "/admin/attributes/size", "", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest(test.method, test.url, bytes.NewBufferString(test.body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != test.status {
+			t.Errorf("%s %s: "+errorMsgStatusCode, test.method, test.url, status, test.status)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/admin/attributes", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	expected := `[{"name":"color","type":"enum","values":["red","blue"]}]`
+	if body := rr.Body.String(); body != expected {
+		t.Errorf(errorMsgResponseBody, body, expected)
+	}
+}
+
+func TestValidateAttributes(t *testing.T) {
+	definitions := []repo.AttributeDefinition{
+		{Name: "color", Type: repo.AttributeEnum, Values: []string{"red", "blue"}},
+		{Name: "size", Type: repo.AttributeNumber},
+		{Name: "organic", Type: repo.AttributeBoolean},
+		{Name: "material", Type: repo.AttributeString},
+	}
+	for _, test := range []struct {
+		attributes map[string]interface{}
+		valid      bool
+	}{
+		{map[string]interface{}{"color": "red", "size": 42.0, "organic": true, "material": "wool"}, true},
+		{map[string]interface{}{"color": "green"}, false},
+		{map[string]interface{}{"size": "42"}, false},
+		{map[string]interface{}{"organic": "yes"}, false},
+		{map[string]interface{}{"material": 1.0}, false},
+		{map[string]interface{}{"weight": 1.0}, false},
+	} {
+		err := repo.ValidateAttributes(definitions, test.attributes)
+		_, rejected := err.(*repo.AttributeError)
+		if (err == nil) != test.valid || rejected == test.valid {
+			t.Errorf("%v: expected valid %v, received %v", test.attributes, test.valid, err)
+		}
+	}
+}
+
+func TestMakeProductsHandlerPUTInvalidTags(t *testing.T) {
+	initMockRepo()
+	for _, tags := range [][]string{{""}, {" sale"}, {strings.Repeat("x", 65)}} {
+		body, _ := json.Marshal(repo.Product{Name: "Hemd", Tags: tags})
+		req, _ := http.NewRequest("PUT", baseUrl+"/1", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		initRouter(MakeProductsHandler(&repository), "PUT").ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf(errorMsgStatusCode, status, http.StatusBadRequest)
+		}
+	}
+}
+
+type mockAuthorizationServer struct {
+	auth.AuthorizationServer
+}
+
+func (server *mockAuthorizationServer) ValidateAuthorizationRequest(request auth.AuthorizationRequest) (repo.OAuthClient, []string, error) {
+	return repo.OAuthClient{ClientId: request.ClientId, Name: "Shop"}, []string{auth.ScopeProductsRead}, nil
+}
+
+func (server *mockAuthorizationServer) Authorize(username string, request auth.AuthorizationRequest) (string, error) {
+	return "code-for-" + username, nil
+}
+
+func TestMakeAuthorizeHandlerRequiresCSRFToken(t *testing.T) {
+	handler := MakeAuthorizeHandler(&mockAuthorizationServer{})
+	query := "/oauth/authorize?response_type=code&client_id=shop&redirect_uri=https://shop.example/cb&state=xyz"
+
+	req, _ := http.NewRequest("GET", query, nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	consent := consentResponse{}
+	_ = json.Unmarshal(rr.Body.Bytes(), &consent)
+	cookies := rr.Result().Cookies()
+	if consent.CSRFToken == "" || len(cookies) != 1 || cookies[0].Value != consent.CSRFToken || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Fatalf("expected a csrf token and matching cookie, received %+v and %+v", consent, cookies)
+	}
+
+	for _, test := range []struct {
+		cookie bool
+		token  string
+		status int
+	}{
+		{false, consent.CSRFToken, http.StatusForbidden},
+		{true, "", http.StatusForbidden},
+		{true, "forged", http.StatusForbidden},
+		{true, consent.CSRFToken, http.StatusFound},
+	} {
+		form := "approve=true&csrf_token=" + test.token
+		req, _ = http.NewRequest("POST", query, bytes.NewBufferString(form))
+		req.Header.Set(contentTypeHeader, "application/x-www-form-urlencoded")
+		if test.cookie {
+			req.AddCookie(cookies[0])
+		}
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != test.status {
+			t.Errorf(errorMsgStatusCode, status, test.status)
+		}
+	}
+	if location := rr.Header().Get("Location"); !strings.Contains(location, "code=code-for-") {
+		t.Errorf("expected a code in %v", location)
+	}
+}
+
+func TestWriteAdminResult(t *testing.T) {
+	tests := map[error]int{
+		nil:                        http.StatusNoContent,
+		auth.ErrUnknownRole:        http.StatusBadRequest,
+		auth.ErrProtectedRole:      http.StatusConflict,
+		repo.ErrUserNotFound:       http.StatusNotFound,
+		repo.ErrRoleNotFound:       http.StatusNotFound,
+		errors.New("conn refused"): http.StatusInternalServerError,
+	}
+	for err, expected := range tests {
+		rr := httptest.NewRecorder()
+		writeAdminResult(rr, err)
+		if status := rr.Code; status != expected {
+			t.Errorf(errorMsgStatusCode, status, expected)
+		}
+	}
+}
+
+func TestMakeRegisterHandlerInvalidEmail(t *testing.T) {
+	body := []byte(`{"username":"hugo","password":"test","email":"not an address"}`)
+	req, _ := http.NewRequest("POST", "/register", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	MakeRegisterHandler(prepareAuthService()).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf(errorMsgStatusCode, status, http.StatusBadRequest)
+	}
+	if rr.Body.String() != auth.ErrInvalidEmail.Error() {
+		t.Errorf(errorMsgResponseBody, rr.Body.String(), auth.ErrInvalidEmail.Error())
+	}
+}
+
+func TestMakeAuditMiddlewareProfile(t *testing.T) {
+	audit := &mockAuditRepo{}
+	service := prepareAuthService()
+	router := mux.NewRouter()
+	router.Handle("/me", MakeAuthenticationMiddleware(service)(MakeAuditMiddleware(audit, ProfileSnapshot(service))(MakeProfileHandler(service)))).Methods("PATCH", "DELETE")
+
+	req, _ := http.NewRequest("PATCH", "/me", bytes.NewReader([]byte(`{"email":"hugo@example.com"}`)))
+	authenticate(req, service)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	after := repo.User{}
+	if len(audit.Entries) != 1 || json.Unmarshal(audit.Entries[0].After, &after) != nil || after.Email != "hugo@example.com" {
+		t.Errorf("unexpected audit entries %+v", audit.Entries)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/me", nil)
+	authenticate(req, service)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if len(audit.Entries) != 2 || audit.Entries[1].After != nil || len(audit.Entries[1].Before) == 0 {
+		t.Errorf("unexpected audit entries %+v", audit.Entries)
+	}
+}
+
+func TestMakeAuditLogHandlerExport(t *testing.T) {
+	audit := &mockAuditRepo{}
+	for id := 1; id <= auditExportBatch*2+10; id++ {
+		audit.Entries = append(audit.Entries, repo.AuditEntry{Id: id})
+	}
+	req, _ := http.NewRequest("GET", "/admin/audit?format=jsonl", nil)
+	rr := httptest.NewRecorder()
+	MakeAuditLogHandler(audit).ServeHTTP(rr, req)
+	seen := make(map[int]bool)
+	decoder := json.NewDecoder(rr.Body)
+	for decoder.More() {
+		entry := repo.AuditEntry{}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		if seen[entry.Id] {
+			t.Errorf("entry %d exported twice", entry.Id)
+		}
+		seen[entry.Id] = true
+	}
+	if len(seen) != auditExportBatch*2+10 {
+		t.Errorf("expected %v, received %v", auditExportBatch*2+10, len(seen))
+	}
+}
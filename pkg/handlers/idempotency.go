@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gorilla/mux"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	maxIdempotentRequestBytes = 1 << 20
+)
+
+type responseRecorder struct {
+	statusRecorder
+	body bytes.Buffer
+}
+
+func (recorder *responseRecorder) Write(body []byte) (int, error) {
+	recorder.body.Write(body)
+	return recorder.statusRecorder.Write(body)
+}
+
+func MakeIdempotencyMiddleware(store repo.IdempotencyRepository, window time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			idempotencyKey := request.Header.Get(idempotencyKeyHeader)
+			if request.Method != "POST" || idempotencyKey == "" {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			if len(idempotencyKey) > maxIdempotencyKeyLength {
+				writer.WriteHeader(http.StatusBadRequest)
+				_, _ = writer.Write([]byte("invalid Idempotency-Key header"))
+				return
+			}
+			body, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, maxIdempotentRequestBytes))
+			if err != nil {
+				writer.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			request.Body = ioutil.NopCloser(bytes.NewReader(body))
+			key := repo.IdempotencyKey{
+				Username:    usernameFromRequest(request),
+				Key:         idempotencyKey,
+				RequestHash: requestHash(request, body),
+			}
+			stored, reserved, err := store.ReserveIdempotencyKey(key, time.Now().Add(-window))
+			if err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				log.Print(err)
+				return
+			}
+			if !reserved {
+				replayResponse(writer, key, stored)
+				return
+			}
+			recorder := &responseRecorder{statusRecorder: statusRecorder{ResponseWriter: writer}}
+			defer func() {
+				if recorder.status == 0 || recorder.status >= http.StatusInternalServerError {
+					if err := store.ReleaseIdempotencyKey(key); err != nil {
+						log.Print(err)
+					}
+				}
+			}()
+			next.ServeHTTP(recorder, request)
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+			if recorder.status >= http.StatusInternalServerError {
+				return
+			}
+			response := repo.IdempotentResponse{
+				Status: recorder.status,
+				Header: writer.Header().Clone(),
+				Body:   recorder.body.Bytes(),
+			}
+			delete(response.Header, "Set-Cookie")
+			delete(response.Header, requestIdHeader)
+			if err = store.SaveIdempotentResponse(key, response); err != nil {
+				log.Print(err)
+				// a reservation that is never completed would answer every
+				// retry with 409 until the key expires
+				if err = store.ReleaseIdempotencyKey(key); err != nil {
+					log.Print(err)
+				}
+			}
+		})
+	}
+}
+
+func replayResponse(writer http.ResponseWriter, key repo.IdempotencyKey, stored repo.IdempotentResponse) {
+	if stored.RequestHash != key.RequestHash {
+		writer.WriteHeader(http.StatusConflict)
+		_, _ = writer.Write([]byte("Idempotency-Key was already used for a different request"))
+		return
+	}
+	if !stored.Completed {
+		writer.Header().Set("Retry-After", "1")
+		writer.WriteHeader(http.StatusConflict)
+		_, _ = writer.Write([]byte("a request with this Idempotency-Key is still in progress"))
+		return
+	}
+	for name, values := range stored.Header {
+		writer.Header()[name] = values
+	}
+	writer.Header().Set(idempotentReplayedHeader, "true")
+	writer.WriteHeader(stored.Status)
+	_, _ = writer.Write(stored.Body)
+}
+
+func requestHash(request *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(request.Method + " " + request.URL.Path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
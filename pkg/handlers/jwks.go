@@ -0,0 +1,18 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/segfaultx/simple_rest/pkg/auth"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func MakeJWKSHandler(service auth.AuthenticationService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		resp, _ := json.Marshal(service.JWKS())
+		writer.Header().Set("Content-Type", "application/jwk-set+json")
+		writer.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(auth.JWKSMaxAge/time.Second)))
+		_, _ = writer.Write(resp)
+	}
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"context"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/segfaultx/simple_rest/pkg/auth"
+	"net/http"
+)
+
+type contextKey string
+
+const (
+	tokenContextKey contextKey = "token"
+	apiKeyHeader               = "X-API-Key"
+	bearerPrefix               = "Bearer "
+)
+
+var productPermissions = map[string]string{
+	"GET":    auth.PermissionProductsRead,
+	"POST":   auth.PermissionProductsWrite,
+	"PUT":    auth.PermissionProductsWrite,
+	"PATCH":  auth.PermissionProductsWrite,
+	"DELETE": auth.PermissionProductsDelete,
+}
+
+func MakeAuthenticationMiddleware(service auth.AuthenticationService) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			token, err := checkUserAuthentication(request, service)
+			if err != nil {
+				writer.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if isCookieAuthenticated(request) {
+				refreshedToken, err := service.RefreshToken(token)
+				if err != nil {
+					writer.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				addCookieToRequest(writer, refreshedToken)
+			}
+			ctx := context.WithValue(request.Context(), tokenContextKey, token)
+			next.ServeHTTP(writer, request.WithContext(ctx))
+		})
+	}
+}
+
+func RequireInteractiveSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if isDelegatedToken(tokenFromRequest(request)) {
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+func MakeProductAuthorizationMiddleware(service auth.AuthenticationService) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			token, err := checkUserAuthentication(request, service)
+			if err != nil {
+				if request.Method == "GET" {
+					next.ServeHTTP(writer, request)
+					return
+				}
+				writer.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			permission := productPermissions[request.Method]
+			if !hasScope(token, permission) || !service.Authorize(token, permission) {
+				writer.WriteHeader(http.StatusForbidden)
+				return
+			}
+			ctx := context.WithValue(request.Context(), tokenContextKey, token)
+			next.ServeHTTP(writer, request.WithContext(ctx))
+		})
+	}
+}
+
+func RequirePermission(service auth.AuthenticationService, permission string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if !service.Authorize(tokenFromRequest(request), permission) {
+				writer.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+func tokenFromRequest(request *http.Request) *jwt.Token {
+	token, _ := request.Context().Value(tokenContextKey).(*jwt.Token)
+	return token
+}
+
+func usernameFromRequest(request *http.Request) string {
+	claims, ok := auth.ClaimsFromToken(tokenFromRequest(request))
+	if !ok {
+		return ""
+	}
+	return claims.Subject
+}
+
+func isDelegatedToken(token *jwt.Token) bool {
+	claims, ok := auth.ClaimsFromToken(token)
+	return !ok || claims.APIKeyId != 0 || claims.ClientId != ""
+}
+
+func isCookieAuthenticated(request *http.Request) bool {
+	return request.Header.Get(apiKeyHeader) == "" && request.Header.Get("Authorization") == ""
+}
+
+func hasScope(token *jwt.Token, scope string) bool {
+	claims, ok := auth.ClaimsFromToken(token)
+	if !ok {
+		return false
+	}
+	if claims.APIKeyId == 0 && claims.ClientId == "" && claims.Scopes == nil {
+		return true
+	}
+	for _, granted := range claims.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
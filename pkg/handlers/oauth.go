@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/segfaultx/simple_rest/pkg/auth"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// consentCookie holds the CSRF token of a consent page. The approving POST
+// has to echo it in the csrf_token form field.
+const consentCookie = "consent_csrf"
+
+type consentResponse struct {
+	Client    string   `json:"client"`
+	Scopes    []string `json:"scopes"`
+	CSRFToken string   `json:"csrfToken"`
+}
+
+type registeredClientResponse struct {
+	Client       repo.OAuthClient `json:"client"`
+	ClientSecret string           `json:"clientSecret,omitempty"`
+}
+
+func MakeClientRegistrationHandler(server auth.AuthorizationServer) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		owner := usernameFromRequest(request)
+		switch request.Method {
+		case "GET":
+			clients, err := server.ListClients(owner)
+			if err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				log.Print(err)
+				return
+			}
+			resp, _ := json.Marshal(clients)
+			setDefaultHeader(writer)
+			_, _ = writer.Write(resp)
+		case "POST":
+			clientRequest := auth.ClientRequest{}
+			if err := decodeRequestBody(&clientRequest, request); err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			client, secret, err := server.RegisterClient(owner, clientRequest)
+			if err != nil {
+				writeOAuthError(writer, err)
+				return
+			}
+			resp, _ := json.Marshal(registeredClientResponse{Client: client, ClientSecret: secret})
+			setDefaultHeader(writer)
+			writer.WriteHeader(http.StatusCreated)
+			_, _ = writer.Write(resp)
+		}
+	}
+}
+
+func MakeAuthorizeHandler(server auth.AuthorizationServer) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if err := request.ParseForm(); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		authRequest := auth.AuthorizationRequest{
+			ResponseType:        request.Form.Get("response_type"),
+			ClientId:            request.Form.Get("client_id"),
+			RedirectURI:         request.Form.Get("redirect_uri"),
+			Scope:               request.Form.Get("scope"),
+			State:               request.Form.Get("state"),
+			CodeChallenge:       request.Form.Get("code_challenge"),
+			CodeChallengeMethod: request.Form.Get("code_challenge_method"),
+		}
+		client, scopes, err := server.ValidateAuthorizationRequest(authRequest)
+		if err != nil {
+			if client.ClientId == "" {
+				writeOAuthError(writer, err)
+				return
+			}
+			redirectWithParams(writer, request, authRequest.RedirectURI, oauthErrorParams(err, authRequest.State))
+			return
+		}
+		if request.Method == "GET" {
+			csrfToken := make([]byte, 32)
+			if _, err = rand.Read(csrfToken); err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				log.Print(err)
+				return
+			}
+			encoded := base64.RawURLEncoding.EncodeToString(csrfToken)
+			http.SetCookie(writer, &http.Cookie{Name: consentCookie,
+				Value:    encoded,
+				HttpOnly: true,
+				Secure:   SecureCookies,
+				SameSite: http.SameSiteStrictMode,
+				Path:     request.URL.Path})
+			resp, _ := json.Marshal(consentResponse{Client: client.Name, Scopes: scopes, CSRFToken: encoded})
+			setDefaultHeader(writer)
+			_, _ = writer.Write(resp)
+			return
+		}
+		if !validConsentToken(request) {
+			writer.WriteHeader(http.StatusForbidden)
+			_, _ = writer.Write([]byte("missing or invalid csrf_token"))
+			return
+		}
+		http.SetCookie(writer, &http.Cookie{Name: consentCookie, Value: "", MaxAge: -1, Path: request.URL.Path})
+		if request.PostForm.Get("approve") != "true" {
+			redirectWithParams(writer, request, authRequest.RedirectURI, url.Values{"error": {"access_denied"}, "state": {authRequest.State}})
+			return
+		}
+		code, err := server.Authorize(usernameFromRequest(request), authRequest)
+		if err != nil {
+			writeOAuthError(writer, err)
+			return
+		}
+		redirectWithParams(writer, request, authRequest.RedirectURI, url.Values{"code": {code}, "state": {authRequest.State}})
+	}
+}
+
+func validConsentToken(request *http.Request) bool {
+	cookie, err := request.Cookie(consentCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(request.PostForm.Get("csrf_token"))) == 1
+}
+
+func MakeTokenHandler(server auth.AuthorizationServer) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if err := request.ParseForm(); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		clientId, clientSecret := clientCredentials(request)
+		response, err := server.ExchangeToken(auth.TokenRequest{
+			GrantType:    request.PostForm.Get("grant_type"),
+			ClientId:     clientId,
+			ClientSecret: clientSecret,
+			Code:         request.PostForm.Get("code"),
+			RedirectURI:  request.PostForm.Get("redirect_uri"),
+			CodeVerifier: request.PostForm.Get("code_verifier"),
+			Scope:        request.PostForm.Get("scope"),
+		})
+		if err != nil {
+			writeOAuthError(writer, err)
+			return
+		}
+		resp, _ := json.Marshal(response)
+		setDefaultHeader(writer)
+		writer.Header().Set("Cache-Control", "no-store")
+		_, _ = writer.Write(resp)
+	}
+}
+
+func MakeIntrospectionHandler(server auth.AuthorizationServer) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if err := request.ParseForm(); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		clientId, clientSecret := clientCredentials(request)
+		introspection, err := server.Introspect(clientId, clientSecret, request.PostForm.Get("token"))
+		if err != nil {
+			writeOAuthError(writer, err)
+			return
+		}
+		resp, _ := json.Marshal(introspection)
+		setDefaultHeader(writer)
+		_, _ = writer.Write(resp)
+	}
+}
+
+func MakeRevocationHandler(server auth.AuthorizationServer) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if err := request.ParseForm(); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		clientId, clientSecret := clientCredentials(request)
+		err := server.Revoke(clientId, clientSecret, request.PostForm.Get("token"))
+		if err != nil {
+			writeOAuthError(writer, err)
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+	}
+}
+
+func clientCredentials(request *http.Request) (string, string) {
+	if clientId, clientSecret, ok := request.BasicAuth(); ok {
+		id, _ := url.QueryUnescape(clientId)
+		secret, _ := url.QueryUnescape(clientSecret)
+		return id, secret
+	}
+	return request.PostForm.Get("client_id"), request.PostForm.Get("client_secret")
+}
+
+func writeOAuthError(writer http.ResponseWriter, err error) {
+	oauthErr, ok := err.(*auth.OAuthError)
+	if !ok {
+		writer.WriteHeader(http.StatusInternalServerError)
+		log.Print(err)
+		return
+	}
+	if oauthErr.Status == http.StatusUnauthorized {
+		writer.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	resp, _ := json.Marshal(oauthErr)
+	setDefaultHeader(writer)
+	writer.WriteHeader(oauthErr.Status)
+	_, _ = writer.Write(resp)
+}
+
+func oauthErrorParams(err error, state string) url.Values {
+	params := url.Values{"error": {"server_error"}, "state": {state}}
+	if oauthErr, ok := err.(*auth.OAuthError); ok {
+		params.Set("error", oauthErr.Code)
+		params.Set("error_description", oauthErr.Description)
+	}
+	return params
+}
+
+func redirectWithParams(writer http.ResponseWriter, request *http.Request, target string, params url.Values) {
+	separator := "?"
+	if strings.Contains(target, "?") {
+		separator = "&"
+	}
+	http.Redirect(writer, request, target+separator+params.Encode(), http.StatusFound)
+}
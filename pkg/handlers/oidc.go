@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/segfaultx/simple_rest/pkg/auth"
+	"log"
+	"net/http"
+	"time"
+)
+
+const oidcStateCookie = "oidc_state"
+
+func MakeOIDCLoginHandler(service auth.AuthenticationService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		redirectToIdentityProvider(service, writer, request, "")
+	}
+}
+
+func MakeOIDCLinkHandler(service auth.AuthenticationService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		redirectToIdentityProvider(service, writer, request, usernameFromRequest(request))
+	}
+}
+
+func redirectToIdentityProvider(service auth.AuthenticationService, writer http.ResponseWriter, request *http.Request, linkUser string) {
+	target, state, err := service.OIDCAuthorizationURL(linkUser)
+	if err == auth.ErrOIDCNotConfigured {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		log.Print(err)
+		return
+	}
+	http.SetCookie(writer, &http.Cookie{Name: oidcStateCookie,
+		Value:    state,
+		Expires:  time.Now().Add(10 * time.Minute),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/login/oidc"})
+	http.Redirect(writer, request, target, http.StatusFound)
+}
+
+func MakeOIDCCallbackHandler(service auth.AuthenticationService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		query := request.URL.Query()
+		if query.Get("error") != "" {
+			writer.WriteHeader(http.StatusUnauthorized)
+			_, _ = writer.Write([]byte(query.Get("error")))
+			return
+		}
+		stateCookie, err := request.Cookie(oidcStateCookie)
+		if err != nil || stateCookie.Value != query.Get("state") {
+			writer.WriteHeader(http.StatusBadRequest)
+			_, _ = writer.Write([]byte(auth.ErrInvalidOIDCState.Error()))
+			return
+		}
+		http.SetCookie(writer, &http.Cookie{Name: oidcStateCookie, Value: "", MaxAge: -1, Path: "/login/oidc"})
+		token, err := service.OIDCLogin(query.Get("state"), query.Get("code"))
+		if err == auth.ErrInvalidOIDCState || err == auth.ErrInvalidIDToken {
+			writer.WriteHeader(http.StatusUnauthorized)
+			_, _ = writer.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			log.Print(err)
+			return
+		}
+		addCookieToRequest(writer, token)
+		writer.WriteHeader(http.StatusOK)
+		_, _ = writer.Write([]byte(token))
+	}
+}
+
+func MakeIdentitiesHandler(service auth.AuthenticationService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		identities, err := service.LinkedIdentities(usernameFromRequest(request))
+		if err == auth.ErrOIDCNotConfigured {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			log.Print(err)
+			return
+		}
+		resp, _ := json.Marshal(identities)
+		setDefaultHeader(writer)
+		_, _ = writer.Write(resp)
+	}
+}
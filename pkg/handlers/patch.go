@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/segfaultx/simple_rest/pkg/patch"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+)
+
+const maxPatchBytes = 1 << 16
+
+var errReadOnlyField = errors.New("id and version are read-only")
+
+type invalidProductError struct {
+	err error
+}
+
+func (err *invalidProductError) Error() string {
+	return err.err.Error()
+}
+
+func handlePatch(repository repo.ProductRepository, writer http.ResponseWriter, request *http.Request, id int) {
+	version, err := expectedVersion(request)
+	if err != nil {
+		writer.WriteHeader(http.StatusPreconditionFailed)
+		_, _ = writer.Write([]byte(err.Error()))
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	var apply func(document, patchDocument []byte) ([]byte, error)
+	switch mediaType {
+	case patch.MergePatchType:
+		apply = patch.Merge
+	case patch.JSONPatchType:
+		apply = patch.Apply
+	default:
+		writer.Header().Set("Accept-Patch", patch.MergePatchType+", "+patch.JSONPatchType)
+		writer.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	patchDocument, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, maxPatchBytes))
+	if err != nil {
+		writer.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	product, err := repository.PatchProduct(id, version, func(current repo.Product) (repo.Product, error) {
+		document, _ := json.Marshal(current)
+		patched, err := apply(document, patchDocument)
+		if err != nil {
+			return repo.Product{}, err
+		}
+		product := repo.Product{}
+		decoder := json.NewDecoder(bytes.NewReader(patched))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(&product); err != nil {
+			return repo.Product{}, &invalidProductError{err}
+		}
+		if product.Id != current.Id || product.Version != current.Version || product.DeletedAt != nil {
+			return repo.Product{}, &invalidProductError{errReadOnlyField}
+		}
+		if err = repo.ValidateProduct(product); err != nil {
+			return repo.Product{}, &invalidProductError{err}
+		}
+		return product, nil
+	})
+	switch {
+	case err == nil:
+	case err == repo.ErrVersionConflict:
+		writer.WriteHeader(http.StatusPreconditionFailed)
+		_, _ = writer.Write([]byte(err.Error()))
+		return
+	case err == repo.ErrDuplicateSku:
+		writer.WriteHeader(http.StatusConflict)
+		_, _ = writer.Write([]byte(err.Error()))
+		return
+	case err == repo.ErrProductNotFound:
+		writer.WriteHeader(http.StatusNotFound)
+		_, _ = writer.Write([]byte(err.Error()))
+		return
+	case err == patch.ErrInvalidPatch:
+		writer.WriteHeader(http.StatusBadRequest)
+		_, _ = writer.Write([]byte(err.Error()))
+		return
+	case err == patch.ErrTestFailed:
+		writer.WriteHeader(http.StatusConflict)
+		_, _ = writer.Write([]byte(err.Error()))
+		return
+	default:
+		var pathErr *patch.PathError
+		var invalidErr *invalidProductError
+		var attributeErr *repo.AttributeError
+		if errors.As(err, &pathErr) || errors.As(err, &invalidErr) || errors.As(err, &attributeErr) {
+			writer.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = writer.Write([]byte(err.Error()))
+			return
+		}
+		writer.WriteHeader(http.StatusInternalServerError)
+		_, _ = writer.Write([]byte("Error updating product"))
+		log.Print(err)
+		return
+	}
+	recordAuditAfter(request, product)
+	writer.Header().Set("ETag", productETag(product))
+	setDefaultHeader(writer)
+	writer.WriteHeader(http.StatusOK)
+	resp, _ := json.Marshal(product)
+	_, _ = writer.Write(resp)
+}
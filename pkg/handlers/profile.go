@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/segfaultx/simple_rest/pkg/auth"
+	"log"
+	"net/http"
+)
+
+func MakeProfileHandler(service auth.AuthenticationService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		username := usernameFromRequest(request)
+		switch request.Method {
+		case "GET":
+			usr, err := service.GetProfile(username)
+			if err != nil {
+				writer.WriteHeader(http.StatusNotFound)
+				return
+			}
+			resp, _ := json.Marshal(usr)
+			setDefaultHeader(writer)
+			_, _ = writer.Write(resp)
+		case "PATCH":
+			update := auth.ProfileUpdate{}
+			err := decodeRequestBody(&update, request)
+			if err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if claims, ok := auth.ClaimsFromToken(tokenFromRequest(request)); ok {
+				update.CurrentSession = claims.SessionId
+			}
+			usr, err := service.UpdateProfile(username, update)
+			if err == auth.ErrWrongPassword {
+				writer.WriteHeader(http.StatusForbidden)
+				_, _ = writer.Write([]byte(err.Error()))
+				return
+			}
+			if err == auth.ErrEmailRequired || err == auth.ErrInvalidEmail {
+				writer.WriteHeader(http.StatusBadRequest)
+				_, _ = writer.Write([]byte(err.Error()))
+				return
+			}
+			if err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				log.Print(err)
+				return
+			}
+			recordAuditAfter(request, usr)
+			resp, _ := json.Marshal(usr)
+			setDefaultHeader(writer)
+			_, _ = writer.Write(resp)
+		case "DELETE":
+			err := service.DeleteAccount(username)
+			if err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				log.Print(err)
+				return
+			}
+			recordAuditAfter(request, nil)
+			http.SetCookie(writer, &http.Cookie{Name: "token", Value: "", MaxAge: -1, Path: "/"})
+			writer.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+func MakeSessionsHandler(service auth.AuthenticationService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		currentSession := ""
+		if claims, ok := auth.ClaimsFromToken(tokenFromRequest(request)); ok {
+			currentSession = claims.SessionId
+		}
+		sessions, err := service.ListSessions(usernameFromRequest(request), currentSession)
+		if err == auth.ErrSessionsNotConfigured {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			log.Print(err)
+			return
+		}
+		resp, _ := json.Marshal(sessions)
+		setDefaultHeader(writer)
+		_, _ = writer.Write(resp)
+	}
+}
+
+func MakeSessionHandler(service auth.AuthenticationService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		err := service.RevokeSession(usernameFromRequest(request), mux.Vars(request)["id"])
+		if err != nil {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
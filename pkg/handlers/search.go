@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"log"
+	"net/http"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+func MakeSearchHandler(repository repo.ProductRepository) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		query := repo.SearchQuery{Text: request.URL.Query().Get("q")}
+		if query.Text == "" {
+			writer.WriteHeader(http.StatusBadRequest)
+			_, _ = writer.Write([]byte("missing query parameter q"))
+			return
+		}
+		if writeFacetedProducts(writer, request, repository) {
+			return
+		}
+		var err error
+		if query.Limit, query.Offset, err = parsePaging(request, defaultSearchLimit, maxSearchLimit); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			_, _ = writer.Write([]byte(err.Error()))
+			return
+		}
+		var results []repo.SearchResult
+		if searcher, ok := repository.(repo.SearchRepository); ok {
+			results, err = searcher.SearchProducts(query)
+		} else {
+			results = repo.MatchProducts(repository.AllProducts(), query)
+		}
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			_, _ = writer.Write([]byte("Error searching products"))
+			log.Print(err)
+			return
+		}
+		resp, _ := json.Marshal(results)
+		setDefaultHeader(writer)
+		writer.WriteHeader(http.StatusOK)
+		_, _ = writer.Write(resp)
+	}
+}
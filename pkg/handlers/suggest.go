@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"github.com/segfaultx/simple_rest/pkg/suggest"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultSuggestLimit = 10
+	maxSuggestLimit     = 50
+)
+
+// MakeSuggestHandler completes from the in-memory index and tops up the
+// results with typo tolerant matches from similar, which may be nil.
+func MakeSuggestHandler(index *suggest.Index, similar repo.SuggestRepository) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		text := request.URL.Query().Get("q")
+		if text == "" {
+			writer.WriteHeader(http.StatusBadRequest)
+			_, _ = writer.Write([]byte("missing query parameter q"))
+			return
+		}
+		limit := defaultSuggestLimit
+		if value := request.URL.Query().Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxSuggestLimit {
+				writer.WriteHeader(http.StatusBadRequest)
+				_, _ = writer.Write([]byte("invalid limit"))
+				return
+			}
+		}
+		suggestions := index.Complete(text, limit)
+		if len(suggestions) < limit && similar != nil {
+			more, err := similar.SuggestProducts(text, limit)
+			if err != nil {
+				log.Print(err)
+			}
+			seen := make(map[int]bool)
+			for _, suggestion := range suggestions {
+				seen[suggestion.Id] = true
+			}
+			for _, suggestion := range more {
+				if len(suggestions) < limit && !seen[suggestion.Id] {
+					suggestions = append(suggestions, suggestion)
+				}
+			}
+		}
+		resp, _ := json.Marshal(suggestions)
+		setDefaultHeader(writer)
+		writer.WriteHeader(http.StatusOK)
+		_, _ = writer.Write(resp)
+	}
+}
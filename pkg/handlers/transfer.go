@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"github.com/segfaultx/simple_rest/pkg/transfer"
+	"log"
+	"net/http"
+)
+
+const (
+	exportFlushRows = 500
+	maxImportBytes  = 32 << 20
+)
+
+func MakeProductExportHandler(store repo.ProductTransferRepository) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		format := request.URL.Query().Get("format")
+		if format == "" {
+			format = transfer.FormatFromContentType(request.Header.Get("Accept"))
+		}
+		if format == "" {
+			format = transfer.FormatCSV
+		}
+		encoder, err := transfer.NewEncoder(writer, format)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			_, _ = writer.Write([]byte(err.Error()))
+			return
+		}
+		writer.Header().Set("Content-Type", transfer.ContentType(format))
+		writer.Header().Set("Content-Disposition", `attachment; filename="products.`+format+`"`)
+		flusher, _ := writer.(http.Flusher)
+		rows := 0
+		err = store.StreamProducts(func(product repo.Product) error {
+			if err := encoder.Encode(product); err != nil {
+				return err
+			}
+			if rows++; rows%exportFlushRows == 0 {
+				if err := encoder.Flush(); err != nil {
+					return err
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+			return nil
+		})
+		if flushErr := encoder.Flush(); err == nil {
+			err = flushErr
+		}
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+func MakeProductImportHandler(store repo.ProductTransferRepository) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		format := request.URL.Query().Get("format")
+		if format == "" {
+			format = transfer.FormatFromContentType(request.Header.Get("Content-Type"))
+		}
+		if format != transfer.FormatCSV && format != transfer.FormatNDJSON {
+			writer.WriteHeader(http.StatusUnsupportedMediaType)
+			_, _ = writer.Write([]byte(transfer.ErrUnknownFormat.Error()))
+			return
+		}
+		body := http.MaxBytesReader(writer, request.Body, maxImportBytes)
+		options := repo.ImportOptions{
+			DryRun:  request.URL.Query().Get("dryRun") == "true",
+			Restore: request.URL.Query().Get("restore") == "true",
+		}
+		report, err := transfer.Import(body, format, store, options)
+		var decodeErr *transfer.DecodeError
+		if errors.As(err, &decodeErr) {
+			writer.WriteHeader(http.StatusBadRequest)
+			_, _ = writer.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			_, _ = writer.Write([]byte("Error importing products"))
+			log.Print(err)
+			return
+		}
+		resp, _ := json.Marshal(report)
+		setDefaultHeader(writer)
+		writer.WriteHeader(http.StatusOK)
+		_, _ = writer.Write(resp)
+	}
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+func MakeTrashHandler(trash repo.TrashRepository) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		products, err := trash.TrashedProducts()
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			log.Print(err)
+			return
+		}
+		resp, _ := json.Marshal(products)
+		setDefaultHeader(writer)
+		_, _ = writer.Write(resp)
+	}
+}
+
+func MakeRestoreProductHandler(trash repo.TrashRepository) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(request)["id"])
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		product, err := trash.RestoreProduct(id)
+		if err == repo.ErrNotInTrash {
+			writer.WriteHeader(http.StatusNotFound)
+			_, _ = writer.Write([]byte(err.Error()))
+			return
+		}
+		if err == repo.ErrDuplicateSku {
+			writer.WriteHeader(http.StatusConflict)
+			_, _ = writer.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			log.Print(err)
+			return
+		}
+		recordAuditAfter(request, product)
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/segfaultx/simple_rest/pkg/auth"
+	"log"
+	"net/http"
+)
+
+type (
+	twoFactorLoginRequest struct {
+		ChallengeToken string `json:"challengeToken"`
+		Code           string `json:"code"`
+	}
+
+	twoFactorChallengeResponse struct {
+		TwoFactorRequired bool   `json:"twoFactorRequired"`
+		ChallengeToken    string `json:"challengeToken"`
+	}
+
+	totpConfirmRequest struct {
+		Code string `json:"code"`
+	}
+
+	totpConfirmResponse struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+)
+
+func MakeTwoFactorLoginHandler(service auth.AuthenticationService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		body := twoFactorLoginRequest{}
+		err := decodeRequestBody(&body, request)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		token, err := service.VerifyTwoFactor(body.ChallengeToken, body.Code)
+		if err == auth.ErrInvalidChallenge || err == auth.ErrInvalidTwoFactorCode {
+			writer.WriteHeader(http.StatusUnauthorized)
+			_, _ = writer.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			log.Print(err)
+			return
+		}
+		addCookieToRequest(writer, token)
+		writer.WriteHeader(http.StatusOK)
+		_, _ = writer.Write([]byte(token))
+	}
+}
+
+func MakeTOTPEnrollHandler(service auth.AuthenticationService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		enrollment, err := service.EnrollTOTP(usernameFromRequest(request))
+		if err == auth.ErrTwoFactorEnabled {
+			writer.WriteHeader(http.StatusConflict)
+			_, _ = writer.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			log.Print(err)
+			return
+		}
+		resp, _ := json.Marshal(enrollment)
+		setDefaultHeader(writer)
+		_, _ = writer.Write(resp)
+	}
+}
+
+func MakeTOTPConfirmHandler(service auth.AuthenticationService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		body := totpConfirmRequest{}
+		err := decodeRequestBody(&body, request)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		codes, err := service.ConfirmTOTP(usernameFromRequest(request), body.Code)
+		if err == auth.ErrInvalidTwoFactorCode {
+			writer.WriteHeader(http.StatusUnauthorized)
+			_, _ = writer.Write([]byte(err.Error()))
+			return
+		}
+		if err == auth.ErrTwoFactorEnabled {
+			writer.WriteHeader(http.StatusConflict)
+			_, _ = writer.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			log.Print(err)
+			return
+		}
+		resp, _ := json.Marshal(totpConfirmResponse{RecoveryCodes: codes})
+		setDefaultHeader(writer)
+		_, _ = writer.Write(resp)
+	}
+}
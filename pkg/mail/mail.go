@@ -0,0 +1,92 @@
+package mail
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	Mailer interface {
+		Send(to, subject, body string) error
+	}
+
+	SMTPMailer struct {
+		Host     string
+		Port     string
+		Username string
+		Password string
+		From     string
+	}
+
+	LogMailer struct {
+		Path string
+	}
+)
+
+var fileMutex = &sync.Mutex{}
+
+func NewFromEnv() Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return &LogMailer{Path: os.Getenv("MAIL_SINK_FILE")}
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	return &SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: os.Getenv("SMTP_USER"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+}
+
+func (mailer *SMTPMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if mailer.Username != "" {
+		auth = smtp.PlainAuth("", mailer.Username, mailer.Password, mailer.Host)
+	}
+	msg := buildMessage(mailer.From, to, subject, body)
+	return smtp.SendMail(mailer.Host+":"+mailer.Port, auth, mailer.From, []string{to}, []byte(msg))
+}
+
+func (mailer *LogMailer) Send(to, subject, body string) error {
+	msg := buildMessage("noreply@localhost", to, subject, body)
+	if mailer.Path == "" {
+		log.Printf("mail to %s:\n%s", to, msg)
+		return nil
+	}
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+	file, err := os.OpenFile(mailer.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(msg + "\r\n")
+	return err
+}
+
+func buildMessage(from, to, subject, body string) string {
+	from, to, subject = stripNewlines(from), stripNewlines(to), stripNewlines(subject)
+	headers := []string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+	return fmt.Sprintf("%s\r\n\r\n%s\r\n", strings.Join(headers, "\r\n"), body)
+}
+
+func stripNewlines(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
@@ -0,0 +1,299 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+var (
+	ErrInvalidPatch = errors.New("invalid patch document")
+	ErrTestFailed   = errors.New("patch test operation failed")
+)
+
+type (
+	Operation struct {
+		Op    string           `json:"op"`
+		Path  string           `json:"path"`
+		From  string           `json:"from,omitempty"`
+		Value *json.RawMessage `json:"value,omitempty"`
+	}
+
+	PathError struct {
+		Path   string
+		Reason string
+	}
+)
+
+func (err *PathError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Path, err.Reason)
+}
+
+// Merge applies an RFC 7396 JSON merge patch to document.
+func Merge(document, mergePatch []byte) ([]byte, error) {
+	var target, patchValue interface{}
+	if err := json.Unmarshal(document, &target); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(mergePatch, &patchValue); err != nil {
+		return nil, ErrInvalidPatch
+	}
+	return json.Marshal(mergeValue(target, patchValue))
+}
+
+func mergeValue(target, patchValue interface{}) interface{} {
+	patchObject, ok := patchValue.(map[string]interface{})
+	if !ok {
+		return patchValue
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = mergeValue(targetObject[key], value)
+	}
+	return targetObject
+}
+
+// Apply applies an RFC 6902 JSON patch to document. Either every operation
+// succeeds or an error is returned.
+func Apply(document, jsonPatch []byte) ([]byte, error) {
+	var operations []Operation
+	if err := json.Unmarshal(jsonPatch, &operations); err != nil {
+		return nil, ErrInvalidPatch
+	}
+	var root interface{}
+	if err := json.Unmarshal(document, &root); err != nil {
+		return nil, err
+	}
+	for _, operation := range operations {
+		var err error
+		root, err = applyOperation(root, operation)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(root)
+}
+
+func applyOperation(root interface{}, operation Operation) (interface{}, error) {
+	path, err := parsePointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if operation.Op == "add" || operation.Op == "replace" || operation.Op == "test" {
+		if operation.Value == nil {
+			return nil, ErrInvalidPatch
+		}
+		if err = json.Unmarshal(*operation.Value, &value); err != nil {
+			return nil, ErrInvalidPatch
+		}
+	}
+	switch operation.Op {
+	case "add":
+		return add(root, path, value)
+	case "remove":
+		root, _, err = remove(root, path)
+		return root, err
+	case "replace":
+		if root, _, err = remove(root, path); err != nil {
+			return nil, err
+		}
+		return add(root, path, value)
+	case "move", "copy":
+		from, err := parsePointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		if operation.Op == "move" {
+			if isPrefix(from, path) && len(from) < len(path) {
+				return nil, &PathError{Path: operation.From, Reason: "cannot move a value into itself"}
+			}
+			root, value, err = remove(root, from)
+		} else {
+			value, err = get(root, from)
+			value = deepCopy(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return add(root, path, value)
+	case "test":
+		current, err := get(root, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, ErrTestFailed
+		}
+		return root, nil
+	}
+	return nil, ErrInvalidPatch
+}
+
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, ErrInvalidPatch
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for index, token := range tokens {
+		tokens[index] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func get(root interface{}, path []string) (interface{}, error) {
+	current := root
+	for index, token := range path {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, &PathError{Path: pointerString(path[:index+1]), Reason: "does not exist"}
+			}
+			current = value
+		case []interface{}:
+			position, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, &PathError{Path: pointerString(path[:index+1]), Reason: err.Error()}
+			}
+			current = node[position]
+		default:
+			return nil, &PathError{Path: pointerString(path[:index+1]), Reason: "does not exist"}
+		}
+	}
+	return current, nil
+}
+
+func add(root interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := get(root, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return root, nil
+	case []interface{}:
+		position := len(node)
+		if last != "-" {
+			if position, err = arrayIndex(last, len(node)); err != nil {
+				return nil, &PathError{Path: pointerString(path), Reason: err.Error()}
+			}
+		}
+		updated := append(node[:position:position], append([]interface{}{value}, node[position:]...)...)
+		return replaceAt(root, path[:len(path)-1], updated)
+	}
+	return nil, &PathError{Path: pointerString(path), Reason: "parent is not a container"}
+}
+
+func remove(root interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, &PathError{Path: "", Reason: "cannot remove the document root"}
+	}
+	parent, err := get(root, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[last]
+		if !ok {
+			return nil, nil, &PathError{Path: pointerString(path), Reason: "does not exist"}
+		}
+		delete(node, last)
+		return root, value, nil
+	case []interface{}:
+		position, err := arrayIndex(last, len(node)-1)
+		if err != nil {
+			return nil, nil, &PathError{Path: pointerString(path), Reason: err.Error()}
+		}
+		value := node[position]
+		updated := append(node[:position:position], node[position+1:]...)
+		root, err = replaceAt(root, path[:len(path)-1], updated)
+		return root, value, err
+	}
+	return nil, nil, &PathError{Path: pointerString(path), Reason: "does not exist"}
+}
+
+func replaceAt(root interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := get(root, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+	case []interface{}:
+		position, _ := arrayIndex(last, len(node)-1)
+		node[position] = value
+	}
+	return root, nil
+}
+
+func arrayIndex(token string, max int) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, errors.New("invalid array index")
+	}
+	position, err := strconv.Atoi(token)
+	if err != nil || position < 0 || position > max {
+		return 0, errors.New("array index out of range")
+	}
+	return position, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for index := range prefix {
+		if prefix[index] != path[index] {
+			return false
+		}
+	}
+	return true
+}
+
+func pointerString(path []string) string {
+	escaped := make([]string, len(path))
+	for index, token := range path {
+		escaped[index] = strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+	}
+	if len(escaped) == 0 {
+		return ""
+	}
+	return "/" + strings.Join(escaped, "/")
+}
+
+func deepCopy(value interface{}) interface{} {
+	data, _ := json.Marshal(value)
+	var copied interface{}
+	_ = json.Unmarshal(data, &copied)
+	return copied
+}
@@ -0,0 +1,95 @@
+package patch
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func assertJSON(t *testing.T, received []byte, expected string) {
+	var left, right interface{}
+	_ = json.Unmarshal(received, &left)
+	_ = json.Unmarshal([]byte(expected), &right)
+	if !reflect.DeepEqual(left, right) {
+		t.Errorf("expected %s, received %s", expected, received)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		document string
+		patch    string
+		expected string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":"foo"}`, `["c"]`, `["c"]`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+	}
+	for _, test := range tests {
+		result, err := Merge([]byte(test.document), []byte(test.patch))
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+			continue
+		}
+		assertJSON(t, result, test.expected)
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		document string
+		patch    string
+		expected string
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"foo":"bar","baz":"qux"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":"qux"}]`, `{"foo":["bar","qux"]}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"/foo","value":1}]`, `{"foo":1}`},
+		{`{"foo":{"bar":"baz"},"qux":{}}`, `[{"op":"move","from":"/foo/bar","path":"/qux/thud"}]`, `{"foo":{},"qux":{"thud":"baz"}}`},
+		{`{"foo":{"bar":"baz"}}`, `[{"op":"copy","from":"/foo","path":"/copy"}]`, `{"foo":{"bar":"baz"},"copy":{"bar":"baz"}}`},
+		{`{"a/b":1,"m~n":2}`, `[{"op":"test","path":"/a~1b","value":1},{"op":"remove","path":"/m~0n"}]`, `{"a/b":1}`},
+	}
+	for _, test := range tests {
+		result, err := Apply([]byte(test.document), []byte(test.patch))
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+			continue
+		}
+		assertJSON(t, result, test.expected)
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []struct {
+		patch    string
+		expected interface{}
+	}{
+		{`{"op":"add"}`, ErrInvalidPatch},
+		{`[{"op":"frobnicate","path":"/foo"}]`, ErrInvalidPatch},
+		{`[{"op":"add","path":"/foo"}]`, ErrInvalidPatch},
+		{`[{"op":"test","path":"/foo","value":"baz"}]`, ErrTestFailed},
+		{`[{"op":"remove","path":"/missing"}]`, &PathError{}},
+		{`[{"op":"add","path":"/list/5","value":1}]`, &PathError{}},
+		{`[{"op":"move","from":"/list","path":"/list/0"}]`, &PathError{}},
+	}
+	for _, test := range tests {
+		_, err := Apply([]byte(`{"foo":"bar","list":[]}`), []byte(test.patch))
+		if reflect.TypeOf(err) != reflect.TypeOf(test.expected) || (reflect.TypeOf(err) != reflect.TypeOf(&PathError{}) && err != test.expected) {
+			t.Errorf("expected %v, received %v", test.expected, err)
+		}
+	}
+}
+
+func TestApplyIsAtomic(t *testing.T) {
+	document := []byte(`{"foo":"bar"}`)
+	_, err := Apply(document, []byte(`[{"op":"replace","path":"/foo","value":"baz"},{"op":"test","path":"/foo","value":"bar"}]`))
+	if err != ErrTestFailed {
+		t.Errorf("expected %v, received %v", ErrTestFailed, err)
+	}
+	assertJSON(t, document, `{"foo":"bar"}`)
+}
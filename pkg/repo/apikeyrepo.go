@@ -0,0 +1,112 @@
+package repo
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"time"
+)
+
+type (
+	APIKeyRepository interface {
+		AddAPIKey(key APIKey) (APIKey, error)
+		GetAPIKeyByPrefix(prefix string) (APIKey, error)
+		APIKeysByCreator(creator string) ([]APIKey, error)
+		RemoveAPIKey(creator string, id int) error
+		TouchAPIKey(id int, lastUsed time.Time) error
+	}
+
+	APIKey struct {
+		Id        int        `json:"id"`
+		Name      string     `json:"name"`
+		Prefix    string     `json:"prefix"`
+		KeyHash   string     `json:"-"`
+		Owner     string     `json:"owner"`
+		OwnerType OwnerType  `json:"ownerType"`
+		Role      Role       `json:"role,omitempty"`
+		Scopes    []string   `json:"scopes"`
+		CreatedBy string     `json:"createdBy"`
+		Created   time.Time  `json:"created"`
+		Expires   *time.Time `json:"expires,omitempty"`
+		LastUsed  *time.Time `json:"lastUsed,omitempty"`
+	}
+
+	OwnerType string
+)
+
+const (
+	USEROWNED    OwnerType = "user"
+	SERVICEOWNED OwnerType = "service"
+)
+
+const apiKeyColumns = "id, name, prefix, key_hash, owner, owner_type, COALESCE(role, ''), scopes, created_by, created, expires, last_used"
+
+func scanAPIKey(scanner interface{ Scan(...interface{}) error }) (APIKey, error) {
+	key := APIKey{}
+	var expires, lastUsed sql.NullTime
+	err := scanner.Scan(&key.Id, &key.Name, &key.Prefix, &key.KeyHash, &key.Owner, &key.OwnerType, &key.Role,
+		pq.Array(&key.Scopes), &key.CreatedBy, &key.Created, &expires, &lastUsed)
+	if err != nil {
+		return APIKey{}, err
+	}
+	if expires.Valid {
+		key.Expires = &expires.Time
+	}
+	if lastUsed.Valid {
+		key.LastUsed = &lastUsed.Time
+	}
+	return key, nil
+}
+
+func (repo *DefaultRepository) AddAPIKey(key APIKey) (APIKey, error) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	row := repo.DB.QueryRow("INSERT INTO api_keys (tenant_id, name, prefix, key_hash, owner, owner_type, role, scopes, created_by, expires) "+
+		"VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, $9, $10) RETURNING "+apiKeyColumns,
+		repo.tenant(), key.Name, key.Prefix, key.KeyHash, key.Owner, key.OwnerType, key.Role, pq.Array(key.Scopes), key.CreatedBy, key.Expires)
+	return scanAPIKey(row)
+}
+
+func (repo *DefaultRepository) GetAPIKeyByPrefix(prefix string) (APIKey, error) {
+	row := repo.DB.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE prefix = $1 AND tenant_id = $2", prefix, repo.tenant())
+	key, err := scanAPIKey(row)
+	if err != nil {
+		return APIKey{}, errors.New("api key not found")
+	}
+	return key, nil
+}
+
+func (repo *DefaultRepository) APIKeysByCreator(creator string) ([]APIKey, error) {
+	rows, err := repo.DB.Query("SELECT "+apiKeyColumns+" FROM api_keys WHERE created_by = $1 AND tenant_id = $2 ORDER BY id", creator, repo.tenant())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make([]APIKey, 0)
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (repo *DefaultRepository) RemoveAPIKey(creator string, id int) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	result, err := repo.DB.Exec("DELETE FROM api_keys WHERE id = $1 AND created_by = $2 AND tenant_id = $3", id, creator, repo.tenant())
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errors.New("api key not found")
+	}
+	return nil
+}
+
+func (repo *DefaultRepository) TouchAPIKey(id int, lastUsed time.Time) error {
+	_, err := repo.DB.Exec("UPDATE api_keys SET last_used = $1 WHERE id = $2 AND tenant_id = $3", lastUsed, id, repo.tenant())
+	return err
+}
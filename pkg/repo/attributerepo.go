@@ -0,0 +1,244 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"regexp"
+	"sort"
+)
+
+const (
+	AttributeString  = "string"
+	AttributeNumber  = "number"
+	AttributeBoolean = "boolean"
+	AttributeEnum    = "enum"
+
+	maxTags      = 50
+	maxTagLength = 64
+)
+
+type (
+	AttributeRepository interface {
+		AttributeDefinitions() ([]AttributeDefinition, error)
+		SaveAttributeDefinition(definition AttributeDefinition) (AttributeDefinition, error)
+		RemoveAttributeDefinition(name string) error
+	}
+
+	AttributeDefinition struct {
+		Name   string   `json:"name"`
+		Type   string   `json:"type"`
+		Values []string `json:"values,omitempty"`
+	}
+
+	// AttributeError reports a product attribute that does not match its
+	// definition.
+	AttributeError struct {
+		Attribute string
+		Reason    string
+	}
+)
+
+var (
+	ErrAttributeNotFound = errors.New("no such attribute")
+	ErrAttributeInUse    = errors.New("attribute values of existing products do not match the new definition")
+
+	attributeNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+)
+
+func (err *AttributeError) Error() string {
+	return fmt.Sprintf("attribute %q %s", err.Attribute, err.Reason)
+}
+
+// AttributeFacet is the facet name of an attribute in ProductPage.Facets.
+func AttributeFacet(name string) string {
+	return "attr." + name
+}
+
+func ValidateAttributeDefinition(definition AttributeDefinition) error {
+	if !attributeNamePattern.MatchString(definition.Name) {
+		return errors.New("attribute names must start with a lowercase letter followed by lowercase letters, digits or underscores")
+	}
+	switch definition.Type {
+	case AttributeString, AttributeNumber, AttributeBoolean:
+		if len(definition.Values) > 0 {
+			return errors.New("only enum attributes have values")
+		}
+	case AttributeEnum:
+		if len(definition.Values) == 0 {
+			return errors.New("enum attributes need at least one value")
+		}
+		seen := make(map[string]bool, len(definition.Values))
+		for _, value := range definition.Values {
+			if value == "" || seen[value] {
+				return errors.New("enum values must be unique and not empty")
+			}
+			seen[value] = true
+		}
+	default:
+		return fmt.Errorf("unknown attribute type %q", definition.Type)
+	}
+	return nil
+}
+
+// ValidateAttributes checks attributes against definitions. Attributes
+// without a definition are rejected.
+func ValidateAttributes(definitions []AttributeDefinition, attributes map[string]interface{}) error {
+	byName := make(map[string]AttributeDefinition, len(definitions))
+	for _, definition := range definitions {
+		byName[definition.Name] = definition
+	}
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		definition, ok := byName[name]
+		if !ok {
+			return &AttributeError{name, "is not defined"}
+		}
+		value := attributes[name]
+		switch definition.Type {
+		case AttributeString:
+			if _, ok = value.(string); !ok {
+				return &AttributeError{name, "must be a string"}
+			}
+		case AttributeNumber:
+			if _, ok = value.(float64); !ok {
+				return &AttributeError{name, "must be a number"}
+			}
+		case AttributeBoolean:
+			if _, ok = value.(bool); !ok {
+				return &AttributeError{name, "must be a boolean"}
+			}
+		case AttributeEnum:
+			text, _ := value.(string)
+			if !containsString(definition.Values, text) {
+				return &AttributeError{name, fmt.Sprintf("must be one of %q", definition.Values)}
+			}
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType is the jsonb_typeof of the values of definition.
+func (definition AttributeDefinition) jsonType() string {
+	if definition.Type == AttributeEnum {
+		return AttributeString
+	}
+	return definition.Type
+}
+
+// checkAttributes validates the attributes of products against the stored
+// definitions, skipping the lookup when none of them has attributes.
+func (repo *DefaultRepository) checkAttributes(db executor, products ...Product) error {
+	var definitions []AttributeDefinition
+	for _, product := range products {
+		if len(product.Attributes) == 0 {
+			continue
+		}
+		if definitions == nil {
+			var err error
+			if definitions, err = repo.attributeDefinitions(db); err != nil {
+				return err
+			}
+		}
+		if err := ValidateAttributes(definitions, product.Attributes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repo *DefaultRepository) attributeDefinitions(db executor) ([]AttributeDefinition, error) {
+	rows, err := db.Query("SELECT name, type, allowed_values FROM attribute_definitions WHERE tenant_id = $1 ORDER BY name", repo.tenant())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	definitions := make([]AttributeDefinition, 0)
+	for rows.Next() {
+		definition := AttributeDefinition{}
+		if err = rows.Scan(&definition.Name, &definition.Type, pq.Array(&definition.Values)); err != nil {
+			return nil, err
+		}
+		definitions = append(definitions, definition)
+	}
+	return definitions, rows.Err()
+}
+
+func (repo *DefaultRepository) AttributeDefinitions() ([]AttributeDefinition, error) {
+	return repo.attributeDefinitions(repo.DB)
+}
+
+// SaveAttributeDefinition creates or replaces a definition. Changes that
+// would leave values of existing products invalid are rejected.
+func (repo *DefaultRepository) SaveAttributeDefinition(definition AttributeDefinition) (AttributeDefinition, error) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	tx, err := repo.DB.Begin()
+	if err != nil {
+		return AttributeDefinition{}, err
+	}
+	defer tx.Rollback()
+	var values interface{}
+	if definition.Type == AttributeEnum {
+		values = pq.Array(definition.Values)
+	}
+	var conflicting bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM products WHERE tenant_id = $1 AND attributes ? $2::text AND NOT "+
+		"(jsonb_typeof(attributes -> $2::text) = $3 AND ($4::text[] IS NULL OR attributes ->> $2::text = ANY($4))))",
+		repo.tenant(), definition.Name, definition.jsonType(), values).Scan(&conflicting)
+	if err != nil {
+		return AttributeDefinition{}, err
+	}
+	if conflicting {
+		return AttributeDefinition{}, ErrAttributeInUse
+	}
+	_, err = tx.Exec("INSERT INTO attribute_definitions (tenant_id, name, type, allowed_values) VALUES ($1, $2, $3, $4) "+
+		"ON CONFLICT (tenant_id, name) DO UPDATE SET type = EXCLUDED.type, allowed_values = EXCLUDED.allowed_values",
+		repo.tenant(), definition.Name, definition.Type, values)
+	if err != nil {
+		return AttributeDefinition{}, err
+	}
+	return definition, tx.Commit()
+}
+
+// RemoveAttributeDefinition deletes a definition and strips the attribute
+// from every product of the tenant.
+func (repo *DefaultRepository) RemoveAttributeDefinition(name string) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	tx, err := repo.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("DELETE FROM attribute_definitions WHERE tenant_id = $1 AND name = $2", repo.tenant(), name)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrAttributeNotFound
+	}
+	_, err = tx.Exec("UPDATE products SET attributes = attributes - $2::text, version = version + 1 WHERE tenant_id = $1 AND attributes ? $2::text",
+		repo.tenant(), name)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	go repo.loadAllProducts()
+	return nil
+}
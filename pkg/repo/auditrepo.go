@@ -0,0 +1,81 @@
+package repo
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type (
+	AuditRepository interface {
+		AddAuditEntry(entry AuditEntry) error
+		AuditEntries(query AuditQuery) ([]AuditEntry, error)
+	}
+
+	AuditEntry struct {
+		Id        int             `json:"id"`
+		Actor     string          `json:"actor"`
+		Action    string          `json:"action"`
+		Target    string          `json:"target"`
+		Status    int             `json:"status"`
+		Before    json.RawMessage `json:"before,omitempty"`
+		After     json.RawMessage `json:"after,omitempty"`
+		RequestId string          `json:"requestId"`
+		Created   time.Time       `json:"created"`
+	}
+
+	AuditQuery struct {
+		Actor  string
+		Action string
+		Target string
+		Since  *time.Time
+		Until  *time.Time
+		// BeforeId restricts the result to entries older than the given
+		// id, which keeps pages stable while new entries arrive.
+		BeforeId int
+		Limit    int
+		Offset   int
+	}
+)
+
+func (repo *DefaultRepository) AddAuditEntry(entry AuditEntry) error {
+	_, err := repo.DB.Exec("INSERT INTO audit_log (tenant_id, actor, action, target, status, before, after, request_id) "+
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		repo.tenant(), entry.Actor, entry.Action, entry.Target, entry.Status, nullableJSON(entry.Before), nullableJSON(entry.After), entry.RequestId)
+	return err
+}
+
+func (repo *DefaultRepository) AuditEntries(query AuditQuery) ([]AuditEntry, error) {
+	rows, err := repo.DB.Query("SELECT id, actor, action, target, status, COALESCE(before, 'null'), COALESCE(after, 'null'), request_id, created "+
+		"FROM audit_log WHERE tenant_id = $1 AND ($2 = '' OR actor = $2) AND ($3 = '' OR action = $3) AND ($4 = '' OR target = $4) "+
+		"AND ($5::timestamptz IS NULL OR created >= $5) AND ($6::timestamptz IS NULL OR created < $6) AND ($9 = 0 OR id < $9) "+
+		"ORDER BY id DESC LIMIT $7 OFFSET $8",
+		repo.tenant(), query.Actor, query.Action, query.Target, query.Since, query.Until, query.Limit, query.Offset, query.BeforeId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		entry := AuditEntry{}
+		var before, after []byte
+		err = rows.Scan(&entry.Id, &entry.Actor, &entry.Action, &entry.Target, &entry.Status, &before, &after, &entry.RequestId, &entry.Created)
+		if err != nil {
+			return nil, err
+		}
+		if string(before) != "null" {
+			entry.Before = before
+		}
+		if string(after) != "null" {
+			entry.After = after
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func nullableJSON(value json.RawMessage) interface{} {
+	if len(value) == 0 {
+		return nil
+	}
+	return string(value)
+}
@@ -0,0 +1,289 @@
+package repo
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"regexp"
+	"strings"
+)
+
+type (
+	CategoryRepository interface {
+		Categories() ([]Category, error)
+		GetCategory(id int) (Category, error)
+		SaveCategory(category Category) (Category, error)
+		MoveCategory(id int, parentId *int, position int) (Category, error)
+		RemoveCategory(id int) error
+		CategoryProducts(id int, descendants bool) ([]Product, error)
+		ProductCategories(productId int) ([]Category, error)
+		SetProductCategories(productId int, categoryIds []int) error
+	}
+
+	Category struct {
+		Id       int         `json:"id"`
+		ParentId *int        `json:"parentId"`
+		Slug     string      `json:"slug"`
+		Name     string      `json:"name"`
+		Position int         `json:"position"`
+		Children []*Category `json:"children,omitempty"`
+	}
+)
+
+const categoryColumns = "id, parent_id, slug, name, position"
+
+// categorySubtree selects the ids of the categories with the slugs bound to
+// its second parameter and all of their descendants.
+const categorySubtree = "WITH RECURSIVE subtree AS (SELECT id FROM categories WHERE tenant_id = $1 AND slug = ANY(%s) " +
+	"UNION ALL SELECT categories.id FROM categories JOIN subtree ON categories.parent_id = subtree.id) SELECT id FROM subtree"
+
+// categoryAncestors pairs every category of the tenant bound to $1 with
+// itself and each of its ancestors.
+const categoryAncestors = "WITH RECURSIVE ancestors AS (SELECT id AS category_id, id AS ancestor_id, parent_id FROM categories WHERE tenant_id = $1 " +
+	"UNION ALL SELECT ancestors.category_id, categories.id, categories.parent_id FROM categories JOIN ancestors ON categories.id = ancestors.parent_id) " +
+	"SELECT category_id, ancestor_id FROM ancestors"
+
+var (
+	ErrCategoryNotFound = errors.New("no such category")
+	ErrCategoryCycle    = errors.New("a category cannot be moved below itself")
+	ErrCategoryNotEmpty = errors.New("category still has subcategories")
+	ErrDuplicateSlug    = errors.New("slug is already in use")
+	ErrInvalidSlug      = errors.New("slug may only contain lowercase letters, digits and dashes")
+
+	slugPattern   = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	slugSeparator = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// Slugify derives a slug from a category name.
+func Slugify(name string) string {
+	return strings.Trim(slugSeparator.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+func ValidateCategory(category Category) error {
+	if strings.TrimSpace(category.Name) == "" {
+		return errors.New("category name must not be empty")
+	}
+	if !slugPattern.MatchString(category.Slug) {
+		return ErrInvalidSlug
+	}
+	return nil
+}
+
+// BuildCategoryTree nests categories below their parents and returns the
+// roots. Siblings keep the order of categories.
+func BuildCategoryTree(categories []Category) []*Category {
+	nodes := make(map[int]*Category, len(categories))
+	for index := range categories {
+		categories[index].Children = nil
+		nodes[categories[index].Id] = &categories[index]
+	}
+	roots := make([]*Category, 0)
+	for index := range categories {
+		category := &categories[index]
+		if category.ParentId != nil {
+			if parent, ok := nodes[*category.ParentId]; ok {
+				parent.Children = append(parent.Children, category)
+				continue
+			}
+		}
+		roots = append(roots, category)
+	}
+	return roots
+}
+
+func scanCategory(row scanner) (Category, error) {
+	category := Category{}
+	var parentId sql.NullInt64
+	err := row.Scan(&category.Id, &parentId, &category.Slug, &category.Name, &category.Position)
+	if parentId.Valid {
+		id := int(parentId.Int64)
+		category.ParentId = &id
+	}
+	return category, err
+}
+
+func categoryWriteError(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code {
+		case "23505":
+			return ErrDuplicateSlug
+		case "23503":
+			return ErrCategoryNotFound
+		}
+	}
+	if err == sql.ErrNoRows {
+		return ErrCategoryNotFound
+	}
+	return err
+}
+
+func (repo *DefaultRepository) Categories() ([]Category, error) {
+	rows, err := repo.DB.Query("SELECT "+categoryColumns+" FROM categories WHERE tenant_id = $1 ORDER BY position, name", repo.tenant())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	categories := make([]Category, 0)
+	for rows.Next() {
+		category, err := scanCategory(rows)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+	return categories, rows.Err()
+}
+
+func (repo *DefaultRepository) GetCategory(id int) (Category, error) {
+	category, err := scanCategory(repo.DB.QueryRow("SELECT "+categoryColumns+" FROM categories WHERE id = $1 AND tenant_id = $2", id, repo.tenant()))
+	return category, categoryWriteError(err)
+}
+
+// SaveCategory creates category when it has no id and otherwise updates its
+// slug, name and position. Parents are changed through MoveCategory.
+func (repo *DefaultRepository) SaveCategory(category Category) (Category, error) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	var err error
+	if category.Id == 0 {
+		category, err = scanCategory(repo.DB.QueryRow("INSERT INTO categories (tenant_id, parent_id, slug, name, position) "+
+			"SELECT $1, $2, $3, $4, $5 WHERE $2::int IS NULL OR EXISTS (SELECT 1 FROM categories WHERE id = $2 AND tenant_id = $1) "+
+			"RETURNING "+categoryColumns, repo.tenant(), category.ParentId, category.Slug, category.Name, category.Position))
+	} else {
+		category, err = scanCategory(repo.DB.QueryRow("UPDATE categories SET slug = $1, name = $2, position = $3 WHERE id = $4 AND tenant_id = $5 "+
+			"RETURNING "+categoryColumns, category.Slug, category.Name, category.Position, category.Id, repo.tenant()))
+	}
+	return category, categoryWriteError(err)
+}
+
+// MoveCategory reparents a category together with its subtree. Moving it
+// below one of its own descendants is rejected.
+func (repo *DefaultRepository) MoveCategory(id int, parentId *int, position int) (Category, error) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	tx, err := repo.DB.Begin()
+	if err != nil {
+		return Category{}, err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return Category{}, err
+	}
+	if parentId != nil {
+		var exists, cycle bool
+		err = tx.QueryRow("WITH RECURSIVE subtree AS (SELECT id FROM categories WHERE id = $1 AND tenant_id = $3 "+
+			"UNION ALL SELECT categories.id FROM categories JOIN subtree ON categories.parent_id = subtree.id) "+
+			"SELECT EXISTS (SELECT 1 FROM categories WHERE id = $2 AND tenant_id = $3), EXISTS (SELECT 1 FROM subtree WHERE id = $2)",
+			id, *parentId, repo.tenant()).Scan(&exists, &cycle)
+		if err != nil {
+			return Category{}, err
+		}
+		if !exists {
+			return Category{}, ErrCategoryNotFound
+		}
+		if cycle {
+			return Category{}, ErrCategoryCycle
+		}
+	}
+	category, err := scanCategory(tx.QueryRow("UPDATE categories SET parent_id = $1, position = $2 WHERE id = $3 AND tenant_id = $4 RETURNING "+categoryColumns,
+		parentId, position, id, repo.tenant()))
+	if err != nil {
+		return Category{}, categoryWriteError(err)
+	}
+	return category, tx.Commit()
+}
+
+func (repo *DefaultRepository) RemoveCategory(id int) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	result, err := repo.DB.Exec("DELETE FROM categories WHERE id = $1 AND tenant_id = $2", id, repo.tenant())
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		return ErrCategoryNotEmpty
+	}
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrCategoryNotFound
+	}
+	return nil
+}
+
+func (repo *DefaultRepository) CategoryProducts(id int, descendants bool) ([]Product, error) {
+	if _, err := repo.GetCategory(id); err != nil {
+		return nil, err
+	}
+	categories := "SELECT $2::int"
+	if descendants {
+		categories = "WITH RECURSIVE subtree AS (SELECT $2::int AS id UNION ALL SELECT categories.id FROM categories " +
+			"JOIN subtree ON categories.parent_id = subtree.id) SELECT id FROM subtree"
+	}
+	rows, err := repo.DB.Query("SELECT "+productColumns+" FROM products WHERE tenant_id = $1 AND deleted_at IS NULL AND id IN "+
+		"(SELECT product_id FROM product_categories WHERE category_id IN ("+categories+")) ORDER BY id", repo.tenant(), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	products := make([]Product, 0)
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, product)
+	}
+	return products, rows.Err()
+}
+
+func (repo *DefaultRepository) ProductCategories(productId int) ([]Category, error) {
+	rows, err := repo.DB.Query("SELECT "+categoryColumns+" FROM categories WHERE tenant_id = $1 AND id IN "+
+		"(SELECT category_id FROM product_categories WHERE product_id = $2) ORDER BY position, name", repo.tenant(), productId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	categories := make([]Category, 0)
+	for rows.Next() {
+		category, err := scanCategory(rows)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+	return categories, rows.Err()
+}
+
+// SetProductCategories replaces the category assignment of a product.
+func (repo *DefaultRepository) SetProductCategories(productId int, categoryIds []int) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	tx, err := repo.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM products WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL)", productId, repo.tenant()).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrProductNotFound
+	}
+	if _, err = tx.Exec("DELETE FROM product_categories WHERE product_id = $1 AND tenant_id = $2", productId, repo.tenant()); err != nil {
+		return err
+	}
+	ids := make(pq.Int64Array, len(categoryIds))
+	for index, id := range categoryIds {
+		ids[index] = int64(id)
+	}
+	result, err := tx.Exec("INSERT INTO product_categories (tenant_id, product_id, category_id) "+
+		"SELECT $1, $2, id FROM categories WHERE tenant_id = $1 AND id = ANY($3)", repo.tenant(), productId, ids)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); int(affected) != len(categoryIds) {
+		return ErrCategoryNotFound
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,239 @@
+package repo
+
+import (
+	"fmt"
+	"github.com/lib/pq"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	FacetBrand    = "brand"
+	FacetPrice    = "price"
+	FacetInStock  = "inStock"
+	FacetCategory = "category"
+	FacetTag      = "tag"
+
+	maxFacetValues = 50
+)
+
+type (
+	FacetRepository interface {
+		FilterProducts(filter ProductFilter) (ProductPage, error)
+	}
+
+	ProductFilter struct {
+		Text        string
+		Brands      []string
+		PriceRanges []PriceRange
+		InStock     *bool
+		Categories  []string
+		Tags        []string
+		// Attributes maps attribute names to the accepted values.
+		Attributes map[string][]string
+		Limit      int
+		Offset     int
+	}
+
+	// PriceRange covers Min <= price < Max; a zero Max leaves it open.
+	PriceRange struct {
+		Min Price
+		Max Price
+	}
+
+	ProductPage struct {
+		Products []Product               `json:"products"`
+		Total    int                     `json:"total"`
+		Facets   map[string][]FacetCount `json:"facets"`
+	}
+
+	FacetCount struct {
+		Value string `json:"value"`
+		Count int    `json:"count"`
+	}
+
+	conditions struct {
+		clauses []string
+		args    []interface{}
+	}
+)
+
+var PriceBuckets = []PriceRange{{0, 1000}, {1000, 5000}, {5000, 10000}, {10000, 50000}, {50000, 0}}
+
+func (priceRange PriceRange) String() string {
+	if priceRange.Max == 0 {
+		return priceRange.Min.String() + "-"
+	}
+	return priceRange.Min.String() + "-" + priceRange.Max.String()
+}
+
+func ParsePriceRange(value string) (PriceRange, error) {
+	bounds := strings.SplitN(value, "-", 2)
+	if len(bounds) != 2 {
+		return PriceRange{}, fmt.Errorf("invalid price range %q", value)
+	}
+	priceRange := PriceRange{}
+	var err error
+	if bounds[0] != "" {
+		if priceRange.Min, err = ParsePrice(bounds[0]); err != nil {
+			return PriceRange{}, fmt.Errorf("invalid price range %q", value)
+		}
+	}
+	if bounds[1] != "" {
+		if priceRange.Max, err = ParsePrice(bounds[1]); err != nil || priceRange.Max <= priceRange.Min {
+			return PriceRange{}, fmt.Errorf("invalid price range %q", value)
+		}
+	}
+	return priceRange, nil
+}
+
+func (where *conditions) arg(value interface{}) string {
+	where.args = append(where.args, value)
+	return fmt.Sprintf("$%d", len(where.args))
+}
+
+func (where *conditions) add(clause string) {
+	where.clauses = append(where.clauses, clause)
+}
+
+func (where *conditions) String() string {
+	return strings.Join(where.clauses, " AND ")
+}
+
+// where builds the filter conditions, leaving out the ones of facet so that
+// its counts show the alternatives to the current selection.
+func (repo *DefaultRepository) where(filter ProductFilter, facet string) *conditions {
+	where := &conditions{}
+	where.add("products.tenant_id = " + where.arg(repo.tenant()))
+	where.add("products.deleted_at IS NULL")
+	if filter.Text != "" {
+		where.add("products.search @@ to_tsquery((SELECT search_config FROM tenants WHERE id = $1), " + where.arg(prefixQuery(filter.Text)) + ")")
+	}
+	if len(filter.Brands) > 0 && facet != FacetBrand {
+		where.add("products.brand = ANY(" + where.arg(pq.Array(filter.Brands)) + ")")
+	}
+	if len(filter.PriceRanges) > 0 && facet != FacetPrice {
+		ranges := make([]string, len(filter.PriceRanges))
+		for index, priceRange := range filter.PriceRanges {
+			ranges[index] = "products.price >= " + where.arg(priceRange.Min)
+			if priceRange.Max != 0 {
+				ranges[index] += " AND products.price < " + where.arg(priceRange.Max)
+			}
+		}
+		where.add("((" + strings.Join(ranges, ") OR (") + "))")
+	}
+	if filter.InStock != nil && facet != FacetInStock {
+		where.add("(products.stock > 0) = " + where.arg(*filter.InStock))
+	}
+	if len(filter.Categories) > 0 && facet != FacetCategory {
+		where.add("products.id IN (SELECT product_id FROM product_categories WHERE category_id IN (" +
+			fmt.Sprintf(categorySubtree, where.arg(pq.Array(filter.Categories))) + "))")
+	}
+	if len(filter.Tags) > 0 && facet != FacetTag {
+		where.add("products.tags @> " + where.arg(pq.Array(filter.Tags)))
+	}
+	names := make([]string, 0, len(filter.Attributes))
+	for name := range filter.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if facet != AttributeFacet(name) {
+			where.add("products.attributes ->> " + where.arg(name) + "::text = ANY(" + where.arg(pq.Array(filter.Attributes[name])) + ")")
+		}
+	}
+	return where
+}
+
+// FilterProducts returns one page of the products matching filter together
+// with the counts of every facet value.
+func (repo *DefaultRepository) FilterProducts(filter ProductFilter) (ProductPage, error) {
+	page := ProductPage{Products: make([]Product, 0), Facets: make(map[string][]FacetCount)}
+	where := repo.where(filter, "")
+	// counted separately, a window count over the page is empty past the last row
+	err := repo.DB.QueryRow("SELECT count(*) FROM products WHERE "+where.String(), where.args...).Scan(&page.Total)
+	if err != nil {
+		return ProductPage{}, err
+	}
+	order := "id"
+	if filter.Text != "" {
+		order = "ts_rank(products.search, to_tsquery((SELECT search_config FROM tenants WHERE id = $1), " + where.arg(prefixQuery(filter.Text)) + ")) DESC, id"
+	}
+	rows, err := repo.DB.Query("SELECT "+productColumns+" FROM products WHERE "+where.String()+
+		" ORDER BY "+order+" LIMIT "+where.arg(filter.Limit)+" OFFSET "+where.arg(filter.Offset), where.args...)
+	if err != nil {
+		return ProductPage{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return ProductPage{}, err
+		}
+		page.Products = append(page.Products, product)
+	}
+	if err = rows.Err(); err != nil {
+		return ProductPage{}, err
+	}
+	buckets := make([]string, len(PriceBuckets))
+	for index, bucket := range PriceBuckets {
+		buckets[index] = fmt.Sprintf("WHEN price >= %s", bucket.Min)
+		if bucket.Max != 0 {
+			buckets[index] += fmt.Sprintf(" AND price < %s", bucket.Max)
+		}
+		buckets[index] += fmt.Sprintf(" THEN '%s'", bucket)
+	}
+	facets := map[string]string{
+		FacetBrand:   "brand AS value FROM products",
+		FacetPrice:   "CASE " + strings.Join(buckets, " ") + " END AS value FROM products",
+		FacetInStock: "CASE WHEN stock > 0 THEN 'true' ELSE 'false' END AS value FROM products",
+		// Counts every product once per category it is assigned to directly
+		// or through a descendant, matching the subtree the filter selects.
+		FacetCategory: "DISTINCT products.id, categories.slug AS value FROM products " +
+			"JOIN product_categories ON product_categories.product_id = products.id JOIN (" + categoryAncestors + ") ancestors " +
+			"ON ancestors.category_id = product_categories.category_id JOIN categories ON categories.id = ancestors.ancestor_id",
+		FacetTag: "unnest(products.tags) AS value FROM products",
+	}
+	for facet, source := range facets {
+		if page.Facets[facet], err = repo.facetCounts(repo.where(filter, facet), source); err != nil {
+			return ProductPage{}, err
+		}
+	}
+	definitions, err := repo.AttributeDefinitions()
+	if err != nil {
+		return ProductPage{}, err
+	}
+	for _, definition := range definitions {
+		if definition.Type != AttributeEnum && definition.Type != AttributeBoolean {
+			continue
+		}
+		facet := AttributeFacet(definition.Name)
+		where := repo.where(filter, facet)
+		source := "products.attributes ->> " + where.arg(definition.Name) + "::text AS value FROM products"
+		if page.Facets[facet], err = repo.facetCounts(where, source); err != nil {
+			return ProductPage{}, err
+		}
+	}
+	return page, nil
+}
+
+// facetCounts groups the values selected by source, an expression aliased
+// value followed by the FROM clause, among the products matching where.
+func (repo *DefaultRepository) facetCounts(where *conditions, source string) ([]FacetCount, error) {
+	rows, err := repo.DB.Query("SELECT value, count(*) FROM (SELECT "+source+" WHERE "+where.String()+") facet "+
+		"WHERE value IS NOT NULL GROUP BY value ORDER BY count(*) DESC, value LIMIT "+strconv.Itoa(maxFacetValues), where.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make([]FacetCount, 0)
+	for rows.Next() {
+		count := FacetCount{}
+		if err = rows.Scan(&count.Value, &count.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,96 @@
+package repo
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+type (
+	IdempotencyRepository interface {
+		ReserveIdempotencyKey(key IdempotencyKey, expiredBefore time.Time) (IdempotentResponse, bool, error)
+		SaveIdempotentResponse(key IdempotencyKey, response IdempotentResponse) error
+		ReleaseIdempotencyKey(key IdempotencyKey) error
+		PurgeIdempotencyKeys(before time.Time) (int64, error)
+	}
+
+	IdempotencyKey struct {
+		Username    string
+		Key         string
+		RequestHash string
+	}
+
+	IdempotentResponse struct {
+		RequestHash string
+		Completed   bool
+		Status      int
+		Header      map[string][]string
+		Body        []byte
+	}
+)
+
+// idempotencyLockTimeout is how long a reservation may stay pending before
+// it is considered abandoned by a crashed or disconnected request.
+const idempotencyLockTimeout = time.Minute
+
+// ReserveIdempotencyKey claims key for the caller. When the key is already
+// taken the stored (possibly still pending) response is returned instead.
+func (repo *DefaultRepository) ReserveIdempotencyKey(key IdempotencyKey, expiredBefore time.Time) (IdempotentResponse, bool, error) {
+	_, err := repo.DB.Exec("DELETE FROM idempotency_keys WHERE tenant_id = $1 AND username = $2 AND key = $3 "+
+		"AND (created < $4 OR (NOT completed AND created < $5))",
+		repo.tenant(), key.Username, key.Key, expiredBefore, time.Now().Add(-idempotencyLockTimeout))
+	if err != nil {
+		return IdempotentResponse{}, false, err
+	}
+	result, err := repo.DB.Exec("INSERT INTO idempotency_keys (tenant_id, username, key, request_hash) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
+		repo.tenant(), key.Username, key.Key, key.RequestHash)
+	if err != nil {
+		return IdempotentResponse{}, false, err
+	}
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		return IdempotentResponse{}, true, nil
+	}
+	response := IdempotentResponse{}
+	var status sql.NullInt64
+	var header []byte
+	err = repo.DB.QueryRow("SELECT request_hash, completed, status, COALESCE(header, 'null'), body FROM idempotency_keys "+
+		"WHERE tenant_id = $1 AND username = $2 AND key = $3", repo.tenant(), key.Username, key.Key).
+		Scan(&response.RequestHash, &response.Completed, &status, &header, &response.Body)
+	if err == sql.ErrNoRows {
+		return repo.ReserveIdempotencyKey(key, expiredBefore)
+	}
+	if err != nil {
+		return IdempotentResponse{}, false, err
+	}
+	response.Status = int(status.Int64)
+	if err = json.Unmarshal(header, &response.Header); err != nil {
+		return IdempotentResponse{}, false, err
+	}
+	return response, false, nil
+}
+
+func (repo *DefaultRepository) SaveIdempotentResponse(key IdempotencyKey, response IdempotentResponse) error {
+	header, err := json.Marshal(response.Header)
+	if err != nil {
+		return err
+	}
+	_, err = repo.DB.Exec("UPDATE idempotency_keys SET completed = true, status = $1, header = $2, body = $3 "+
+		"WHERE tenant_id = $4 AND username = $5 AND key = $6",
+		response.Status, header, response.Body, repo.tenant(), key.Username, key.Key)
+	return err
+}
+
+func (repo *DefaultRepository) ReleaseIdempotencyKey(key IdempotencyKey) error {
+	_, err := repo.DB.Exec("DELETE FROM idempotency_keys WHERE tenant_id = $1 AND username = $2 AND key = $3 AND NOT completed",
+		repo.tenant(), key.Username, key.Key)
+	return err
+}
+
+// PurgeIdempotencyKeys removes expired keys of every tenant.
+func (repo *DefaultRepository) PurgeIdempotencyKeys(before time.Time) (int64, error) {
+	result, err := repo.DB.Exec("DELETE FROM idempotency_keys WHERE created < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,70 @@
+package repo
+
+import (
+	"errors"
+	"time"
+)
+
+type (
+	IdentityRepository interface {
+		AddIdentity(identity ExternalIdentity) error
+		GetIdentity(issuer, subject string) (ExternalIdentity, error)
+		IdentitiesByUsername(username string) ([]ExternalIdentity, error)
+		SetUserRole(username string, role Role) error
+	}
+
+	ExternalIdentity struct {
+		Issuer   string    `json:"issuer"`
+		Subject  string    `json:"subject"`
+		Username string    `json:"username"`
+		Email    string    `json:"email,omitempty"`
+		Created  time.Time `json:"created"`
+	}
+)
+
+func (repo *DefaultRepository) AddIdentity(identity ExternalIdentity) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	_, err := repo.DB.Exec("INSERT INTO external_identities (tenant_id, issuer, subject, username, email) VALUES ($1, $2, $3, $4, NULLIF($5, ''))",
+		repo.tenant(), identity.Issuer, identity.Subject, identity.Username, identity.Email)
+	return err
+}
+
+func (repo *DefaultRepository) GetIdentity(issuer, subject string) (ExternalIdentity, error) {
+	identity := ExternalIdentity{}
+	row := repo.DB.QueryRow("SELECT issuer, subject, username, COALESCE(email, ''), created FROM external_identities WHERE issuer = $1 AND subject = $2 AND tenant_id = $3",
+		issuer, subject, repo.tenant())
+	err := row.Scan(&identity.Issuer, &identity.Subject, &identity.Username, &identity.Email, &identity.Created)
+	if err != nil {
+		return ExternalIdentity{}, errors.New("identity not found")
+	}
+	return identity, nil
+}
+
+func (repo *DefaultRepository) IdentitiesByUsername(username string) ([]ExternalIdentity, error) {
+	rows, err := repo.DB.Query("SELECT issuer, subject, username, COALESCE(email, ''), created FROM external_identities WHERE username = $1 AND tenant_id = $2", username, repo.tenant())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	identities := make([]ExternalIdentity, 0)
+	for rows.Next() {
+		identity := ExternalIdentity{}
+		if err = rows.Scan(&identity.Issuer, &identity.Subject, &identity.Username, &identity.Email, &identity.Created); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+func (repo *DefaultRepository) SetUserRole(username string, role Role) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	_, err := repo.DB.Exec("UPDATE users SET role = $1 WHERE username = $2 AND tenant_id = $3", role, username, repo.tenant())
+	if err != nil {
+		return err
+	}
+	go repo.loadAllUsers()
+	return nil
+}
@@ -0,0 +1,128 @@
+package repo
+
+import (
+	"errors"
+	"github.com/lib/pq"
+	"time"
+)
+
+type (
+	OAuthRepository interface {
+		AddClient(client OAuthClient) (OAuthClient, error)
+		GetClient(clientId string) (OAuthClient, error)
+		ClientsByOwner(owner string) ([]OAuthClient, error)
+		AddAuthorizationCode(code AuthorizationCode) error
+		TakeAuthorizationCode(codeHash string) (AuthorizationCode, error)
+	}
+
+	RevocationRepository interface {
+		RevokeToken(jti string, expires time.Time) error
+		IsTokenRevoked(jti string) (bool, error)
+	}
+
+	OAuthClient struct {
+		Id           int       `json:"id"`
+		ClientId     string    `json:"clientId"`
+		SecretHash   string    `json:"-"`
+		Name         string    `json:"name"`
+		RedirectURIs []string  `json:"redirectUris"`
+		Scopes       []string  `json:"scopes"`
+		GrantTypes   []string  `json:"grantTypes"`
+		Owner        string    `json:"owner"`
+		Created      time.Time `json:"created"`
+	}
+
+	AuthorizationCode struct {
+		CodeHash      string
+		ClientId      string
+		Username      string
+		RedirectURI   string
+		Scopes        []string
+		CodeChallenge string
+		Expires       time.Time
+	}
+)
+
+const oauthClientColumns = "id, client_id, COALESCE(secret_hash, ''), name, redirect_uris, scopes, grant_types, owner, created"
+
+func scanOAuthClient(scanner interface{ Scan(...interface{}) error }) (OAuthClient, error) {
+	client := OAuthClient{}
+	err := scanner.Scan(&client.Id, &client.ClientId, &client.SecretHash, &client.Name, pq.Array(&client.RedirectURIs),
+		pq.Array(&client.Scopes), pq.Array(&client.GrantTypes), &client.Owner, &client.Created)
+	return client, err
+}
+
+func (repo *DefaultRepository) AddClient(client OAuthClient) (OAuthClient, error) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	row := repo.DB.QueryRow("INSERT INTO oauth_clients (tenant_id, client_id, secret_hash, name, redirect_uris, scopes, grant_types, owner) "+
+		"VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7, $8) RETURNING "+oauthClientColumns,
+		repo.tenant(), client.ClientId, client.SecretHash, client.Name, pq.Array(client.RedirectURIs), pq.Array(client.Scopes),
+		pq.Array(client.GrantTypes), client.Owner)
+	return scanOAuthClient(row)
+}
+
+func (repo *DefaultRepository) GetClient(clientId string) (OAuthClient, error) {
+	row := repo.DB.QueryRow("SELECT "+oauthClientColumns+" FROM oauth_clients WHERE client_id = $1 AND tenant_id = $2", clientId, repo.tenant())
+	client, err := scanOAuthClient(row)
+	if err != nil {
+		return OAuthClient{}, errors.New("client not found")
+	}
+	return client, nil
+}
+
+func (repo *DefaultRepository) ClientsByOwner(owner string) ([]OAuthClient, error) {
+	rows, err := repo.DB.Query("SELECT "+oauthClientColumns+" FROM oauth_clients WHERE owner = $1 AND tenant_id = $2 ORDER BY id", owner, repo.tenant())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	clients := make([]OAuthClient, 0)
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, rows.Err()
+}
+
+func (repo *DefaultRepository) AddAuthorizationCode(code AuthorizationCode) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	_, err := repo.DB.Exec("INSERT INTO authorization_codes (tenant_id, code_hash, client_id, username, redirect_uri, scopes, code_challenge, expires) "+
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		repo.tenant(), code.CodeHash, code.ClientId, code.Username, code.RedirectURI, pq.Array(code.Scopes), code.CodeChallenge, code.Expires)
+	return err
+}
+
+func (repo *DefaultRepository) TakeAuthorizationCode(codeHash string) (AuthorizationCode, error) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	code := AuthorizationCode{}
+	row := repo.DB.QueryRow("DELETE FROM authorization_codes WHERE code_hash = $1 AND tenant_id = $2 "+
+		"RETURNING code_hash, client_id, username, redirect_uri, scopes, code_challenge, expires", codeHash, repo.tenant())
+	err := row.Scan(&code.CodeHash, &code.ClientId, &code.Username, &code.RedirectURI, pq.Array(&code.Scopes), &code.CodeChallenge, &code.Expires)
+	if err != nil {
+		return AuthorizationCode{}, errors.New("authorization code not found")
+	}
+	return code, nil
+}
+
+func (repo *DefaultRepository) RevokeToken(jti string, expires time.Time) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	_, err := repo.DB.Exec("INSERT INTO revoked_tokens (jti, expires) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING", jti, expires)
+	if err != nil {
+		return err
+	}
+	_, err = repo.DB.Exec("DELETE FROM revoked_tokens WHERE expires < now()")
+	return err
+}
+
+func (repo *DefaultRepository) IsTokenRevoked(jti string) (bool, error) {
+	var revoked bool
+	err := repo.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)", jti).Scan(&revoked)
+	return revoked, err
+}
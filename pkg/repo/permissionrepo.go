@@ -0,0 +1,126 @@
+package repo
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+)
+
+type (
+	PermissionRepository interface {
+		AllRoles() ([]RoleDefinition, error)
+		GetRole(name Role) (RoleDefinition, error)
+		SaveRole(role RoleDefinition) error
+		RemoveRole(name Role) error
+		UserRoles(username string) ([]Role, error)
+		SetUserRoles(username string, roles []Role) error
+	}
+
+	RoleDefinition struct {
+		Name        Role     `json:"name"`
+		Permissions []string `json:"permissions"`
+	}
+)
+
+var ErrRoleNotFound = errors.New("role not found")
+
+func (repo *DefaultRepository) AllRoles() ([]RoleDefinition, error) {
+	rows, err := repo.DB.Query("SELECT name, permissions FROM roles WHERE tenant_id = $1 ORDER BY name", repo.tenant())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := make([]RoleDefinition, 0)
+	for rows.Next() {
+		role := RoleDefinition{}
+		if err = rows.Scan(&role.Name, pq.Array(&role.Permissions)); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func (repo *DefaultRepository) GetRole(name Role) (RoleDefinition, error) {
+	role := RoleDefinition{}
+	row := repo.DB.QueryRow("SELECT name, permissions FROM roles WHERE name = $1 AND tenant_id = $2", name, repo.tenant())
+	err := row.Scan(&role.Name, pq.Array(&role.Permissions))
+	if err == sql.ErrNoRows {
+		return RoleDefinition{}, ErrRoleNotFound
+	}
+	if err != nil {
+		return RoleDefinition{}, err
+	}
+	return role, nil
+}
+
+func (repo *DefaultRepository) SaveRole(role RoleDefinition) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	_, err := repo.DB.Exec("INSERT INTO roles (tenant_id, name, permissions) VALUES ($1, $2, $3) "+
+		"ON CONFLICT (tenant_id, name) DO UPDATE SET permissions = EXCLUDED.permissions",
+		repo.tenant(), role.Name, pq.Array(role.Permissions))
+	return err
+}
+
+func (repo *DefaultRepository) RemoveRole(name Role) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	tx, err := repo.DB.Begin()
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM roles WHERE name = $1 AND tenant_id = $2", name, repo.tenant())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		_ = tx.Rollback()
+		return ErrRoleNotFound
+	}
+	// Roles are defined per tenant, so no definition of name remains and
+	// its assignments would only dangle.
+	if _, err = tx.Exec("DELETE FROM user_roles WHERE role = $1 AND tenant_id = $2", name, repo.tenant()); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (repo *DefaultRepository) UserRoles(username string) ([]Role, error) {
+	rows, err := repo.DB.Query("SELECT role FROM user_roles WHERE username = $1 AND tenant_id = $2 ORDER BY role", username, repo.tenant())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := make([]Role, 0)
+	for rows.Next() {
+		var role Role
+		if err = rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func (repo *DefaultRepository) SetUserRoles(username string, roles []Role) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	tx, err := repo.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM user_roles WHERE username = $1 AND tenant_id = $2", username, repo.tenant()); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for _, role := range roles {
+		if _, err = tx.Exec("INSERT INTO user_roles (tenant_id, username, role) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", repo.tenant(), username, role); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
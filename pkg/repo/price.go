@@ -0,0 +1,94 @@
+package repo
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Price is an amount in cents. It is written as a decimal number in JSON, CSV
+// and SQL so that NUMERIC(12, 2) values round-trip without float rounding.
+type Price int64
+
+var ErrInvalidPriceFormat = errors.New("price must be a decimal number with at most two decimal places")
+
+// ParsePrice reads a decimal amount such as "19.9" or "19.90".
+func ParsePrice(value string) (Price, error) {
+	value = strings.TrimSpace(value)
+	negative := strings.HasPrefix(value, "-")
+	units, fraction := strings.TrimPrefix(value, "-"), ""
+	if dot := strings.IndexByte(units, '.'); dot >= 0 {
+		units, fraction = units[:dot], units[dot+1:]
+		if fraction == "" {
+			return 0, ErrInvalidPriceFormat
+		}
+	}
+	if units == "" || len(fraction) > 2 || !digitsOnly(units) || !digitsOnly(fraction) {
+		return 0, ErrInvalidPriceFormat
+	}
+	cents, err := strconv.ParseInt(units+(fraction + "00")[:2], 10, 64)
+	if err != nil {
+		return 0, ErrInvalidPriceFormat
+	}
+	if negative {
+		cents = -cents
+	}
+	return Price(cents), nil
+}
+
+func digitsOnly(value string) bool {
+	for _, char := range value {
+		if char < '0' || char > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the price without trailing zeros, e.g. "19.9" or "5".
+func (price Price) String() string {
+	cents := int64(price)
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	formatted := fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+	return strings.TrimSuffix(strings.TrimRight(formatted, "0"), ".")
+}
+
+func (price Price) MarshalJSON() ([]byte, error) {
+	return []byte(price.String()), nil
+}
+
+func (price *Price) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	parsed, err := ParsePrice(string(data))
+	if err != nil {
+		return err
+	}
+	*price = parsed
+	return nil
+}
+
+func (price Price) Value() (driver.Value, error) {
+	return price.String(), nil
+}
+
+func (price *Price) Scan(src interface{}) error {
+	var err error
+	switch value := src.(type) {
+	case []byte:
+		*price, err = ParsePrice(string(value))
+	case string:
+		*price, err = ParsePrice(value)
+	case int64:
+		*price = Price(value * 100)
+	default:
+		return fmt.Errorf("cannot scan %T into a price", src)
+	}
+	return err
+}
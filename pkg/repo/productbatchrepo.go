@@ -0,0 +1,204 @@
+package repo
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+
+	batchInsertSize = 1000
+)
+
+type (
+	ProductBatchRepository interface {
+		ApplyProductBatch(operations []ProductOperation, atomic bool) ([]ProductOperationResult, error)
+	}
+
+	ProductOperation struct {
+		Op      string  `json:"op"`
+		Id      int     `json:"id,omitempty"`
+		Version int     `json:"version,omitempty"`
+		Product Product `json:"product"`
+	}
+
+	ProductOperationResult struct {
+		Product Product
+		Err     error
+	}
+)
+
+var (
+	ErrUnknownBatchOperation = errors.New("unknown batch operation")
+	ErrBatchAborted          = errors.New("batch aborted by a failed operation")
+)
+
+// ApplyProductBatch runs operations in one transaction. In atomic mode the
+// first failing operation rolls back the whole batch; otherwise every
+// operation is isolated by a savepoint and failures are only reported.
+func (repo *DefaultRepository) ApplyProductBatch(operations []ProductOperation, atomic bool) ([]ProductOperationResult, error) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	tx, err := repo.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	results := make([]ProductOperationResult, len(operations))
+	creates := make([]int, 0)
+	for index, operation := range operations {
+		if operation.Op == BatchCreate {
+			creates = append(creates, index)
+			if len(creates) < batchInsertSize {
+				continue
+			}
+		}
+		// pending creates are flushed first so operations apply in request order
+		if failed := repo.createProducts(tx, operations, creates, results, atomic); failed >= 0 {
+			return abortBatch(results, failed), nil
+		}
+		creates = creates[:0]
+		if operation.Op == BatchCreate {
+			continue
+		}
+		result := &results[index]
+		switch operation.Op {
+		case BatchUpdate:
+			product := operation.Product
+			product.Id, product.Version = operation.Id, operation.Version
+			result.Err = inSavepoint(tx, !atomic, func() (err error) {
+				result.Product, err = repo.updateProduct(tx, product)
+				return err
+			})
+		case BatchDelete:
+			result.Err = inSavepoint(tx, !atomic, func() (err error) {
+				result.Product, err = repo.removeProduct(tx, Product{Id: operation.Id, Version: operation.Version})
+				return err
+			})
+		default:
+			result.Err = ErrUnknownBatchOperation
+		}
+		if atomic && result.Err != nil {
+			return abortBatch(results, index), nil
+		}
+	}
+	if failed := repo.createProducts(tx, operations, creates, results, atomic); failed >= 0 {
+		return abortBatch(results, failed), nil
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	go repo.loadAllProducts()
+	return results, nil
+}
+
+// createProducts inserts the creates at indices with one multi-row INSERT. If
+// that fails, the rows are retried one at a time so the error lands on the
+// offending operation. In atomic mode it returns the index of the first
+// failing create, otherwise -1.
+func (repo *DefaultRepository) createProducts(tx *sql.Tx, operations []ProductOperation, indices []int, results []ProductOperationResult, atomic bool) int {
+	if len(indices) == 0 {
+		return -1
+	}
+	err := inSavepoint(tx, true, func() error {
+		return repo.insertProducts(tx, operations, indices, results)
+	})
+	if err == nil {
+		return -1
+	}
+	for _, index := range indices {
+		index := index
+		results[index].Err = inSavepoint(tx, true, func() error {
+			return repo.insertProducts(tx, operations, []int{index}, results)
+		})
+		if atomic && results[index].Err != nil {
+			return index
+		}
+	}
+	return -1
+}
+
+// insertProducts creates the products at indices with a single multi-row
+// INSERT. The ids are drawn from the sequence up front, since RETURNING does
+// not guarantee the order of the VALUES list.
+func (repo *DefaultRepository) insertProducts(db executor, operations []ProductOperation, indices []int, results []ProductOperationResult) error {
+	products := make([]Product, len(indices))
+	for position, index := range indices {
+		products[position] = operations[index].Product
+	}
+	if err := repo.checkAttributes(db, products...); err != nil {
+		return err
+	}
+	ids, err := nextProductIds(db, len(indices))
+	if err != nil {
+		return err
+	}
+	values := make([]string, len(indices))
+	args := []interface{}{repo.tenant()}
+	positions := make(map[int]int, len(indices))
+	for position, index := range indices {
+		values[position] = "($1, " + placeholders(len(args)+1, len(productFields)+1) + ")"
+		args = append(args, append([]interface{}{ids[position]}, productValues(operations[index].Product)...)...)
+		positions[ids[position]] = index
+	}
+	rows, err := db.Query("INSERT INTO products (tenant_id, id, "+strings.Join(productFields, ", ")+") VALUES "+strings.Join(values, ", ")+" RETURNING "+productColumns, args...)
+	if err != nil {
+		return productWriteError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return err
+		}
+		results[positions[product.Id]].Product = product
+	}
+	return rows.Err()
+}
+
+func nextProductIds(db executor, count int) ([]int, error) {
+	rows, err := db.Query("SELECT nextval(pg_get_serial_sequence('products', 'id')) FROM generate_series(1, $1)", count)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]int, 0, count)
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func inSavepoint(tx *sql.Tx, enabled bool, statement func() error) error {
+	if !enabled {
+		return statement()
+	}
+	if _, err := tx.Exec("SAVEPOINT batch_operation"); err != nil {
+		return err
+	}
+	if err := statement(); err != nil {
+		if _, rollbackErr := tx.Exec("ROLLBACK TO SAVEPOINT batch_operation"); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+	_, err := tx.Exec("RELEASE SAVEPOINT batch_operation")
+	return err
+}
+
+func abortBatch(results []ProductOperationResult, failed int) []ProductOperationResult {
+	for index := range results {
+		if index != failed {
+			results[index] = ProductOperationResult{Err: ErrBatchAborted}
+		}
+	}
+	return results
+}
@@ -1,52 +1,272 @@
 package repo
 
 import (
+	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/lib/pq"
 	"log"
+	"strings"
+	"time"
 )
 
 type (
 	ProductRepository interface {
-		AddProduct(p Product) error
+		AddProduct(p Product) (Product, error)
 		RemoveProduct(p Product) error
-		UpdateProduct(p Product) error
+		UpdateProduct(p Product) (Product, error)
+		PatchProduct(id, version int, apply func(Product) (Product, error)) (Product, error)
 		AllProducts() []Product
+		ListProducts() ([]Product, error)
 		GetProductById(id int) (Product, error)
 		InitRepo(user, passwd, dbname string) error
 		Close()
 	}
 
+	TrashRepository interface {
+		TrashedProducts() ([]Product, error)
+		RestoreProduct(id int) (Product, error)
+		PurgeProducts(deletedBefore time.Time) (int64, error)
+	}
+
 	Product struct {
-		Id   int    `json:"id"`
-		Name string `json:"name"`
+		Id          int                    `json:"id"`
+		Name        string                 `json:"name"`
+		Sku         string                 `json:"sku,omitempty"`
+		Description string                 `json:"description,omitempty"`
+		Price       Price                  `json:"price"`
+		Brand       string                 `json:"brand,omitempty"`
+		Stock       int                    `json:"stock"`
+		Tags        []string               `json:"tags,omitempty"`
+		Attributes  map[string]interface{} `json:"attributes,omitempty"`
+		Version     int                    `json:"version"`
+		DeletedAt   *time.Time             `json:"deletedAt,omitempty"`
+	}
+)
+
+type (
+	executor interface {
+		Exec(query string, args ...interface{}) (sql.Result, error)
+		Query(query string, args ...interface{}) (*sql.Rows, error)
+		QueryRow(query string, args ...interface{}) *sql.Row
+	}
+
+	scanner interface {
+		Scan(dest ...interface{}) error
 	}
 )
 
+const productColumns = "id, name, COALESCE(sku, ''), COALESCE(description, ''), price, COALESCE(brand, ''), stock, tags, attributes, version, deleted_at"
+
+// productFields are the writable product columns in the order of productValues.
+var productFields = []string{"name", "sku", "description", "price", "brand", "stock", "tags", "attributes"}
+
+var (
+	ErrVersionConflict    = errors.New("product was modified concurrently")
+	ErrProductNotFound    = errors.New("no such item")
+	ErrNotInTrash         = errors.New("no such item in trash")
+	ErrDuplicateSku       = errors.New("sku is already in use")
+	ErrInvalidProductName = errors.New("invalid product name")
+	ErrInvalidPrice       = errors.New("price must not be negative")
+	ErrInvalidStock       = errors.New("stock must not be negative")
+	ErrInvalidTag         = fmt.Errorf("tags must be 1 to %d characters long without surrounding spaces", maxTagLength)
+	ErrTooManyTags        = fmt.Errorf("a product may have at most %d tags", maxTags)
+)
+
+func ValidateProduct(p Product) error {
+	if len(p.Name) <= 3 {
+		return ErrInvalidProductName
+	}
+	if p.Price < 0 {
+		return ErrInvalidPrice
+	}
+	if p.Stock < 0 {
+		return ErrInvalidStock
+	}
+	if len(p.Tags) > maxTags {
+		return ErrTooManyTags
+	}
+	for _, tag := range p.Tags {
+		if tag == "" || tag != strings.TrimSpace(tag) || len(tag) > maxTagLength {
+			return ErrInvalidTag
+		}
+	}
+	return nil
+}
+
+func productValues(p Product) []interface{} {
+	tags := p.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	attributes := []byte("{}")
+	if len(p.Attributes) > 0 {
+		attributes, _ = json.Marshal(p.Attributes)
+	}
+	return []interface{}{p.Name, nullString(p.Sku), nullString(p.Description), p.Price, nullString(p.Brand), p.Stock,
+		pq.Array(tags), string(attributes)}
+}
+
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+// placeholders returns count bind parameters starting at $first.
+func placeholders(first, count int) string {
+	params := make([]string, count)
+	for index := range params {
+		params[index] = fmt.Sprintf("$%d", first+index)
+	}
+	return strings.Join(params, ", ")
+}
+
+func (repo *DefaultRepository) insertProduct(db executor, p Product, onConflict string) (Product, error) {
+	if err := repo.checkAttributes(db, p); err != nil {
+		return Product{}, err
+	}
+	created, err := scanProduct(db.QueryRow("INSERT INTO products (tenant_id, "+strings.Join(productFields, ", ")+") "+
+		"VALUES ($1, "+placeholders(2, len(productFields))+") "+onConflict+" RETURNING "+productColumns,
+		append([]interface{}{repo.tenant()}, productValues(p)...)...))
+	return created, productWriteError(err)
+}
+
+// scanProduct reads the productColumns of row followed by any extra columns.
+func scanProduct(row scanner, extra ...interface{}) (Product, error) {
+	product := Product{}
+	var deletedAt sql.NullTime
+	var attributes []byte
+	dest := append([]interface{}{&product.Id, &product.Name, &product.Sku, &product.Description, &product.Price, &product.Brand, &product.Stock,
+		pq.Array(&product.Tags), &attributes, &product.Version, &deletedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return product, err
+	}
+	if deletedAt.Valid {
+		product.DeletedAt = &deletedAt.Time
+	}
+	if len(product.Tags) == 0 {
+		product.Tags = nil
+	}
+	err := json.Unmarshal(attributes, &product.Attributes)
+	if len(product.Attributes) == 0 {
+		product.Attributes = nil
+	}
+	return product, err
+}
+
+func productWriteError(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return ErrDuplicateSku
+	}
+	return err
+}
+
 func (repo *DefaultRepository) GetProductById(id int) (Product, error) {
 	for _, item := range repo.AllProducts() {
 		if item.Id == id {
 			return item, nil
 		}
 	}
-	return Product{}, errors.New("no such item")
+	return Product{}, ErrProductNotFound
 }
 
-func (repo *DefaultRepository) UpdateProduct(p Product) error {
+func (repo *DefaultRepository) UpdateProduct(p Product) (Product, error) {
 	writeMutex.Lock()
 	defer writeMutex.Unlock()
-	_, err := repo.DB.Exec("UPDATE products SET name = $1 where products.id = $2", p.Name, p.Id)
-	return err
+	updated, err := repo.updateProduct(repo.DB, p)
+	if err != nil {
+		return Product{}, err
+	}
+	go repo.loadAllProducts()
+	return updated, nil
 }
 
-func (repo *DefaultRepository) AddProduct(p Product) error {
+func (repo *DefaultRepository) updateProduct(db executor, p Product) (Product, error) {
+	if err := repo.checkAttributes(db, p); err != nil {
+		return Product{}, err
+	}
+	assignments := make([]string, len(productFields))
+	for index, field := range productFields {
+		assignments[index] = fmt.Sprintf("%s = $%d", field, index+4)
+	}
+	updated, err := scanProduct(db.QueryRow("UPDATE products SET "+strings.Join(assignments, ", ")+", version = version + 1 "+
+		"where products.id = $1 AND tenant_id = $2 AND deleted_at IS NULL AND ($3 = 0 OR version = $3) RETURNING "+productColumns,
+		append([]interface{}{p.Id, repo.tenant(), p.Version}, productValues(p)...)...))
+	if err == sql.ErrNoRows {
+		return Product{}, repo.missingProduct(db, p.Id)
+	}
+	return updated, productWriteError(err)
+}
+
+func (repo *DefaultRepository) removeProduct(db executor, p Product) (Product, error) {
+	removed, err := scanProduct(db.QueryRow("UPDATE products SET deleted_at = now(), version = version + 1 WHERE id=$1 AND tenant_id = $2 "+
+		"AND deleted_at IS NULL AND ($3 = 0 OR version = $3) RETURNING "+productColumns, p.Id, repo.tenant(), p.Version))
+	if err == sql.ErrNoRows {
+		return Product{}, repo.missingProduct(db, p.Id)
+	}
+	return removed, err
+}
+
+// missingProduct tells apart a stale version from a product that is gone
+// after a conditional write matched no rows.
+func (repo *DefaultRepository) missingProduct(db executor, id int) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM products WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL)",
+		id, repo.tenant()).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrVersionConflict
+	}
+	return ErrProductNotFound
+}
+
+// PatchProduct locks the stored product, hands it to apply and writes back
+// the result within a single transaction.
+func (repo *DefaultRepository) PatchProduct(id, version int, apply func(Product) (Product, error)) (Product, error) {
 	writeMutex.Lock()
 	defer writeMutex.Unlock()
-	_, err := repo.DB.Exec("INSERT INTO products (name) VALUES ($1)", p.Name)
+	tx, err := repo.DB.Begin()
 	if err != nil {
-		return err
+		return Product{}, err
+	}
+	defer tx.Rollback()
+	current, err := scanProduct(tx.QueryRow("SELECT "+productColumns+" FROM products WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL FOR UPDATE",
+		id, repo.tenant()))
+	if err == sql.ErrNoRows {
+		return Product{}, ErrProductNotFound
+	}
+	if err != nil {
+		return Product{}, err
+	}
+	if version != 0 && current.Version != version {
+		return Product{}, ErrVersionConflict
+	}
+	patched, err := apply(current)
+	if err != nil {
+		return Product{}, err
+	}
+	patched.Id, patched.Version = id, 0
+	if patched, err = repo.updateProduct(tx, patched); err != nil {
+		return Product{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return Product{}, err
 	}
 	go repo.loadAllProducts()
-	return nil
+	return patched, nil
+}
+
+func (repo *DefaultRepository) AddProduct(p Product) (Product, error) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	created, err := repo.insertProduct(repo.DB, p, "")
+	if err != nil {
+		return Product{}, err
+	}
+	go repo.loadAllProducts()
+	return created, nil
 }
 
 func (repo *DefaultRepository) loadAllProducts() {
@@ -57,19 +277,21 @@ func (repo *DefaultRepository) loadAllProducts() {
 			log.Fatal(rec)
 		}
 	}()
-	rows, err := repo.DB.Query("SELECT * from products")
+	rows, err := repo.DB.Query("SELECT "+productColumns+" from products WHERE tenant_id = $1 AND deleted_at IS NULL ORDER BY id", repo.tenant())
 	if err != nil {
 		panic(err)
 	}
 	repo.Products = make([]Product, 0)
 	for rows.Next() {
-		prod := Product{}
-		err = rows.Scan(&prod.Id, &prod.Name)
+		prod, err := scanProduct(rows)
 		if err != nil {
 			panic(err)
 		}
 		repo.Products = append(repo.Products, prod)
 	}
+	if repo.ProductsLoaded != nil {
+		repo.ProductsLoaded(repo.Products)
+	}
 }
 
 func (repo *DefaultRepository) AllProducts() []Product {
@@ -79,13 +301,69 @@ func (repo *DefaultRepository) AllProducts() []Product {
 	return repo.Products
 }
 
+// ListProducts reads the live products from the database rather than the
+// product cache, which is reloaded asynchronously after writes.
+func (repo *DefaultRepository) ListProducts() ([]Product, error) {
+	products := make([]Product, 0)
+	err := repo.StreamProducts(func(product Product) error {
+		products = append(products, product)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
 func (repo *DefaultRepository) RemoveProduct(p Product) error {
 	writeMutex.Lock()
 	defer writeMutex.Unlock()
-	_, err := repo.DB.Exec("DELETE FROM products WHERE id=$1", p.Id)
-	if err != nil {
-		return errors.New(err.Error())
+	if _, err := repo.removeProduct(repo.DB, p); err != nil {
+		return err
 	}
 	go repo.loadAllProducts()
 	return nil
 }
+
+func (repo *DefaultRepository) TrashedProducts() ([]Product, error) {
+	rows, err := repo.DB.Query("SELECT "+productColumns+" FROM products WHERE tenant_id = $1 AND deleted_at IS NOT NULL ORDER BY deleted_at DESC", repo.tenant())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	products := make([]Product, 0)
+	for rows.Next() {
+		prod, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, prod)
+	}
+	return products, rows.Err()
+}
+
+func (repo *DefaultRepository) RestoreProduct(id int) (Product, error) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	restored, err := scanProduct(repo.DB.QueryRow("UPDATE products SET deleted_at = NULL, version = version + 1 "+
+		"WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NOT NULL RETURNING "+productColumns, id, repo.tenant()))
+	if err == sql.ErrNoRows {
+		return Product{}, ErrNotInTrash
+	}
+	if err != nil {
+		return Product{}, productWriteError(err)
+	}
+	go repo.loadAllProducts()
+	return restored, nil
+}
+
+// PurgeProducts permanently removes trashed products of every tenant.
+func (repo *DefaultRepository) PurgeProducts(deletedBefore time.Time) (int64, error) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	result, err := repo.DB.Exec("DELETE FROM products WHERE deleted_at < $1", deletedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,106 @@
+package repo
+
+import (
+	"fmt"
+	"strings"
+)
+
+type (
+	ProductTransferRepository interface {
+		StreamProducts(visit func(Product) error) error
+		ImportProducts(products []Product, options ImportOptions) ([]ProductOperationResult, error)
+	}
+
+	ImportOptions struct {
+		// DryRun rolls the import back after validating every row.
+		DryRun bool
+		// Restore undeletes trashed products that rows match by id or sku
+		// instead of leaving them in the trash.
+		Restore bool
+	}
+)
+
+// StreamProducts hands every live product to visit straight from the
+// database cursor, bypassing the product cache.
+func (repo *DefaultRepository) StreamProducts(visit func(Product) error) error {
+	rows, err := repo.DB.Query("SELECT "+productColumns+" FROM products WHERE tenant_id = $1 AND deleted_at IS NULL ORDER BY id", repo.tenant())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return err
+		}
+		if err = visit(product); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+var skuUpsert = func() string {
+	assignments := make([]string, len(productFields))
+	for index, field := range productFields {
+		assignments[index] = fmt.Sprintf("%s = EXCLUDED.%s", field, field)
+	}
+	return "ON CONFLICT (tenant_id, sku) WHERE deleted_at IS NULL DO UPDATE SET " + strings.Join(assignments, ", ") + ", version = products.version + 1"
+}()
+
+// ImportProducts upserts live products by id, then by sku, and inserts the
+// rest. Failures are reported per product; a dry run rolls everything back.
+func (repo *DefaultRepository) ImportProducts(products []Product, options ImportOptions) ([]ProductOperationResult, error) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	tx, err := repo.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	results := make([]ProductOperationResult, len(products))
+	for index, product := range products {
+		product := product
+		result := &results[index]
+		result.Err = inSavepoint(tx, true, func() (err error) {
+			if options.Restore {
+				if err = repo.restoreImported(tx, product); err != nil {
+					return err
+				}
+			}
+			switch {
+			case product.Id > 0:
+				product.Version = 0
+				result.Product, err = repo.updateProduct(tx, product)
+			case product.Sku != "":
+				result.Product, err = repo.insertProduct(tx, product, skuUpsert)
+			default:
+				result.Product, err = repo.insertProduct(tx, product, "")
+			}
+			return err
+		})
+	}
+	if options.DryRun {
+		return results, nil
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	go repo.loadAllProducts()
+	return results, nil
+}
+
+// restoreImported undeletes the trashed product with the id of product or,
+// without an id, the most recently trashed one with its sku unless a live
+// product already holds that sku.
+func (repo *DefaultRepository) restoreImported(db executor, product Product) error {
+	var err error
+	if product.Id > 0 {
+		_, err = db.Exec("UPDATE products SET deleted_at = NULL WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NOT NULL", product.Id, repo.tenant())
+	} else if product.Sku != "" {
+		_, err = db.Exec("UPDATE products SET deleted_at = NULL WHERE id = (SELECT id FROM products "+
+			"WHERE tenant_id = $1 AND sku = $2 AND deleted_at IS NOT NULL ORDER BY deleted_at DESC LIMIT 1) "+
+			"AND NOT EXISTS (SELECT 1 FROM products WHERE tenant_id = $1 AND sku = $2 AND deleted_at IS NULL)", repo.tenant(), product.Sku)
+	}
+	return productWriteError(err)
+}
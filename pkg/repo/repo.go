@@ -9,12 +9,16 @@ import (
 
 type (
 	DefaultRepository struct {
-		Products []Product
-		Users    []User
-		DB       *sql.DB
+		Products       []Product
+		Users          []User
+		DB             *sql.DB
+		Tenant         string
+		ProductsLoaded func(products []Product)
 	}
 )
 
+const DefaultTenant = "default"
+
 var readMutex = &sync.Mutex{}
 var writeMutex = &sync.Mutex{}
 
@@ -41,4 +45,15 @@ func (repo *DefaultRepository) Close() {
 
 func New() *DefaultRepository {
 	return &DefaultRepository{Products: nil, Users: nil}
-}
\ No newline at end of file
+}
+
+func (repo *DefaultRepository) ForTenant(tenant string) *DefaultRepository {
+	return &DefaultRepository{DB: repo.DB, Tenant: tenant}
+}
+
+func (repo *DefaultRepository) tenant() string {
+	if repo.Tenant == "" {
+		return DefaultTenant
+	}
+	return repo.Tenant
+}
@@ -0,0 +1,176 @@
+package repo
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	HighlightStart = "<mark>"
+	HighlightStop  = "</mark>"
+
+	nameWeight        = 1.0
+	descriptionWeight = 0.4
+)
+
+type (
+	SearchRepository interface {
+		SearchProducts(query SearchQuery) ([]SearchResult, error)
+	}
+
+	SearchQuery struct {
+		Text   string
+		Limit  int
+		Offset int
+	}
+
+	SearchResult struct {
+		Product
+		Rank    float64 `json:"rank"`
+		Snippet string  `json:"snippet"`
+	}
+)
+
+// SearchProducts ranks products against the tenant's text search
+// configuration. Every term of the query is matched as a prefix.
+func (repo *DefaultRepository) SearchProducts(query SearchQuery) ([]SearchResult, error) {
+	results := make([]SearchResult, 0)
+	tsquery := prefixQuery(query.Text)
+	if tsquery == "" {
+		return results, nil
+	}
+	rows, err := repo.DB.Query("SELECT "+productColumns+", ts_rank(search, query) AS rank, "+
+		"ts_headline(settings.config, "+escapeHTML("name || ' ' || COALESCE(description, '')")+", query, 'StartSel="+HighlightStart+", StopSel="+HighlightStop+"') "+
+		"FROM products, (SELECT search_config AS config FROM tenants WHERE id = $1) settings, to_tsquery(settings.config, $2) query "+
+		"WHERE tenant_id = $1 AND deleted_at IS NULL AND search @@ query ORDER BY rank DESC, id LIMIT $3 OFFSET $4",
+		repo.tenant(), tsquery, query.Limit, query.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		result := SearchResult{}
+		if result.Product, err = scanProduct(rows, &result.Rank, &result.Snippet); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// escapeHTML wraps a SQL text expression so that it yields HTML-escaped text.
+// Snippets are rendered as HTML, so only the highlight markers may be markup.
+// The text search parser keeps named entities intact as single tokens.
+func escapeHTML(expression string) string {
+	for _, replacement := range [][2]string{{"&", "&amp;"}, {"<", "&lt;"}, {">", "&gt;"}} {
+		expression = "replace(" + expression + ", '" + replacement[0] + "', '" + replacement[1] + "')"
+	}
+	return expression
+}
+
+// MatchProducts is the in-process counterpart of SearchProducts for
+// repositories without a database. It does prefix matching without stemming.
+func MatchProducts(products []Product, query SearchQuery) []SearchResult {
+	terms := searchTerms(query.Text)
+	results := make([]SearchResult, 0)
+	if len(terms) == 0 {
+		return results
+	}
+	for _, product := range products {
+		nameWords, descriptionWords := searchTerms(product.Name), searchTerms(product.Description)
+		rank := 0.0
+		for _, term := range terms {
+			termRank := 0.0
+			if matchesPrefix(nameWords, term) {
+				termRank += nameWeight
+			}
+			if matchesPrefix(descriptionWords, term) {
+				termRank += descriptionWeight
+			}
+			if termRank == 0 {
+				rank = 0
+				break
+			}
+			rank += termRank
+		}
+		if rank == 0 {
+			continue
+		}
+		text := strings.TrimSpace(product.Name + " " + product.Description)
+		results = append(results, SearchResult{Product: product, Rank: rank / float64(len(terms)), Snippet: highlight(text, terms)})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].Id < results[j].Id
+	})
+	if query.Offset >= len(results) {
+		return results[:0]
+	}
+	results = results[query.Offset:]
+	if query.Limit > 0 && query.Limit < len(results) {
+		results = results[:query.Limit]
+	}
+	return results
+}
+
+func prefixQuery(text string) string {
+	terms := searchTerms(text)
+	for index, term := range terms {
+		terms[index] = term + ":*"
+	}
+	return strings.Join(terms, " & ")
+}
+
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func matchesPrefix(words []string, term string) bool {
+	for _, word := range words {
+		if strings.HasPrefix(word, term) {
+			return true
+		}
+	}
+	return false
+}
+
+func highlight(text string, terms []string) string {
+	var builder strings.Builder
+	word := make([]rune, 0)
+	flush := func() {
+		if len(word) == 0 {
+			return
+		}
+		if matchesAnyTerm(strings.ToLower(string(word)), terms) {
+			builder.WriteString(HighlightStart + html.EscapeString(string(word)) + HighlightStop)
+		} else {
+			builder.WriteString(html.EscapeString(string(word)))
+		}
+		word = word[:0]
+	}
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			word = append(word, r)
+			continue
+		}
+		flush()
+		builder.WriteString(html.EscapeString(string(r)))
+	}
+	flush()
+	return builder.String()
+}
+
+func matchesAnyTerm(word string, terms []string) bool {
+	for _, term := range terms {
+		if strings.HasPrefix(word, term) {
+			return true
+		}
+	}
+	return false
+}
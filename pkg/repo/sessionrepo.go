@@ -0,0 +1,81 @@
+package repo
+
+import (
+	"errors"
+	"time"
+)
+
+type (
+	SessionRepository interface {
+		AddSession(session Session) error
+		GetSession(id string) (Session, error)
+		SessionsByUsername(username string, activeSince time.Time) ([]Session, error)
+		TouchSession(id string, lastSeen time.Time) error
+		RevokeSession(username, id string) error
+		RevokeAllSessions(username string) error
+	}
+
+	Session struct {
+		Id       string    `json:"id"`
+		Username string    `json:"-"`
+		Created  time.Time `json:"created"`
+		LastSeen time.Time `json:"lastSeen"`
+		Revoked  bool      `json:"-"`
+		Current  bool      `json:"current"`
+	}
+)
+
+func (repo *DefaultRepository) AddSession(session Session) error {
+	_, err := repo.DB.Exec("INSERT INTO sessions (tenant_id, id, username, created, last_seen) VALUES ($1, $2, $3, $4, $5)",
+		repo.tenant(), session.Id, session.Username, session.Created, session.LastSeen)
+	return err
+}
+
+func (repo *DefaultRepository) GetSession(id string) (Session, error) {
+	session := Session{}
+	row := repo.DB.QueryRow("SELECT id, username, created, last_seen, revoked FROM sessions WHERE id = $1 AND tenant_id = $2", id, repo.tenant())
+	err := row.Scan(&session.Id, &session.Username, &session.Created, &session.LastSeen, &session.Revoked)
+	if err != nil {
+		return Session{}, errors.New("session not found")
+	}
+	return session, nil
+}
+
+func (repo *DefaultRepository) SessionsByUsername(username string, activeSince time.Time) ([]Session, error) {
+	rows, err := repo.DB.Query("SELECT id, username, created, last_seen, revoked FROM sessions "+
+		"WHERE username = $1 AND NOT revoked AND last_seen >= $2 AND tenant_id = $3 ORDER BY last_seen DESC", username, activeSince, repo.tenant())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := make([]Session, 0)
+	for rows.Next() {
+		session := Session{}
+		if err = rows.Scan(&session.Id, &session.Username, &session.Created, &session.LastSeen, &session.Revoked); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (repo *DefaultRepository) TouchSession(id string, lastSeen time.Time) error {
+	_, err := repo.DB.Exec("UPDATE sessions SET last_seen = $1 WHERE id = $2 AND tenant_id = $3", lastSeen, id, repo.tenant())
+	return err
+}
+
+func (repo *DefaultRepository) RevokeSession(username, id string) error {
+	result, err := repo.DB.Exec("UPDATE sessions SET revoked = TRUE WHERE id = $1 AND username = $2 AND tenant_id = $3", id, username, repo.tenant())
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return errors.New("session not found")
+	}
+	return nil
+}
+
+func (repo *DefaultRepository) RevokeAllSessions(username string) error {
+	_, err := repo.DB.Exec("UPDATE sessions SET revoked = TRUE WHERE username = $1 AND tenant_id = $2", username, repo.tenant())
+	return err
+}
@@ -0,0 +1,32 @@
+package repo
+
+type (
+	SuggestRepository interface {
+		SuggestProducts(text string, limit int) ([]Suggestion, error)
+	}
+
+	Suggestion struct {
+		Id   int    `json:"id"`
+		Name string `json:"name"`
+	}
+)
+
+// SuggestProducts finds product names resembling text by trigram word
+// similarity, which tolerates typos in partially typed input.
+func (repo *DefaultRepository) SuggestProducts(text string, limit int) ([]Suggestion, error) {
+	rows, err := repo.DB.Query("SELECT id, name FROM products WHERE tenant_id = $1 AND deleted_at IS NULL AND $2 <% name "+
+		"ORDER BY word_similarity($2, name) DESC, name LIMIT $3", repo.tenant(), text, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	suggestions := make([]Suggestion, 0)
+	for rows.Next() {
+		suggestion := Suggestion{}
+		if err = rows.Scan(&suggestion.Id, &suggestion.Name); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+	return suggestions, rows.Err()
+}
@@ -0,0 +1,28 @@
+package repo
+
+import (
+	"errors"
+	"time"
+)
+
+type (
+	TenantRepository interface {
+		GetTenant(id string) (Tenant, error)
+	}
+
+	Tenant struct {
+		Id      string    `json:"id"`
+		Name    string    `json:"name"`
+		Created time.Time `json:"created"`
+	}
+)
+
+func (repo *DefaultRepository) GetTenant(id string) (Tenant, error) {
+	tenant := Tenant{}
+	row := repo.DB.QueryRow("SELECT id, name, created FROM tenants WHERE id = $1", id)
+	err := row.Scan(&tenant.Id, &tenant.Name, &tenant.Created)
+	if err != nil {
+		return Tenant{}, errors.New("tenant not found")
+	}
+	return tenant, nil
+}
@@ -0,0 +1,109 @@
+package repo
+
+import "time"
+
+type (
+	TwoFactorRepository interface {
+		SetTOTPSecret(username, secret string, enabled bool) error
+		UseTOTPStep(username string, step int64) (bool, error)
+		CountTwoFactorAttempt(challengeId string, expiredBefore time.Time) (int, error)
+		SetRecoveryCodes(username string, codeHashes []string) error
+		RecoveryCodes(username string) ([]RecoveryCode, error)
+		UseRecoveryCode(id int) (bool, error)
+	}
+
+	RecoveryCode struct {
+		Id       int
+		Username string
+		CodeHash string
+	}
+)
+
+func (repo *DefaultRepository) SetTOTPSecret(username, secret string, enabled bool) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	_, err := repo.DB.Exec("UPDATE users SET totp_secret = NULLIF($1, ''), totp_enabled = $2 WHERE username = $3 AND tenant_id = $4", secret, enabled, username, repo.tenant())
+	if err != nil {
+		return err
+	}
+	go repo.loadAllUsers()
+	return nil
+}
+
+// UseTOTPStep records step as the last time step accepted for username. It
+// reports false when that step or a later one was already used.
+func (repo *DefaultRepository) UseTOTPStep(username string, step int64) (bool, error) {
+	result, err := repo.DB.Exec("UPDATE users SET totp_last_step = $1 WHERE username = $2 AND tenant_id = $3 AND totp_last_step < $1",
+		step, username, repo.tenant())
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// CountTwoFactorAttempt records an attempt on the challenge and returns the
+// number of attempts made so far. Counters of expired challenges are dropped.
+func (repo *DefaultRepository) CountTwoFactorAttempt(challengeId string, expiredBefore time.Time) (int, error) {
+	_, err := repo.DB.Exec("DELETE FROM two_factor_attempts WHERE tenant_id = $1 AND created < $2", repo.tenant(), expiredBefore)
+	if err != nil {
+		return 0, err
+	}
+	var attempts int
+	err = repo.DB.QueryRow("INSERT INTO two_factor_attempts (tenant_id, challenge_id) VALUES ($1, $2) "+
+		"ON CONFLICT (tenant_id, challenge_id) DO UPDATE SET attempts = two_factor_attempts.attempts + 1 RETURNING attempts",
+		repo.tenant(), challengeId).Scan(&attempts)
+	return attempts, err
+}
+
+func (repo *DefaultRepository) SetRecoveryCodes(username string, codeHashes []string) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	tx, err := repo.DB.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE username = $1 AND tenant_id = $2", username, repo.tenant())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for _, codeHash := range codeHashes {
+		_, err = tx.Exec("INSERT INTO recovery_codes (tenant_id, username, code_hash) VALUES ($1, $2, $3)", repo.tenant(), username, codeHash)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (repo *DefaultRepository) RecoveryCodes(username string) ([]RecoveryCode, error) {
+	rows, err := repo.DB.Query("SELECT id, username, code_hash FROM recovery_codes WHERE username = $1 AND tenant_id = $2", username, repo.tenant())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	codes := make([]RecoveryCode, 0)
+	for rows.Next() {
+		code := RecoveryCode{}
+		if err = rows.Scan(&code.Id, &code.Username, &code.CodeHash); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, rows.Err()
+}
+
+// UseRecoveryCode deletes the recovery code. It reports false when a
+// concurrent login already used it.
+func (repo *DefaultRepository) UseRecoveryCode(id int) (bool, error) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	result, err := repo.DB.Exec("DELETE FROM recovery_codes WHERE id = $1 AND tenant_id = $2", id, repo.tenant())
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
@@ -0,0 +1,76 @@
+package repo
+
+import "database/sql"
+
+type (
+	UserAdminRepository interface {
+		ListUsers(query UserQuery) (UserPage, error)
+		GetUser(username string) (User, error)
+		SetUserRole(username string, role Role) error
+		SetUserDisabled(username string, disabled bool) error
+	}
+
+	UserQuery struct {
+		Search   string
+		Role     Role
+		Page     int
+		PageSize int
+	}
+
+	UserPage struct {
+		Users    []User `json:"users"`
+		Total    int    `json:"total"`
+		Page     int    `json:"page"`
+		PageSize int    `json:"pageSize"`
+	}
+)
+
+const userFilter = "WHERE ($1 = '' OR username ILIKE '%' || $1 || '%' OR email ILIKE '%' || $1 || '%') AND ($2 = '' OR role = $2) AND tenant_id = $3"
+
+func (repo *DefaultRepository) ListUsers(query UserQuery) (UserPage, error) {
+	page := UserPage{Users: make([]User, 0), Page: query.Page, PageSize: query.PageSize}
+	err := repo.DB.QueryRow("SELECT count(*) FROM users "+userFilter, query.Search, query.Role, repo.tenant()).Scan(&page.Total)
+	if err != nil {
+		return UserPage{}, err
+	}
+	rows, err := repo.DB.Query("SELECT id, username, role, COALESCE(email, ''), verified, totp_enabled, disabled FROM users "+
+		userFilter+" ORDER BY username LIMIT $4 OFFSET $5",
+		query.Search, query.Role, repo.tenant(), query.PageSize, (query.Page-1)*query.PageSize)
+	if err != nil {
+		return UserPage{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		user := User{}
+		err = rows.Scan(&user.Id, &user.Username, &user.Role, &user.Email, &user.Verified, &user.TOTPEnabled, &user.Disabled)
+		if err != nil {
+			return UserPage{}, err
+		}
+		page.Users = append(page.Users, user)
+	}
+	return page, rows.Err()
+}
+
+// GetUser reads username from the database rather than the user cache, which
+// lags behind writes.
+func (repo *DefaultRepository) GetUser(username string) (User, error) {
+	user := User{}
+	err := repo.DB.QueryRow("SELECT id, username, role, COALESCE(email, ''), verified, totp_enabled, disabled FROM users "+
+		"WHERE username = $1 AND tenant_id = $2", username, repo.tenant()).
+		Scan(&user.Id, &user.Username, &user.Role, &user.Email, &user.Verified, &user.TOTPEnabled, &user.Disabled)
+	if err == sql.ErrNoRows {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+func (repo *DefaultRepository) SetUserDisabled(username string, disabled bool) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	_, err := repo.DB.Exec("UPDATE users SET disabled = $1 WHERE username = $2 AND tenant_id = $3", disabled, username, repo.tenant())
+	if err != nil {
+		return err
+	}
+	go repo.loadAllUsers()
+	return nil
+}
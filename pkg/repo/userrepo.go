@@ -6,18 +6,27 @@ type (
 	UserRepository interface {
 		AddUser(u User) error
 		GetByUsername(username string) (User, error)
+		UpdateUser(u User) error
+		RemoveUser(username string) error
 	}
 
 	User struct {
-		Id       int    `json:"id"`
-		Username string `json:"username"`
-		Password string `json:"password"`
-		Role     Role `json:"role"`
+		Id          int    `json:"id"`
+		Username    string `json:"username"`
+		Password    string `json:"-"`
+		Role        Role   `json:"role"`
+		Email       string `json:"email"`
+		Verified    bool   `json:"verified"`
+		TOTPSecret  string `json:"-"`
+		TOTPEnabled bool   `json:"totpEnabled"`
+		Disabled    bool   `json:"disabled"`
 	}
 
 	Role string
 )
 
+var ErrUserNotFound = errors.New("user not found")
+
 const (
 	ADMIN Role = "ADMIN"
 	USER  Role = "USER"
@@ -28,13 +37,13 @@ func (repo *DefaultRepository) loadAllUsers() {
 	defer readMutex.Unlock()
 	repo.Users = make([]User, 0)
 
-	rows, err := repo.DB.Query("SELECT * from users")
+	rows, err := repo.DB.Query("SELECT id, username, password, role, COALESCE(email, ''), verified, COALESCE(totp_secret, ''), totp_enabled, disabled from users WHERE tenant_id = $1", repo.tenant())
 	if err != nil {
 		panic(err)
 	}
 	for rows.Next() {
 		user := User{}
-		err = rows.Scan(&user.Id, &user.Username, &user.Password, &user.Role)
+		err = rows.Scan(&user.Id, &user.Username, &user.Password, &user.Role, &user.Email, &user.Verified, &user.TOTPSecret, &user.TOTPEnabled, &user.Disabled)
 		if err != nil {
 			panic(err)
 		}
@@ -45,7 +54,8 @@ func (repo *DefaultRepository) loadAllUsers() {
 func (repo *DefaultRepository) AddUser(u User) error {
 	writeMutex.Lock()
 	defer writeMutex.Unlock()
-	_, err := repo.DB.Exec("INSERT INTO users (username, password, role) VALUES ($1, $2, $3)", u.Username, u.Password, u.Role)
+	_, err := repo.DB.Exec("INSERT INTO users (tenant_id, username, password, role, email, verified) VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)",
+		repo.tenant(), u.Username, u.Password, u.Role, u.Email, u.Verified)
 	if err != nil {
 		return err
 	}
@@ -62,5 +72,50 @@ func (repo *DefaultRepository) GetByUsername(username string) (User, error) {
 			return usr, nil
 		}
 	}
-	return User{}, errors.New("user not found")
+	return User{}, ErrUserNotFound
+}
+
+func (repo *DefaultRepository) UpdateUser(u User) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	result, err := repo.DB.Exec("UPDATE users SET password = $1, email = NULLIF($2, ''), verified = $3 WHERE username = $4 AND tenant_id = $5",
+		u.Password, u.Email, u.Verified, u.Username, repo.tenant())
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrUserNotFound
+	}
+	go repo.loadAllUsers()
+	return nil
+}
+
+func (repo *DefaultRepository) RemoveUser(username string) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	tx, err := repo.DB.Begin()
+	if err != nil {
+		return err
+	}
+	statements := []string{
+		"DELETE FROM sessions WHERE username = $1 AND tenant_id = $2",
+		"DELETE FROM user_roles WHERE username = $1 AND tenant_id = $2",
+		"DELETE FROM recovery_codes WHERE username = $1 AND tenant_id = $2",
+		"DELETE FROM verification_tokens WHERE username = $1 AND tenant_id = $2",
+		"DELETE FROM external_identities WHERE username = $1 AND tenant_id = $2",
+		"DELETE FROM api_keys WHERE (created_by = $1 OR (owner = $1 AND owner_type = 'user')) AND tenant_id = $2",
+		"DELETE FROM users WHERE username = $1 AND tenant_id = $2",
+	}
+	for _, statement := range statements {
+		if _, err = tx.Exec(statement, username, repo.tenant()); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	go repo.loadAllUsers()
+	return nil
 }
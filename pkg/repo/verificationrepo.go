@@ -0,0 +1,58 @@
+package repo
+
+import (
+	"errors"
+	"time"
+)
+
+type (
+	VerificationRepository interface {
+		AddVerificationToken(token VerificationToken) error
+		GetVerificationToken(tokenHash string) (VerificationToken, error)
+		RemoveVerificationToken(tokenHash string) error
+		SetUserVerified(username string) error
+	}
+
+	VerificationToken struct {
+		TokenHash string
+		Username  string
+		Purpose   string
+		Expires   time.Time
+	}
+)
+
+func (repo *DefaultRepository) AddVerificationToken(token VerificationToken) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	_, err := repo.DB.Exec("INSERT INTO verification_tokens (tenant_id, token_hash, username, purpose, expires) VALUES ($1, $2, $3, $4, $5)",
+		repo.tenant(), token.TokenHash, token.Username, token.Purpose, token.Expires)
+	return err
+}
+
+func (repo *DefaultRepository) GetVerificationToken(tokenHash string) (VerificationToken, error) {
+	token := VerificationToken{}
+	row := repo.DB.QueryRow("SELECT token_hash, username, purpose, expires FROM verification_tokens WHERE token_hash = $1 AND tenant_id = $2", tokenHash, repo.tenant())
+	err := row.Scan(&token.TokenHash, &token.Username, &token.Purpose, &token.Expires)
+	if err != nil {
+		return VerificationToken{}, errors.New("verification token not found")
+	}
+	return token, nil
+}
+
+func (repo *DefaultRepository) RemoveVerificationToken(tokenHash string) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	_, err := repo.DB.Exec("DELETE FROM verification_tokens WHERE token_hash = $1 AND tenant_id = $2", tokenHash, repo.tenant())
+	return err
+}
+
+func (repo *DefaultRepository) SetUserVerified(username string) error {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	_, err := repo.DB.Exec("UPDATE users SET verified = TRUE WHERE username = $1 AND tenant_id = $2", username, repo.tenant())
+	if err != nil {
+		return err
+	}
+	go repo.loadAllUsers()
+	return nil
+}
@@ -0,0 +1,120 @@
+package suggest
+
+import (
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// candidatesPerResult bounds how many matches are ranked per requested result.
+const candidatesPerResult = 8
+
+type (
+	// Index is a trie over every word-initial suffix of the product names,
+	// so that "jack" completes both "Jacket" and "Rain jacket".
+	Index struct {
+		mutex sync.RWMutex
+		root  *node
+	}
+
+	node struct {
+		children map[rune]*node
+		entries  []entry
+	}
+
+	entry struct {
+		suggestion repo.Suggestion
+		nameStart  bool
+	}
+)
+
+func NewIndex() *Index {
+	return &Index{root: newNode()}
+}
+
+func newNode() *node {
+	return &node{children: make(map[rune]*node)}
+}
+
+// Rebuild replaces the indexed products. It is meant to be installed as
+// repo.DefaultRepository.ProductsLoaded to follow every product write.
+func (index *Index) Rebuild(products []repo.Product) {
+	root := newNode()
+	for _, product := range products {
+		words := strings.Fields(strings.ToLower(product.Name))
+		for start := range words {
+			current := root
+			for _, r := range strings.Join(words[start:], " ") {
+				child, ok := current.children[r]
+				if !ok {
+					child = newNode()
+					current.children[r] = child
+				}
+				current = child
+			}
+			current.entries = append(current.entries, entry{
+				suggestion: repo.Suggestion{Id: product.Id, Name: product.Name},
+				nameStart:  start == 0,
+			})
+		}
+	}
+	index.mutex.Lock()
+	index.root = root
+	index.mutex.Unlock()
+}
+
+// Complete returns up to limit products with a name or name word starting
+// with prefix. Names starting with prefix rank first, then shorter names.
+func (index *Index) Complete(prefix string, limit int) []repo.Suggestion {
+	index.mutex.RLock()
+	current := index.root
+	index.mutex.RUnlock()
+	for _, r := range strings.Join(strings.Fields(strings.ToLower(prefix)), " ") {
+		if current = current.children[r]; current == nil {
+			return []repo.Suggestion{}
+		}
+	}
+	candidates := make([]entry, 0)
+	current.collect(&candidates, limit*candidatesPerResult)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].nameStart != candidates[j].nameStart {
+			return candidates[i].nameStart
+		}
+		if len(candidates[i].suggestion.Name) != len(candidates[j].suggestion.Name) {
+			return len(candidates[i].suggestion.Name) < len(candidates[j].suggestion.Name)
+		}
+		return candidates[i].suggestion.Name < candidates[j].suggestion.Name
+	})
+	seen := make(map[int]bool)
+	suggestions := make([]repo.Suggestion, 0, limit)
+	for _, candidate := range candidates {
+		if len(suggestions) == limit {
+			break
+		}
+		if !seen[candidate.suggestion.Id] {
+			seen[candidate.suggestion.Id] = true
+			suggestions = append(suggestions, candidate.suggestion)
+		}
+	}
+	return suggestions
+}
+
+// collect gathers entries breadth first, so the shortest completions are
+// kept when max cuts the search short.
+func (current *node) collect(candidates *[]entry, max int) {
+	queue := []*node{current}
+	for len(queue) > 0 && len(*candidates) < max {
+		next := queue[0]
+		queue = queue[1:]
+		*candidates = append(*candidates, next.entries...)
+		runes := make([]rune, 0, len(next.children))
+		for r := range next.children {
+			runes = append(runes, r)
+		}
+		sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+		for _, r := range runes {
+			queue = append(queue, next.children[r])
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package suggest
+
+import (
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"testing"
+)
+
+func names(suggestions []repo.Suggestion) []string {
+	result := make([]string, len(suggestions))
+	for index, suggestion := range suggestions {
+		result[index] = suggestion.Name
+	}
+	return result
+}
+
+func equal(left, right []string) bool {
+	if len(left) != len(right) {
+		return false
+	}
+	for index := range left {
+		if left[index] != right[index] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestComplete(t *testing.T) {
+	index := NewIndex()
+	index.Rebuild([]repo.Product{
+		{Id: 1, Name: "Jacke"},
+		{Id: 2, Name: "Rote  Jacke"},
+		{Id: 3, Name: "Jackett"},
+		{Id: 4, Name: "Jeans"},
+		{Id: 5, Name: "Jacke Jacke"},
+	})
+	tests := []struct {
+		prefix   string
+		limit    int
+		expected []string
+	}{
+		{"jac", 10, []string{"Jacke", "Jackett", "Jacke Jacke", "Rote  Jacke"}},
+		{"J", 2, []string{"Jacke", "Jeans"}},
+		{"rote ja", 10, []string{"Rote  Jacke"}},
+		{"jacke j", 10, []string{"Jacke Jacke"}},
+		{"hose", 10, []string{}},
+	}
+	for _, test := range tests {
+		if received := names(index.Complete(test.prefix, test.limit)); !equal(received, test.expected) {
+			t.Errorf("expected %v, received %v", test.expected, received)
+		}
+	}
+}
+
+func TestRebuildReplacesProducts(t *testing.T) {
+	index := NewIndex()
+	index.Rebuild([]repo.Product{{Id: 1, Name: "Jacke"}})
+	index.Rebuild([]repo.Product{{Id: 1, Name: "Mantel"}})
+	if received := names(index.Complete("ja", 10)); len(received) != 0 {
+		t.Errorf("expected no suggestions, received %v", received)
+	}
+	if received := names(index.Complete("man", 10)); !equal(received, []string{"Mantel"}) {
+		t.Errorf("expected %v, received %v", []string{"Mantel"}, received)
+	}
+}
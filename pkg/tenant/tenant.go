@@ -0,0 +1,123 @@
+package tenant
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"github.com/segfaultx/simple_rest/pkg/auth"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	Header       = "X-Tenant-ID"
+	bearerPrefix = "Bearer "
+)
+
+type (
+	Resolver struct {
+		BaseDomain string
+	}
+
+	Dispatcher struct {
+		Resolver Resolver
+		Tenants  repo.TenantRepository
+		Build    func(tenant string) http.Handler
+		mutex    sync.Mutex
+		handlers map[string]*tenantHandler
+	}
+
+	tenantHandler struct {
+		once    sync.Once
+		handler http.Handler
+	}
+)
+
+// Resolve picks the tenant of request from its subdomain of BaseDomain. The
+// Header is unauthenticated, so it is only honoured without a BaseDomain.
+func (resolver Resolver) Resolve(request *http.Request) string {
+	if resolver.BaseDomain == "" {
+		if tenant := request.Header.Get(Header); tenant != "" {
+			return tenant
+		}
+	}
+	if tenant := resolver.fromHost(request.Host); tenant != "" {
+		return tenant
+	}
+	if tenant := fromToken(request); tenant != "" {
+		return tenant
+	}
+	return repo.DefaultTenant
+}
+
+func (resolver Resolver) fromHost(host string) string {
+	if resolver.BaseDomain == "" {
+		return ""
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	suffix := "." + strings.TrimPrefix(resolver.BaseDomain, ".")
+	if !strings.HasSuffix(host, suffix) {
+		return ""
+	}
+	subdomain := strings.TrimSuffix(host, suffix)
+	if subdomain == "" || strings.Contains(subdomain, ".") {
+		return ""
+	}
+	return subdomain
+}
+
+func fromToken(request *http.Request) string {
+	tokenString := ""
+	if authorization := request.Header.Get("Authorization"); strings.HasPrefix(authorization, bearerPrefix) {
+		tokenString = strings.TrimPrefix(authorization, bearerPrefix)
+	} else if cookie, err := request.Cookie("token"); err == nil {
+		tokenString = cookie.Value
+	}
+	if tokenString == "" {
+		return ""
+	}
+	claims := &auth.Claims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(tokenString, claims); err != nil {
+		return ""
+	}
+	return claims.Tenant
+}
+
+func (dispatcher *Dispatcher) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	handler, err := dispatcher.handlerFor(dispatcher.Resolver.Resolve(request))
+	if err != nil {
+		writer.WriteHeader(http.StatusNotFound)
+		_, _ = writer.Write([]byte("unknown tenant"))
+		return
+	}
+	handler.ServeHTTP(writer, request)
+}
+
+func (dispatcher *Dispatcher) handlerFor(tenant string) (http.Handler, error) {
+	dispatcher.mutex.Lock()
+	entry, ok := dispatcher.handlers[tenant]
+	dispatcher.mutex.Unlock()
+	if !ok {
+		if _, err := dispatcher.Tenants.GetTenant(tenant); err != nil {
+			return nil, err
+		}
+		dispatcher.mutex.Lock()
+		if dispatcher.handlers == nil {
+			dispatcher.handlers = make(map[string]*tenantHandler)
+		}
+		if entry, ok = dispatcher.handlers[tenant]; !ok {
+			entry = &tenantHandler{}
+			dispatcher.handlers[tenant] = entry
+		}
+		dispatcher.mutex.Unlock()
+	}
+	// Building loads the products of the tenant, so it runs outside the
+	// mutex and only requests for the same tenant wait for it.
+	entry.once.Do(func() {
+		entry.handler = dispatcher.Build(tenant)
+	})
+	return entry.handler, nil
+}
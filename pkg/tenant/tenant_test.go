@@ -0,0 +1,82 @@
+package tenant
+
+import (
+	"errors"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type mockTenantRepo struct {
+	Tenants map[string]repo.Tenant
+}
+
+func (mockRepo *mockTenantRepo) GetTenant(id string) (repo.Tenant, error) {
+	tenant, ok := mockRepo.Tenants[id]
+	if !ok {
+		return repo.Tenant{}, errors.New("tenant not found")
+	}
+	return tenant, nil
+}
+
+func TestResolver_Resolve(t *testing.T) {
+	resolver := Resolver{BaseDomain: "shop.example"}
+	cases := []struct {
+		host     string
+		header   string
+		expected string
+	}{
+		{"shop.example", "", repo.DefaultTenant},
+		{"boots.shop.example:8080", "", "boots"},
+		{"a.b.shop.example", "", repo.DefaultTenant},
+		{"boots.shop.example", "hats", "boots"},
+		{"shop.example", "hats", repo.DefaultTenant},
+		{"localhost:8080", "", repo.DefaultTenant},
+	}
+	for _, c := range cases {
+		request := httptest.NewRequest("GET", "/catalog/products", nil)
+		request.Host = c.host
+		if c.header != "" {
+			request.Header.Set(Header, c.header)
+		}
+		if tenant := resolver.Resolve(request); tenant != c.expected {
+			t.Errorf("%s: expected %v, received %v", c.host, c.expected, tenant)
+		}
+	}
+	request := httptest.NewRequest("GET", "/catalog/products", nil)
+	request.Header.Set(Header, "hats")
+	if tenant := (Resolver{}).Resolve(request); tenant != "hats" {
+		t.Errorf("expected %v, received %v", "hats", tenant)
+	}
+}
+
+func TestDispatcher_UnknownTenant(t *testing.T) {
+	built := 0
+	dispatcher := &Dispatcher{
+		Tenants: &mockTenantRepo{Tenants: map[string]repo.Tenant{repo.DefaultTenant: {Id: repo.DefaultTenant}}},
+		Build: func(tenant string) http.Handler {
+			built++
+			return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				_, _ = writer.Write([]byte(tenant))
+			})
+		},
+	}
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		dispatcher.ServeHTTP(rr, httptest.NewRequest("GET", "/catalog/products", nil))
+		if rr.Code != http.StatusOK || rr.Body.String() != repo.DefaultTenant {
+			t.Errorf("unexpected response %d %q", rr.Code, rr.Body.String())
+		}
+	}
+	if built != 1 {
+		t.Errorf("expected handler to be built once, built %d times", built)
+	}
+	request := httptest.NewRequest("GET", "/catalog/products", nil)
+	request.Header.Set(Header, "unknown")
+	rr := httptest.NewRecorder()
+	dispatcher.ServeHTTP(rr, request)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected %v, received %v", http.StatusNotFound, rr.Code)
+	}
+}
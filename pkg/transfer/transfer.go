@@ -0,0 +1,313 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"io"
+	"mime"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+
+	maxLineBytes = 1 << 20
+
+	// tagSeparator joins the tags of a product within the CSV tags column.
+	tagSeparator = "|"
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown format, expected csv or ndjson")
+	csvColumns       = []string{"id", "sku", "name", "description", "price", "brand", "stock", "tags", "attributes"}
+)
+
+type (
+	Encoder interface {
+		Encode(product repo.Product) error
+		Flush() error
+	}
+
+	LineError struct {
+		Line  int    `json:"line"`
+		Error string `json:"error"`
+	}
+
+	Report struct {
+		DryRun    bool        `json:"dryRun"`
+		Processed int         `json:"processed"`
+		Imported  int         `json:"imported"`
+		Errors    []LineError `json:"errors"`
+	}
+
+	csvEncoder struct {
+		writer *csv.Writer
+	}
+
+	ndjsonEncoder struct {
+		writer  *bufio.Writer
+		encoder *json.Encoder
+	}
+
+	// DecodeError marks input Import could not read, as opposed to a failing store.
+	DecodeError struct {
+		Err error
+	}
+)
+
+func (err *DecodeError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *DecodeError) Unwrap() error {
+	return err.Err
+}
+
+func ContentType(format string) string {
+	if format == FormatCSV {
+		return "text/csv; charset=UTF-8"
+	}
+	return "application/x-ndjson"
+}
+
+func FormatFromContentType(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/csv":
+		return FormatCSV
+	case "application/x-ndjson", "application/jsonl":
+		return FormatNDJSON
+	}
+	return ""
+}
+
+func FormatFromFilename(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return FormatCSV
+	case ".ndjson", ".jsonl":
+		return FormatNDJSON
+	}
+	return ""
+}
+
+func NewEncoder(writer io.Writer, format string) (Encoder, error) {
+	switch format {
+	case FormatCSV:
+		encoder := &csvEncoder{writer: csv.NewWriter(writer)}
+		return encoder, encoder.writer.Write(csvColumns)
+	case FormatNDJSON:
+		buffered := bufio.NewWriter(writer)
+		return &ndjsonEncoder{writer: buffered, encoder: json.NewEncoder(buffered)}, nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+func (encoder *csvEncoder) Encode(product repo.Product) error {
+	attributes := ""
+	if len(product.Attributes) > 0 {
+		encoded, err := json.Marshal(product.Attributes)
+		if err != nil {
+			return err
+		}
+		attributes = string(encoded)
+	}
+	return encoder.writer.Write([]string{strconv.Itoa(product.Id), product.Sku, product.Name, product.Description,
+		product.Price.String(), product.Brand, strconv.Itoa(product.Stock),
+		strings.Join(product.Tags, tagSeparator), attributes})
+}
+
+func (encoder *csvEncoder) Flush() error {
+	encoder.writer.Flush()
+	return encoder.writer.Error()
+}
+
+func (encoder *ndjsonEncoder) Encode(product repo.Product) error {
+	return encoder.encoder.Encode(product)
+}
+
+func (encoder *ndjsonEncoder) Flush() error {
+	return encoder.writer.Flush()
+}
+
+// Decode parses reader row by row. Row errors are handed to visit, only
+// errors that make the rest of the input unreadable are returned.
+func Decode(reader io.Reader, format string, visit func(line int, product repo.Product, err error)) error {
+	switch format {
+	case FormatCSV:
+		return decodeCSV(reader, visit)
+	case FormatNDJSON:
+		return decodeNDJSON(reader, visit)
+	}
+	return ErrUnknownFormat
+}
+
+func decodeCSV(reader io.Reader, visit func(line int, product repo.Product, err error)) error {
+	csvReader := csv.NewReader(reader)
+	header, err := csvReader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	columns := make(map[string]int)
+	for index, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if !knownColumn(column) {
+			return fmt.Errorf("line 1: unknown column %q", column)
+		}
+		columns[column] = index
+	}
+	if _, ok := columns["name"]; !ok {
+		return errors.New("line 1: missing column \"name\"")
+	}
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if parseErr, malformed := err.(*csv.ParseError); malformed {
+			visit(parseErr.StartLine, repo.Product{}, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// quoted fields may span several lines, so take the line the record starts on
+		line, _ := csvReader.FieldPos(0)
+		product := repo.Product{Name: record[columns["name"]]}
+		if index, ok := columns["sku"]; ok {
+			product.Sku = strings.TrimSpace(record[index])
+		}
+		if index, ok := columns["description"]; ok {
+			product.Description = record[index]
+		}
+		if index, ok := columns["brand"]; ok {
+			product.Brand = strings.TrimSpace(record[index])
+		}
+		if index, ok := columns["tags"]; ok && strings.TrimSpace(record[index]) != "" {
+			product.Tags = strings.Split(record[index], tagSeparator)
+		}
+		if err = parseNumbers(columns, record, &product); err != nil {
+			visit(line, repo.Product{}, err)
+			continue
+		}
+		if index, ok := columns["attributes"]; ok && strings.TrimSpace(record[index]) != "" {
+			if err = json.Unmarshal([]byte(record[index]), &product.Attributes); err != nil {
+				visit(line, repo.Product{}, fmt.Errorf("invalid attributes %q", record[index]))
+				continue
+			}
+		}
+		visit(line, product, nil)
+	}
+}
+
+func parseNumbers(columns map[string]int, record []string, product *repo.Product) error {
+	value := func(column string) string {
+		if index, ok := columns[column]; ok {
+			return strings.TrimSpace(record[index])
+		}
+		return ""
+	}
+	var err error
+	if id := value("id"); id != "" {
+		if product.Id, err = strconv.Atoi(id); err != nil || product.Id < 1 {
+			return fmt.Errorf("invalid id %q", id)
+		}
+	}
+	if price := value("price"); price != "" {
+		if product.Price, err = repo.ParsePrice(price); err != nil {
+			return fmt.Errorf("invalid price %q", price)
+		}
+	}
+	if stock := value("stock"); stock != "" {
+		if product.Stock, err = strconv.Atoi(stock); err != nil {
+			return fmt.Errorf("invalid stock %q", stock)
+		}
+	}
+	return nil
+}
+
+func decodeNDJSON(reader io.Reader, visit func(line int, product repo.Product, err error)) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineBytes)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		product := repo.Product{}
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&product); err != nil {
+			visit(line, repo.Product{}, err)
+			continue
+		}
+		if product.Id < 0 {
+			visit(line, repo.Product{}, fmt.Errorf("invalid id %d", product.Id))
+			continue
+		}
+		product.Version, product.DeletedAt = 0, nil
+		visit(line, product, nil)
+	}
+	return scanner.Err()
+}
+
+func knownColumn(column string) bool {
+	for _, known := range csvColumns {
+		if column == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Import validates every row of reader and upserts the valid ones. The
+// report lists the failed rows by line number.
+func Import(reader io.Reader, format string, store repo.ProductTransferRepository, options repo.ImportOptions) (Report, error) {
+	report := Report{DryRun: options.DryRun, Errors: make([]LineError, 0)}
+	products := make([]repo.Product, 0)
+	lines := make([]int, 0)
+	err := Decode(reader, format, func(line int, product repo.Product, err error) {
+		report.Processed++
+		if err == nil {
+			err = repo.ValidateProduct(product)
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, LineError{Line: line, Error: err.Error()})
+			return
+		}
+		products = append(products, product)
+		lines = append(lines, line)
+	})
+	if err != nil {
+		return Report{}, &DecodeError{Err: err}
+	}
+	if len(products) == 0 {
+		return report, nil
+	}
+	results, err := store.ImportProducts(products, options)
+	if err != nil {
+		return Report{}, err
+	}
+	for index, result := range results {
+		if result.Err != nil {
+			report.Errors = append(report.Errors, LineError{Line: lines[index], Error: result.Err.Error()})
+			continue
+		}
+		report.Imported++
+	}
+	sort.Slice(report.Errors, func(i, j int) bool {
+		return report.Errors[i].Line < report.Errors[j].Line
+	})
+	return report, nil
+}
@@ -0,0 +1,197 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/segfaultx/simple_rest/pkg/repo"
+	"io"
+	"strings"
+	"testing"
+)
+
+type mockTransferRepo struct {
+	Products []repo.Product
+	Options  repo.ImportOptions
+}
+
+func (mockRepo *mockTransferRepo) StreamProducts(visit func(repo.Product) error) error {
+	for _, product := range mockRepo.Products {
+		if err := visit(product); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mockRepo *mockTransferRepo) ImportProducts(products []repo.Product, options repo.ImportOptions) ([]repo.ProductOperationResult, error) {
+	mockRepo.Options = options
+	results := make([]repo.ProductOperationResult, len(products))
+	for index, product := range products {
+		if product.Id > len(mockRepo.Products) {
+			results[index].Err = repo.ErrProductNotFound
+			continue
+		}
+		if product.Sku == "taken" {
+			results[index].Err = errors.New(repo.ErrDuplicateSku.Error())
+			continue
+		}
+		results[index].Product = product
+	}
+	return results, nil
+}
+
+func TestEncoder(t *testing.T) {
+	products := []repo.Product{{Id: 1, Name: "Hose", Sku: "H-1", Price: 1990, Brand: "Acme", Stock: 3, Version: 2,
+		Tags: []string{"sale", "wool"}, Attributes: map[string]interface{}{"color": "red"}}, {Id: 2, Name: "Jacke, rot"}}
+	tests := map[string]string{
+		FormatCSV: "id,sku,name,description,price,brand,stock,tags,attributes\n1,H-1,Hose,,19.9,Acme,3,sale|wool,\"{\"\"color\"\":\"\"red\"\"}\"\n" +
+			"2,,\"Jacke, rot\",,0,,0,,\n",
+		FormatNDJSON: "{\"id\":1,\"name\":\"Hose\",\"sku\":\"H-1\",\"price\":19.9,\"brand\":\"Acme\",\"stock\":3,\"tags\":[\"sale\",\"wool\"],\"attributes\":{\"color\":\"red\"},\"version\":2}\n{\"id\":2,\"name\":\"Jacke, rot\",\"price\":0,\"stock\":0,\"version\":0}\n",
+	}
+	for format, expected := range tests {
+		var buffer bytes.Buffer
+		encoder, err := NewEncoder(&buffer, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, product := range products {
+			_ = encoder.Encode(product)
+		}
+		_ = encoder.Flush()
+		if buffer.String() != expected {
+			t.Errorf("expected %q, received %q", expected, buffer.String())
+		}
+	}
+	if _, err := NewEncoder(&bytes.Buffer{}, "xml"); err != ErrUnknownFormat {
+		t.Errorf("expected %v, received %v", ErrUnknownFormat, err)
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	store := &mockTransferRepo{Products: []repo.Product{{Id: 1, Name: "Hose"}}}
+	input := "Name,SKU,id,price\nSchuhe,S-1,,49.95\nHut,,,\nJacke,,abc,\nSocken,,7,\nMantel,taken,,\nHemden,,1,\nKleid,,,-1\nRock,,,teuer\n"
+	report, err := Import(strings.NewReader(input), FormatCSV, store, repo.ImportOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.Options.DryRun || report.Processed != 8 || report.Imported != 2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	lines := make([]int, 0)
+	for _, lineError := range report.Errors {
+		lines = append(lines, lineError.Line)
+	}
+	if len(lines) != 6 || lines[0] != 3 || lines[1] != 4 || lines[2] != 5 || lines[3] != 6 || lines[4] != 8 || lines[5] != 9 {
+		t.Errorf("unexpected line errors %+v", report.Errors)
+	}
+}
+
+func TestDecodeCSVTagsAndAttributes(t *testing.T) {
+	input := "name,tags,attributes\nSchuhe,sale|leather,\"{\"\"size\"\":42}\"\nHut,,\nJacke,,{broken\n"
+	products := make([]repo.Product, 0)
+	failed := make([]int, 0)
+	err := Decode(strings.NewReader(input), FormatCSV, func(line int, product repo.Product, err error) {
+		if err != nil {
+			failed = append(failed, line)
+			return
+		}
+		products = append(products, product)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 2 || len(products[0].Tags) != 2 || products[0].Tags[1] != "leather" || products[0].Attributes["size"] != 42.0 ||
+		products[1].Tags != nil || products[1].Attributes != nil {
+		t.Errorf("unexpected products %+v", products)
+	}
+	if len(failed) != 1 || failed[0] != 4 {
+		t.Errorf("expected %v, received %v", []int{4}, failed)
+	}
+}
+
+func TestDecodeCSVMultiLineFields(t *testing.T) {
+	input := "name,description,price\nSchuhe,\"aus Leder,\nhandgenäht\n\",49.95\nHut,,teuer\nJacke,\"warm\",\n\"Socken,x\n"
+	failed := make([]int, 0)
+	_ = Decode(strings.NewReader(input), FormatCSV, func(line int, product repo.Product, err error) {
+		if err != nil {
+			failed = append(failed, line)
+		}
+	})
+	if len(failed) != 2 || failed[0] != 5 || failed[1] != 7 {
+		t.Errorf("expected %v, received %v", []int{5, 7}, failed)
+	}
+}
+
+func TestDecodePrices(t *testing.T) {
+	input := "name,price\nSchuhe,0.1\nHut,1234567890.99\nJacke,19.999\nSocken,1e3\n"
+	prices := make([]repo.Price, 0)
+	failed := make([]int, 0)
+	_ = Decode(strings.NewReader(input), FormatCSV, func(line int, product repo.Product, err error) {
+		if err != nil {
+			failed = append(failed, line)
+			return
+		}
+		prices = append(prices, product.Price)
+	})
+	if len(prices) != 2 || prices[0] != 10 || prices[1] != 123456789099 {
+		t.Errorf("unexpected prices %v", prices)
+	}
+	if len(failed) != 2 || failed[0] != 4 || failed[1] != 5 {
+		t.Errorf("expected %v, received %v", []int{4, 5}, failed)
+	}
+	product := repo.Product{}
+	if err := json.Unmarshal([]byte(`{"name":"Hose","price":19.90}`), &product); err != nil || product.Price != 1990 {
+		t.Errorf("expected %v, received %v (%v)", 1990, product.Price, err)
+	}
+}
+
+func TestImportNDJSON(t *testing.T) {
+	store := &mockTransferRepo{}
+	input := "{\"name\":\"Schuhe\",\"sku\":\"S-1\"}\n\n{\"name\":\"Jacke\",\"color\":\"red\"}\nnot json\n"
+	report, err := Import(strings.NewReader(input), FormatNDJSON, store, repo.ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Options.DryRun || report.Processed != 3 || report.Imported != 1 || len(report.Errors) != 2 || report.Errors[0].Line != 3 || report.Errors[1].Line != 4 {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
+
+type failingReader struct {
+	data io.Reader
+	err  error
+}
+
+func (reader *failingReader) Read(buffer []byte) (int, error) {
+	read, err := reader.data.Read(buffer)
+	if err == io.EOF {
+		return read, reader.err
+	}
+	return read, err
+}
+
+func TestImportStopsOnReadError(t *testing.T) {
+	readErr := errors.New("http: request body too large")
+	for _, format := range []string{FormatCSV, FormatNDJSON} {
+		input := "name\nSchuhe\n"
+		if format == FormatNDJSON {
+			input = "{\"name\":\"Schuhe\"}\n"
+		}
+		reader := &failingReader{data: strings.NewReader(input), err: readErr}
+		if _, err := Import(reader, format, &mockTransferRepo{}, repo.ImportOptions{}); !errors.Is(err, readErr) {
+			t.Errorf("%s: expected %v, received %v", format, readErr, err)
+		}
+	}
+}
+
+func TestImportRejectsBadHeader(t *testing.T) {
+	for _, input := range []string{"sku,title\nS-1,Schuhe\n", "id,sku\n1,S-1\n"} {
+		if _, err := Import(strings.NewReader(input), FormatCSV, &mockTransferRepo{}, repo.ImportOptions{}); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+	if _, err := Import(strings.NewReader(""), "xml", &mockTransferRepo{}, repo.ImportOptions{}); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("expected %v, received %v", ErrUnknownFormat, err)
+	}
+}